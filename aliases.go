@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+func init() {
+	configSections["aliases"] = nil
+	rawSections["aliases"] = true
+}
+
+var (
+	loadAliasesOnce sync.Once
+	aliasLabels     map[string]string // alias name to label
+	labelAliases    map[string]string // label to alias name
+)
+
+// loadAliases parses the config file's [aliases] section, whose lines name
+// devices, like:
+//
+//	gpu1 = hostpci:0000:01:00
+//	zigbee = hostusb:1a86:7523
+//
+// Invalid lines are logged and ignored, since aliases are only a convenience.
+func loadAliases() {
+	loadAliasesOnce.Do(func() {
+		aliasLabels = make(map[string]string)
+		labelAliases = make(map[string]string)
+		for _, ent := range config.sections["aliases"] {
+			i := strings.IndexByte(ent.value, '=')
+			if i < 0 {
+				warnf("%v", config.errorf(ent.line, "expected alias = resource"))
+				continue
+			}
+			name := strings.TrimSpace(ent.value[:i])
+			label := canonicalLabel(strings.TrimSpace(ent.value[i+1:]))
+			aliasLabels[name] = label
+			if _, dup := labelAliases[label]; !dup {
+				labelAliases[label] = name
+			}
+		}
+	})
+}
+
+// aliasLabel returns the label of an aliased device.
+func aliasLabel(name string) (string, bool) {
+	loadAliases()
+	label, ok := aliasLabels[name]
+	return label, ok
+}
+
+// labelAlias returns any alias of a device label, or the empty string.
+func labelAlias(label string) string {
+	loadAliases()
+	return labelAliases[label]
+}
+
+// displayLabel returns a label for display, as its alias if it has one.
+func displayLabel(label string) string {
+	if alias := labelAlias(label); alias != "" {
+		return alias
+	}
+	return label
+}
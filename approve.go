@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// approvalWait is how long the ask policy holds a start while awaiting
+// approval, before denying it; 0 denies it right away, leaving the request to
+// be approved before starting it again.
+var approvalWait = 10 * time.Minute
+
+// approvalValid is how long an approval lasts, for a start to be retried
+// after its request was denied.
+const approvalValid = time.Hour
+
+// approvalPoll is how often a held start checks for its approval.
+var approvalPoll = 2 * time.Second
+
+func init() {
+	flag.DurationVar(&approvalWait, "approval-wait", approvalWait, "how long the ask policy holds a start awaiting approval; 0 denies it until approved")
+}
+
+// approvalRequest records a start that would preempt mutuals, awaiting
+// approval, or approved.
+type approvalRequest struct {
+	Time       time.Time `json:"time"`
+	Mutuals    []string  `json:"mutuals"`
+	ApprovedAt time.Time `json:"approved_at,omitempty"`
+	ApprovedBy string    `json:"approved_by,omitempty"`
+}
+
+// awaitApproval requires approval, given by runApprove, before starting vmid
+// preempts the stopping mutuals: an approval given within approvalValid is
+// used up right away; otherwise a request is recorded, and the start is held
+// for up to approvalWait for it to be approved, or denied if it isn't. A
+// denied request stays pending, so that it may still be approved before the
+// start is tried again; runCancel rejects it instead.
+func awaitApproval(vmid string, stopping []vmInfo) error {
+	mutuals := vmIDs(stopping)
+	if dryRun {
+		infof("would await approval to preempt vm #%v", strings.Join(mutuals, ", #"))
+		return nil
+	}
+
+	approved := false
+	if err := updateState(func(st *state) error {
+		req, ok := st.Approvals[vmid]
+		if ok && !req.ApprovedAt.IsZero() && time.Since(req.ApprovedAt) < approvalValid {
+			delete(st.Approvals, vmid)
+			approved = true
+			return nil
+		}
+		if !ok || !req.ApprovedAt.IsZero() {
+			req.Time = time.Now()
+		}
+		req.Mutuals, req.ApprovedAt, req.ApprovedBy = mutuals, time.Time{}, ""
+		if st.Approvals == nil {
+			st.Approvals = make(map[string]approvalRequest)
+		}
+		st.Approvals[vmid] = req
+		return nil
+	}); err != nil {
+		return err
+	}
+	if approved {
+		infof("preempting vm #%v to start vm #%v was approved", strings.Join(mutuals, ", #"), vmid)
+		return nil
+	}
+
+	ev := userHookEvent{Point: "ask", VMID: vmid, Mutuals: mutuals}
+	runUserHook(onAskExec, ev)
+	recordEvent(event{Kind: kindAsk, VMID: vmid, Reason: "preempting vm #" + strings.Join(mutuals, ", #")})
+
+	if approvalWait <= 0 {
+		err := fmt.Errorf("preempting vm #%v needs approval; run: qmexmut approve %v, then start it again",
+			strings.Join(mutuals, ", #"), vmid)
+		return withExitCode(exitDenied, recordDenial(vmid, err))
+	}
+
+	cancelFile := cancelPath(vmid)
+	if err := os.Remove(cancelFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// printed to stdout so that it shows in the proxmox start task log
+	fmt.Printf("awaiting approval for %v to preempt vm #%v to start vm #%v; to approve, run: qmexmut approve %v\n",
+		approvalWait, strings.Join(mutuals, ", #"), vmid, vmid)
+
+	for deadline := time.Now().Add(approvalWait); time.Now().Before(deadline); {
+		time.Sleep(approvalPoll)
+		if _, err := os.Stat(cancelFile); err == nil {
+			_ = os.Remove(cancelFile)
+			if err := updateState(func(st *state) error {
+				delete(st.Approvals, vmid)
+				return nil
+			}); err != nil {
+				warnf("unable to remove approval request: %v", err)
+			}
+			recordEvent(event{Kind: kindCancel, VMID: vmid})
+			return withExitCode(exitDenied, errCancelled)
+		}
+		// polled under the shared lock, so as not to hold up other hook runs
+		st, err := readState()
+		if err != nil {
+			return err
+		}
+		if st.Approvals[vmid].ApprovedAt.IsZero() {
+			continue
+		}
+		if err := updateState(func(st *state) error {
+			if req := st.Approvals[vmid]; !req.ApprovedAt.IsZero() {
+				delete(st.Approvals, vmid)
+				approved = true
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if approved {
+			infof("preempting vm #%v to start vm #%v was approved", strings.Join(mutuals, ", #"), vmid)
+			return nil
+		}
+	}
+
+	err := fmt.Errorf("preempting vm #%v wasn't approved within %v; run: qmexmut approve %v, then start it again",
+		strings.Join(mutuals, ", #"), approvalWait, vmid)
+	return withExitCode(exitDenied, recordDenial(vmid, err))
+}
+
+// runApprove approves the pending preemption for starting the given VM, or
+// lists any pending requests if none is given.
+func runApprove(args []string) error {
+	switch len(args) {
+	case 0:
+		return listApprovals()
+	case 1:
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("usage: approve [<vmid>]"))
+	}
+	vmid := args[0]
+
+	by := os.Getenv("SUDO_USER")
+	if by == "" {
+		by = os.Getenv("USER")
+	}
+	var req approvalRequest
+	if err := updateState(func(st *state) error {
+		var ok bool
+		if req, ok = st.Approvals[vmid]; !ok {
+			return errNoApproval
+		}
+		req.ApprovedAt, req.ApprovedBy = time.Now(), by
+		st.Approvals[vmid] = req
+		return nil
+	}); errors.Is(err, errNoApproval) {
+		return withExitCode(exitUsage, fmt.Errorf("no preemption awaits approval for starting vm #%v", vmid))
+	} else if err != nil {
+		return err
+	}
+	recordEvent(event{Kind: kindApprove, VMID: vmid, By: by})
+	infof("approved preempting vm #%v to start vm #%v", strings.Join(req.Mutuals, ", #"), vmid)
+	return nil
+}
+
+var errNoApproval = errors.New("no approval request")
+
+func listApprovals() error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(st.Approvals))
+	for id := range st.Approvals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return vmidLess(ids[i], ids[j]) })
+
+	var tab table
+	tab.header("VMID", "SINCE", "PREEMPTING", "STATUS")
+	for _, id := range ids {
+		req := st.Approvals[id]
+		status := colored(colorYellow, "pending")
+		if !req.ApprovedAt.IsZero() && req.ApprovedBy != "" {
+			status = colored(colorGreen, fmt.Sprintf("approved by %v", req.ApprovedBy))
+		} else if !req.ApprovedAt.IsZero() {
+			status = colored(colorGreen, "approved")
+		}
+		tab.add(plain(id), plain(req.Time.Format(time.RFC3339)), plain("#"+strings.Join(req.Mutuals, ", #")), status)
+	}
+	if len(tab.rows) == 1 {
+		infof("no preemptions await approval")
+		return nil
+	}
+	return printTable(&tab)
+}
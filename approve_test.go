@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAwaitApproval(t *testing.T) {
+	defer func(wait, poll time.Duration) { approvalWait, approvalPoll = wait, poll }(approvalWait, approvalPoll)
+	approvalPoll = 10 * time.Millisecond
+	mutuals := []vmInfo{{listRec: listRec{id: "102"}}}
+
+	t.Run("stale cancel", func(t *testing.T) {
+		h := newFakeHost(t)
+		approvalWait = 50 * time.Millisecond
+		// left by a cancel issued when nothing was pending
+		h.write(cancelPath("101"), "")
+		err := awaitApproval("101", mutuals)
+		if errors.Is(err, errCancelled) || err == nil || !strings.Contains(err.Error(), "wasn't approved") {
+			t.Errorf("got %v, want it not approved in time", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		newFakeHost(t)
+		approvalWait = 5 * time.Second
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			time.Sleep(50 * time.Millisecond)
+			if err := os.WriteFile(cancelPath("101"), nil, 0644); err != nil {
+				t.Error(err)
+			}
+		}()
+		defer func() { <-done }()
+		if err := awaitApproval("101", mutuals); !errors.Is(err, errCancelled) {
+			t.Errorf("got %v, want it cancelled", err)
+		}
+		if _, err := os.Stat(cancelPath("101")); err == nil {
+			t.Errorf("cancel file left behind")
+		}
+	})
+
+	t.Run("approved", func(t *testing.T) {
+		newFakeHost(t)
+		approvalWait = 5 * time.Second
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for approved := false; !approved; time.Sleep(10 * time.Millisecond) {
+				if err := updateState(func(st *state) error {
+					if req, ok := st.Approvals["101"]; ok {
+						req.ApprovedAt = time.Now()
+						st.Approvals["101"] = req
+						approved = true
+					}
+					return nil
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		defer func() { <-done }()
+		if err := awaitApproval("101", mutuals); err != nil {
+			t.Errorf("got %v, want it approved", err)
+		}
+	})
+}
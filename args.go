@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// argsResourceLabels returns labels for any host devices passed thru by raw
+// QEMU arguments, like those of an args: config line:
+//
+//	-device vfio-pci,host=01:00.0
+//	-device vfio-pci,sysfsdev=/sys/bus/pci/devices/0000:01:00.0
+//	-device usb-host,vendorid=0x1a86,productid=0x7523
+//	-device usb-host,hostbus=1,hostport=2
+//
+// Under sharedDirs, host directories shared by 9p are labeled too:
+//
+//	-virtfs local,path=/srv/share,mount_tag=share
+//	-fsdev local,id=fs0,path=/srv/share
+func argsResourceLabels(args string) (labels []string) {
+	fields := strings.Fields(args)
+	for i := 0; i < len(fields); i++ {
+		opt, val := strings.TrimLeft(fields[i], "-"), ""
+		if j := strings.IndexByte(opt, '='); j >= 0 {
+			opt, val = opt[:j], opt[j+1:]
+		}
+		if opt != "device" && opt != "virtfs" && opt != "fsdev" {
+			continue
+		}
+		if val == "" && i+1 < len(fields) {
+			i++
+			val = fields[i]
+		}
+		val = strings.Trim(val, `"'`)
+
+		var label string
+		if opt == "device" {
+			label = deviceArgLabel(val)
+		} else if sharedDirs != "off" {
+			label = fsdevArgLabel(val)
+		}
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// deviceArgLabel returns the label of a host device passed thru by a QEMU
+// -device value, or "" if it passes thru none.
+func deviceArgLabel(dev string) string {
+	opts := strings.Split(dev, ",")
+	props := make(map[string]string, len(opts))
+	for _, opt := range opts[1:] {
+		if i := strings.IndexByte(opt, '='); i > 0 {
+			props[opt[:i]] = opt[i+1:]
+		}
+	}
+
+	switch opts[0] {
+	case "vfio-pci":
+		if host := props["host"]; host != "" {
+			return "hostpci:" + pciResource(host)
+		}
+		if sysfsdev := props["sysfsdev"]; sysfsdev != "" {
+			return "hostpci:" + pciResource(sysfsdev[strings.LastIndexByte(sysfsdev, '/')+1:])
+		}
+
+	case "usb-host":
+		vendor, product := usbArgID(props["vendorid"]), usbArgID(props["productid"])
+		if vendor != "" && product != "" {
+			return usbLabel(vendor + ":" + product)
+		}
+		if bus, port := props["hostbus"], props["hostport"]; bus != "" && port != "" {
+			return usbLabel(bus + "-" + port)
+		}
+	}
+	return ""
+}
+
+// fsdevArgLabel returns the label of a host directory shared by a QEMU
+// -virtfs or -fsdev value, or "" if it shares none.
+func fsdevArgLabel(fsdev string) string {
+	for _, opt := range strings.Split(fsdev, ",")[1:] {
+		if strings.HasPrefix(opt, "path=") {
+			return hostDirLabel(strings.TrimPrefix(opt, "path="))
+		}
+	}
+	return ""
+}
+
+// usbArgID formats a USB vendor or product id, given to QEMU as any integer,
+// as the 4 hex digits that proxmox uses.
+func usbArgID(s string) string {
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(n|0x10000, 16)[1:]
+}
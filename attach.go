@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// verifyAttach enables checking, once a VM has started, that qemu actually
+// has its passed thru devices attached.
+var verifyAttach = true
+
+func init() {
+	flag.BoolVar(&verifyAttach, "verify-attach", verifyAttach, "check that passed thru devices are attached once a VM starts")
+}
+
+// qemu device ids given by proxmox to passed thru devices, like hostpci0, or
+// hostpci0.1 for further functions, and usb0.
+var (
+	monitorPCIPat = regexp.MustCompile(`id "(hostpci\d+)`)
+	monitorUSBPat = regexp.MustCompile(`ID: (usb\d+)`)
+)
+
+// verifyAttached checks, using the qemu monitor, that every device passed
+// thru by a started VM is attached; silent VFIO attach failures otherwise
+// only surface as mysterious guest problems. Any missing devices are logged,
+// printed to the start task log, and recorded as an attach event; an error is
+// only returned if the check couldn't be made.
+func verifyAttached(id string) error {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for key, val := range conf {
+		// devices given by raw args have no monitor id of the key's name
+		if key != "args" && len(hostResourceLabels(key, val)) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	attached := make(map[string]bool)
+	for _, query := range []struct {
+		cmd string
+		pat *regexp.Regexp
+	}{
+		{"info pci", monitorPCIPat},
+		{"info usb", monitorUSBPat},
+	} {
+		ids, err := monitorIDs(id, query.cmd, query.pat)
+		if err != nil {
+			return err
+		}
+		for _, dev := range ids {
+			attached[dev] = true
+		}
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if !attached[key] {
+			missing = append(missing, fmt.Sprintf("%v (%v)", key, describeDevices(hostResourceLabels(key, conf[key]))))
+		}
+	}
+	if len(missing) == 0 {
+		debugf("vm #%v has all of %v attached", id, strings.Join(keys, ","))
+		return nil
+	}
+	msg := fmt.Sprintf("passed thru devices not attached: %v", strings.Join(missing, ", "))
+	// printed to stdout so that it shows in the proxmox start task log
+	fmt.Printf("qmexmut: vm #%v %v\n", id, msg)
+	recordEvent(event{Kind: kindAttach, VMID: id, Error: msg})
+	return nil
+}
+
+// monitorIDs runs a qemu monitor command, returning every device id matched
+// in its output.
+func monitorIDs(id, command string, pat *regexp.Regexp) (ids []string, rerr error) {
+	cmd := exec.Command("qm", "monitor", id)
+	cmd.Stdin = strings.NewReader(command + "\n")
+	cmm := matchCommand(cmd, pat)
+	defer cmm.Cleanup(&rerr)
+	for cmm.Scan() {
+		ids = append(ids, cmm.MatchText(1))
+	}
+	return ids, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// benchVMs is how many VMs the benchmarks scan, about as many as a large host
+// or small cluster has.
+const benchVMs = 500
+
+// addBenchVMs adds n synthetic VMs to a fake host, in groups of 4 sharing a
+// GPU, with a USB device shared by every 10th VM, and the disks, networks,
+// and other config that real VMs carry.
+func addBenchVMs(h *fakeHost, n int) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprint(100 + i)
+		gpu := fmt.Sprintf("0000:%02x:00", 1+i/4%0xfe)
+		if i%4 == 0 {
+			h.addPCI(gpu+".0", fmt.Sprint(i/4))
+		}
+		conf := []string{
+			"name: vm" + id,
+			"boot: order=scsi0;net0",
+			"cores: 4",
+			"memory: 8192",
+			"net0: virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1",
+			"scsi0: local-lvm:vm-" + id + "-disk-0,iothread=1,size=64G",
+			"scsihw: virtio-scsi-single",
+			"hostpci0: " + gpu + ",pcie=1,x-vga=1",
+			"tags: bench;group" + fmt.Sprint(i/4),
+		}
+		if i%10 == 0 {
+			conf = append(conf, "usb0: host=1a86:7523")
+		}
+		if i%25 == 0 {
+			conf = append(conf, "args: -device vfio-pci,host=0000:ff:00.0")
+		}
+		h.addVM(id, "stopped", conf...)
+	}
+}
+
+// benchHost returns a fake host with benchVMs synthetic VMs, read offline, so
+// that no qm is run for them.
+func benchHost(b *testing.B) *fakeHost {
+	h := newFakeHost(b)
+	addBenchVMs(h, benchVMs)
+	prior := offlineDir
+	offlineDir = h.path("vms")
+	b.Cleanup(func() { offlineDir = prior })
+	return h
+}
+
+func BenchmarkScanVMs(b *testing.B) {
+	benchHost(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scanVMs(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchConfigHost returns a fake host with one VM, whose config carries the
+// disks, devices, and long description of a well used VM.
+func benchConfigHost(b *testing.B) *fakeHost {
+	h := newFakeHost(b)
+	h.addPCI("0000:01:00.0", "1")
+	conf := []string{
+		"agent: 1",
+		"bios: ovmf",
+		"boot: order=scsi0;net0",
+		"cores: 8",
+		"cpu: host",
+		"description: " + strings.Repeat("notes%20on%20this%20vm%0A", 100),
+		"efidisk0: local-lvm:vm-100-disk-0,efitype=4m,size=4M",
+		"hostpci0: 0000:01:00,pcie=1,x-vga=1",
+		"machine: q35",
+		"memory: 16384",
+		"name: vm100",
+		"ostype: l26",
+		"scsihw: virtio-scsi-single",
+		"smbios1: uuid=5f3c2a4e-8d6b-4b7e-9a1c-2d3e4f5a6b7c",
+		"tags: bench;group0",
+		"usb0: host=1a86:7523",
+		"vmgenid: 0c1d2e3f-4a5b-6c7d-8e9f-a0b1c2d3e4f5",
+	}
+	for i := 0; i < 4; i++ {
+		conf = append(conf,
+			fmt.Sprintf("net%d: virtio=BC:24:11:00:00:%02d,bridge=vmbr%d,firewall=1", i, i+1, i),
+			fmt.Sprintf("scsi%d: local-lvm:vm-100-disk-%d,iothread=1,size=256G", i, i+1))
+	}
+	h.addVM("100", "stopped", conf...)
+	return h
+}
+
+// BenchmarkScanVMConfig scans a VM config thru qm config, as every pre-start
+// does for each VM not yet in the config cache.
+func BenchmarkScanVMConfig(b *testing.B) {
+	benchConfigHost(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scanVMConfig("100"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMatchConfig matches recorded qm config output, apart from the cost
+// of the fake qm that produced it.
+func BenchmarkMatchConfig(b *testing.B) {
+	h := benchConfigHost(b)
+	out, err := exec.Command("qm", "config", "100").Output()
+	if err != nil {
+		b.Fatal(err)
+	}
+	recorded := h.path("100.config")
+	h.write(recorded, string(out))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmm := matchCommand(exec.Command("cat", recorded), keyValPat)
+		n := 0
+		for cmm.Scan() {
+			n++
+		}
+		var err error
+		cmm.Cleanup(&err)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n < 20 {
+			b.Fatalf("matched only %v lines", n)
+		}
+	}
+}
+
+// BenchmarkScanWorkers scans the synthetic VMs thru the stub qm, as a host
+// with an empty config cache does, at various -scan-workers.
+func BenchmarkScanWorkers(b *testing.B) {
+	h := newFakeHost(b)
+	addBenchVMs(h, benchVMs)
+	defer func(prior int) { scanWorkers = prior }(scanWorkers)
+	for _, workers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprint(workers), func(b *testing.B) {
+			scanWorkers = workers
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				h.resetCaches()
+				b.StartTimer()
+				if _, err := scanVMs(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHostResourceLabels(b *testing.B) {
+	benchHost(b)
+	vms, err := scanVMs()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, vm := range vms {
+			vm.config.hostResources()
+		}
+	}
+}
+
+func BenchmarkMutualsOf(b *testing.B) {
+	benchHost(b)
+	vms, err := scanVMs()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, vm := range vms {
+			mutualsOf(vm.id, vms)
+		}
+	}
+}
+
+func BenchmarkPCIResource(b *testing.B) {
+	benchHost(b)
+	for _, gran := range pciGranularities {
+		b.Run(gran, func(b *testing.B) {
+			defer func(prior string) { pciGranularity = prior }(pciGranularity)
+			pciGranularity = gran
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pciResource(fmt.Sprintf("%02x:00.0", 1+i%0xfe))
+			}
+		})
+	}
+}
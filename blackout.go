@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blackoutWindow is a recurring time window, given in the [blackout] config
+// section, during which mutuals are never preempted:
+//
+//	[blackout]
+//	# nightly backups
+//	* 01:00-03:00
+//	# business hours, queueing starts instead of denying them
+//	mon-fri 08:00-18:00 queue
+//
+// The days and times are parsed as a timeWindow.
+type blackoutWindow struct {
+	timeWindow
+	line   int
+	text   string
+	action string // deny or queue
+}
+
+// timeWindow is a recurring daily time window, like "mon-fri 08:00-18:00".
+// Days are given like a cron day of week field: * for every day, or a comma
+// separated list of day names or numbers (0 or 7 for sunday), and ranges of
+// them. A window that ends before it starts continues past midnight, into the
+// next day; one that ends when it starts lasts all day.
+type timeWindow struct {
+	days  [7]bool
+	start int // minute of the day
+	end   int
+}
+
+var blackoutActions = []string{"deny", "queue"}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func init() {
+	configSections["blackout"] = nil
+	rawSections["blackout"] = true
+}
+
+var (
+	loadBlackoutsOnce sync.Once
+	loadedBlackouts   []blackoutWindow
+	loadBlackoutsErr  error
+)
+
+// configBlackouts returns the blackout windows parsed from the config file,
+// failing on the first invalid one.
+func configBlackouts() ([]blackoutWindow, error) {
+	loadBlackoutsOnce.Do(func() {
+		var errs []error
+		loadedBlackouts, errs = parseBlackouts(config)
+		if len(errs) > 0 {
+			loadBlackoutsErr = errs[0]
+		}
+	})
+	return loadedBlackouts, loadBlackoutsErr
+}
+
+// activeBlackout returns the first blackout window containing the given
+// time, if any.
+func activeBlackout(t time.Time) (*blackoutWindow, error) {
+	windows, err := configBlackouts()
+	if err != nil {
+		return nil, err
+	}
+	for i := range windows {
+		if windows[i].contains(t) {
+			return &windows[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// parseBlackouts parses all blackout windows in the config, returning all
+// valid windows, and an error for each invalid one.
+func parseBlackouts(cf configFile) (windows []blackoutWindow, errs []error) {
+	for _, ent := range cf.sections["blackout"] {
+		bw, err := parseBlackout(ent.value)
+		if err != nil {
+			errs = append(errs, cf.errorf(ent.line, "%w", err))
+			continue
+		}
+		bw.line = ent.line
+		windows = append(windows, bw)
+	}
+	return windows, errs
+}
+
+func parseBlackout(text string) (bw blackoutWindow, err error) {
+	bw.text = text
+	fields := strings.Fields(text)
+	if len(fields) < 2 || len(fields) > 3 {
+		return bw, fmt.Errorf("expected <days> <HH:MM>-<HH:MM> [deny|queue]")
+	}
+	if bw.timeWindow, err = parseTimeWindow(fields[0], fields[1]); err != nil {
+		return bw, err
+	}
+
+	bw.action = "deny"
+	if len(fields) > 2 {
+		if !hasString(fields[2], blackoutActions) {
+			return bw, fmt.Errorf("invalid blackout action %q, must be one of %v", fields[2], strings.Join(blackoutActions, ", "))
+		}
+		bw.action = fields[2]
+	}
+	return bw, nil
+}
+
+// parseTimeWindow parses a window's days and time range, like "mon-fri" and
+// "08:00-18:00".
+func parseTimeWindow(days, times string) (tw timeWindow, err error) {
+	if err := tw.parseDays(days); err != nil {
+		return tw, err
+	}
+	i := strings.IndexByte(times, '-')
+	if i < 0 {
+		return tw, fmt.Errorf("expected a time range like 08:00-18:00, got %q", times)
+	}
+	if tw.start, err = parseClock(times[:i]); err != nil {
+		return tw, err
+	}
+	if tw.end, err = parseClock(times[i+1:]); err != nil {
+		return tw, err
+	}
+	return tw, nil
+}
+
+func (tw *timeWindow) parseDays(s string) error {
+	if s == "*" {
+		for d := range tw.days {
+			tw.days[d] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		lo, hi := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		from, err := parseDay(lo)
+		if err != nil {
+			return err
+		}
+		to, err := parseDay(hi)
+		if err != nil {
+			return err
+		}
+		if to < from {
+			to += 7 // like fri-mon
+		}
+		for d := from; d <= to; d++ {
+			tw.days[d%7] = true
+		}
+	}
+	return nil
+}
+
+// parseDay parses a day of the week, by name or cron number.
+func parseDay(s string) (int, error) {
+	for d, name := range dayNames {
+		if strings.EqualFold(s, name) {
+			return d, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+		return n % 7, nil
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+// parseClock parses a HH:MM time of day into minutes since midnight; 24:00
+// is allowed to end a window at midnight.
+func parseClock(s string) (int, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, herr := strconv.Atoi(s[:i])
+	m, merr := strconv.Atoi(s[i+1:])
+	if herr != nil || merr != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m > 0 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains returns true if the window covers the given local time.
+func (tw timeWindow) contains(t time.Time) bool {
+	day, minute := int(t.Weekday()), t.Hour()*60+t.Minute()
+	switch {
+	case tw.start < tw.end:
+		return tw.days[day] && minute >= tw.start && minute < tw.end
+	case tw.start == tw.end:
+		return tw.days[day]
+	default:
+		return tw.days[day] && minute >= tw.start || tw.days[(day+6)%7] && minute < tw.end
+	}
+}
+
+// startOf returns when the occurrence of the window containing t started.
+func (tw timeWindow) startOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, tw.start/60, tw.start%60, 0, 0, t.Location())
+	if start.After(t) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBlackout(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		days   string // of the week, from sunday, like "-MTWTF-"
+		start  int
+		end    int
+		action string
+		err    string
+	}{
+		{text: "* 01:00-03:00", days: "SMTWTFS", start: 60, end: 180, action: "deny"},
+		{text: "mon-fri 08:00-18:00 queue", days: "-MTWTF-", start: 480, end: 1080, action: "queue"},
+		{text: "fri-mon 22:00-06:00", days: "SM---FS", start: 1320, end: 360, action: "deny"},
+		{text: "sat,0 00:00-24:00", days: "S-----S", start: 0, end: 1440, action: "deny"},
+		{text: "7,1-2 12:00-12:00", days: "SMT----", start: 720, end: 720, action: "deny"},
+		{text: "* 01:00-03:00 allow", err: `invalid blackout action "allow"`},
+		{text: "* 01:00", err: "expected a time range"},
+		{text: "* 1:00-25:00", err: `invalid time "25:00"`},
+		{text: "* 24:30-01:00", err: `invalid time "24:30"`},
+		{text: "someday 01:00-03:00", err: `invalid day "someday"`},
+		{text: "*", err: "expected <days>"},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			bw, err := parseBlackout(tc.text)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			days := []byte("-------")
+			for d, on := range bw.days {
+				if on {
+					days[d] = "SMTWTFS"[d]
+				}
+			}
+			if string(days) != tc.days || bw.start != tc.start || bw.end != tc.end || bw.action != tc.action {
+				t.Errorf("got %s %v-%v %v, want %s %v-%v %v",
+					days, bw.start, bw.end, bw.action, tc.days, tc.start, tc.end, tc.action)
+			}
+		})
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("Mon 2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, tc := range []struct {
+		days, times string
+		at          string
+		contains    bool
+		start       string // of the occurrence containing at
+	}{
+		{"mon-fri", "08:00-18:00", "Wed 2024-01-03 12:00", true, "Wed 2024-01-03 08:00"},
+		{"mon-fri", "08:00-18:00", "Wed 2024-01-03 18:00", false, ""},
+		{"mon-fri", "08:00-18:00", "Sat 2024-01-06 12:00", false, ""},
+
+		// across midnight, the window belongs to the day that it starts
+		{"fri", "22:00-06:00", "Fri 2024-01-05 23:00", true, "Fri 2024-01-05 22:00"},
+		{"fri", "22:00-06:00", "Sat 2024-01-06 05:59", true, "Fri 2024-01-05 22:00"},
+		{"fri", "22:00-06:00", "Sat 2024-01-06 06:00", false, ""},
+		{"fri", "22:00-06:00", "Fri 2024-01-05 05:00", false, ""},
+		{"fri", "22:00-06:00", "Sat 2024-01-06 23:00", false, ""},
+		{"sat", "22:00-06:00", "Sun 2024-01-07 01:00", true, "Sat 2024-01-06 22:00"},
+
+		// across midnight at the end of the month and year
+		{"*", "23:00-01:00", "Mon 2024-01-01 00:30", true, "Sun 2023-12-31 23:00"},
+
+		// all day, when it ends as it starts
+		{"sun", "00:00-00:00", "Sun 2024-01-07 23:59", true, "Sun 2024-01-07 00:00"},
+		{"sun", "00:00-00:00", "Mon 2024-01-08 00:00", false, ""},
+		{"*", "00:00-24:00", "Tue 2024-01-02 23:59", true, "Tue 2024-01-02 00:00"},
+	} {
+		t.Run(tc.days+" "+tc.times+" at "+tc.at, func(t *testing.T) {
+			tw, err := parseTimeWindow(tc.days, tc.times)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tw.contains(at(tc.at)); got != tc.contains {
+				t.Fatalf("got contains %v, want %v", got, tc.contains)
+			}
+			if !tc.contains {
+				return
+			}
+			if got := tw.startOf(at(tc.at)); !got.Equal(at(tc.start)) {
+				t.Errorf("got start %v, want %v", got.Format("Mon 2006-01-02 15:04"), tc.start)
+			}
+		})
+	}
+}
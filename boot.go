@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	vmSettings["boot-priority"] = "when several mutuals start on boot, the highest priority wins"
+}
+
+// bootUnitPath is where the boot unit should be installed.
+const bootUnitPath = "/etc/systemd/system/qmexmut-boot.service"
+
+// bootUnit is a systemd unit that runs boot arbitration before proxmox starts
+// any onboot VMs, using the binary installed by init.
+const bootUnit = `[Unit]
+Description=Arbitrate host resources between onboot VMs
+After=pve-cluster.service
+Before=pve-guests.service
+
+[Service]
+Type=oneshot
+ExecStart=%v boot
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// runBoot arbitrates between onboot VMs: within each exclusion domain (a set
+// of VMs connected by sharing host resources) only one VM may start on boot,
+// otherwise each would preempt the last as proxmox starts them. The winner is
+// the VM with the highest boot-priority, then the first in startup order; any
+// others have onboot cleared, as claimMutualOnboot would have done had they
+// been started normally.
+//
+// With a -unit argument, it instead prints a systemd unit to run it on boot.
+func runBoot(args []string) error {
+	if len(args) == 1 && args[0] == "-unit" {
+		fmt.Printf(bootUnit, libPath())
+		return nil
+	}
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: boot [-unit]"))
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	var booting []vmInfo
+	for _, vm := range vms {
+		will, err := vm.config.willBoot()
+		if err != nil {
+			return fmt.Errorf("vm #%v: %w", vm.id, err)
+		}
+		if will && len(exclusiveResources(vm.resources)) > 0 {
+			booting = append(booting, vm)
+		}
+	}
+
+	for _, domain := range exclusionDomains(booting) {
+		if len(domain) < 2 {
+			continue
+		}
+		prios := make(map[string]int, len(domain))
+		for _, vm := range domain {
+			prio, err := bootPriority(vm)
+			if err != nil {
+				return err
+			}
+			prios[vm.id] = prio
+		}
+		sort.SliceStable(domain, func(i, j int) bool {
+			if pi, pj := prios[domain[i].id], prios[domain[j].id]; pi != pj {
+				return pi > pj
+			}
+			return startupLess(domain[i], domain[j])
+		})
+
+		winner := domain[0]
+		for _, loser := range domain[1:] {
+			if err := maybeRun("qm", "set", loser.id, "-onboot", "0"); err != nil {
+				return err
+			}
+			recordEvent(event{Kind: kindBoot, VMID: loser.id, By: winner.id})
+		}
+	}
+	return nil
+}
+
+// bootPriority returns the VM's boot-priority setting, 0 by default.
+func bootPriority(vm vmInfo) (int, error) {
+	val, ok := vm.setting("boot-priority")
+	if !ok {
+		return 0, nil
+	}
+	prio, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("vm #%v: invalid boot-priority %q", vm.id, val)
+	}
+	return prio, nil
+}
+
+// exclusionDomains partitions VMs into sets connected by being mutuals.
+func exclusionDomains(vms []vmInfo) (domains [][]vmInfo) {
+	seen := make([]bool, len(vms))
+	for i := range vms {
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		domain := []vmInfo{vms[i]}
+		for k := 0; k < len(domain); k++ {
+			for j := range vms {
+				if !seen[j] && areMutuals(domain[k], vms[j]) {
+					seen[j] = true
+					domain = append(domain, vms[j])
+				}
+			}
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
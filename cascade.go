@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// maxCascade limits how many starts may be chained by the hook itself, like
+// a yield-back restarting a VM whose own hook then restarts another.
+var maxCascade = 3
+
+func init() {
+	flag.IntVar(&maxCascade, "max-cascade", maxCascade, "maximum depth of VM starts caused by the hook starting other VMs")
+}
+
+// hookChain lists the VMs whose hook runs led to the current one, ending with
+// the VM that it's running for; it's empty outside of a hook run.
+var hookChain []string
+
+// loadHookChain sets hookChain for a hook run on the given VM, from any chain
+// recorded when the hook started it.
+func loadHookChain(id string) error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	hookChain = append(append([]string(nil), st.Chains[id]...), id)
+	return nil
+}
+
+// recordChain notes that the current hook run is about to start the given VM,
+// so that its own hook run can tell that it's part of a cascade.
+func recordChain(id string) error {
+	if len(hookChain) == 0 {
+		return nil
+	}
+	return updateState(func(st *state) error {
+		if st.Chains == nil {
+			st.Chains = make(map[string][]string)
+		}
+		st.Chains[id] = hookChain
+		return nil
+	})
+}
+
+// clearChain forgets any chain recorded for the given VM, once its start has
+// been decided.
+func clearChain(id string) error {
+	return updateState(func(st *state) error {
+		delete(st.Chains, id)
+		return nil
+	})
+}
+
+// checkCascade denies a start caused by too long a chain of hook runs, or one
+// that would stop a VM earlier in its chain, which would loop.
+func checkCascade(stopping []vmInfo) error {
+	if len(hookChain) == 0 {
+		return nil
+	}
+	desc := strings.Join(hookChain, " -> ")
+	if depth := len(hookChain) - 1; depth > maxCascade {
+		return withExitCode(exitDenied, fmt.Errorf("cascade %v exceeds max-cascade %v", desc, maxCascade))
+	}
+	for _, vm := range stopping {
+		if hasString(vm.id, hookChain[:len(hookChain)-1]) {
+			return withExitCode(exitDenied, fmt.Errorf("would stop vm #%v, looping cascade %v", vm.id, desc))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// resourceClasses lists the kinds of host resource label, as their prefix.
+var resourceClasses = []string{"hostpci", "hostusb", "hostdir"}
+
+// onlyClasses and ignoreClasses restrict which resource classes are enforced
+// as exclusive, like only hostpci to manage GPUs but not USB devices.
+var onlyClasses, ignoreClasses listFlag
+
+func init() {
+	flag.Var(classListFlag{&onlyClasses}, "only", "comma separated resource classes to enforce, ignoring all others: hostpci, hostusb, hostdir")
+	flag.Var(classListFlag{&ignoreClasses}, "ignore", "comma separated resource classes to ignore: hostpci, hostusb, hostdir")
+}
+
+// classListFlag is a listFlag restricted to resourceClasses.
+type classListFlag struct{ *listFlag }
+
+func (cf classListFlag) String() string {
+	if cf.listFlag == nil {
+		return ""
+	}
+	return cf.listFlag.String()
+}
+
+func (cf classListFlag) Set(s string) error {
+	if err := cf.listFlag.Set(s); err != nil {
+		return err
+	}
+	for _, class := range *cf.listFlag {
+		if !hasString(class, resourceClasses) {
+			return fmt.Errorf("unknown resource class %q, must be one of %s", class, strings.Join(resourceClasses, ", "))
+		}
+	}
+	return nil
+}
+
+// resourceClass returns a label's class, like hostpci.
+func resourceClass(label string) string {
+	if i := strings.IndexByte(label, ':'); i >= 0 {
+		return label[:i]
+	}
+	return label
+}
+
+// isIgnoredClass returns true if a label's class isn't enforced.
+func isIgnoredClass(label string) bool {
+	class := resourceClass(label)
+	if len(onlyClasses) > 0 && !hasString(class, onlyClasses) {
+		return true
+	}
+	return hasString(class, ignoreClasses)
+}
+
+// isEnforced returns true if a label may make VMs mutuals: it's neither
+// shareable, of an ignored class, one of several identical USB devices, nor a
+// vGPU profile with instances to spare.
+func isEnforced(label string) bool {
+	return !isShareable(label) && !isIgnoredClass(label) && !isIdenticalUSB(label) && !isSpareMdev(label) && !isDisabled(label)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// managedRecord records when qmexmut hooked a VM, and which exclusive host
+// resources it passed thru then.
+type managedRecord struct {
+	Time      time.Time `json:"time"`
+	Resources []string  `json:"resources,omitempty"`
+}
+
+// registerVM records that qmexmut manages a VM, having hooked it, once init
+// or reconcile has established the registry of managed VMs.
+func registerVM(id string, conf vmConfig) error {
+	return updateState(func(st *state) error {
+		if st.Managed != nil {
+			st.Managed[id] = managedRecord{
+				Time:      time.Now(),
+				Resources: exclusiveResources(conf.hostResources()),
+			}
+		}
+		return nil
+	})
+}
+
+// establishRegistry creates the registry of managed VMs, returning true if
+// it didn't exist yet, as after upgrading from a version that kept none; any
+// VMs already hooked then should be registered quietly.
+func establishRegistry() (created bool, _ error) {
+	return created, updateState(func(st *state) error {
+		if st.Managed == nil {
+			st.Managed = make(map[string]managedRecord)
+			created = true
+		}
+		return nil
+	})
+}
+
+// adoptHooked registers a VM found hooked without qmexmut having hooked it,
+// as when it was cloned from a managed VM, inheriting its hookscript, but
+// perhaps not its devices. It returns true if the VM was unknown, unless
+// quiet, or the registry isn't established yet.
+func adoptHooked(id string, conf vmConfig, quiet bool) (bool, error) {
+	st, err := readState()
+	if err != nil {
+		return false, err
+	}
+	if _, known := st.Managed[id]; known || st.Managed == nil {
+		return false, nil
+	}
+	if err := registerVM(id, conf); err != nil {
+		return false, err
+	}
+	if quiet {
+		return false, nil
+	}
+	recordEvent(event{Kind: kindAdopt, VMID: id})
+	return true, nil
+}
+
+// describeAdopted explains that a VM was adopted by adoptHooked, with the
+// resources that it's now managed for.
+func describeAdopted(id string, conf vmConfig) string {
+	desc := fmt.Sprintf("vm #%v was hooked outside of qmexmut, like by cloning a managed vm; registered it", id)
+	exclusive := exclusiveResources(conf.hostResources())
+	if len(exclusive) > 0 {
+		desc += fmt.Sprintf(" for %v", describeResources(exclusive))
+	}
+	return desc
+}
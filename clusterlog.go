@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// clusterLog has decisions, like preemptions, denials, and violations, also
+// logged to the proxmox cluster log, so that they show in the web UI's
+// cluster log pane alongside other cluster events.
+var clusterLog = false
+
+func init() {
+	flag.BoolVar(&clusterLog, "cluster-log", false, "also log decisions like preemptions and denials to the proxmox cluster log")
+	subscribeEvents("the cluster log", false, logClusterEvent)
+}
+
+// clusterLogTimeout bounds logging each event to the cluster log.
+const clusterLogTimeout = 5 * time.Second
+
+// clusterLogScript logs a message to the cluster log; proxmox has no command
+// for this, so it's done thru its perl API, as its own daemons do.
+const clusterLogScript = `use PVE::Cluster; PVE::Cluster::log_msg(@ARGV)`
+
+// logClusterEvent logs any decision event to the cluster log, under
+// clusterLog.
+func logClusterEvent(ev event) error {
+	if !clusterLog || ev.VMID == "" || !hasKind(ev.Kind, decisionKinds) {
+		return nil
+	}
+	priority := "info"
+	if decisionColor(ev) == colorRed {
+		priority = "warning"
+	}
+	msg := fmt.Sprintf("qmexmut: vm %v %v", ev.VMID, describeDecision(ev, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterLogTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "perl", "-e", clusterLogScript, priority, "root@pam", msg)
+	stderr := captureStderr(cmd)
+	done, err := startCommand(cmd)
+	if err == nil {
+		err = cmd.Wait()
+		done(err)
+		if err != nil {
+			err = commandError(cmd, stderr, err)
+		}
+	}
+	return err
+}
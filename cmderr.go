@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// stderrBuffer captures the start of a command's stderr, so that any error
+// it reports can be surfaced, without letting a chatty command grow memory.
+type stderrBuffer struct {
+	buf []byte
+}
+
+const maxStderr = 8 * 1024
+
+func (sb *stderrBuffer) Write(p []byte) (int, error) {
+	if room := maxStderr - len(sb.buf); room > 0 {
+		if len(p) > room {
+			sb.buf = append(sb.buf, p[:room]...)
+		} else {
+			sb.buf = append(sb.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// captureStderr sets a command's stderr to be captured, unless already set.
+func captureStderr(cmd *exec.Cmd) *stderrBuffer {
+	sb, ok := cmd.Stderr.(*stderrBuffer)
+	if !ok && cmd.Stderr == nil {
+		sb = &stderrBuffer{}
+		cmd.Stderr = sb
+	}
+	return sb
+}
+
+// commandError explains a failed command by any error reported on its
+// stderr, as qm and pvesh report proxmox API errors, with a hint at how to
+// resolve common ones; err is still wrapped, for errors.Is and exit codes.
+func commandError(cmd *exec.Cmd, stderr *stderrBuffer, err error) error {
+	if stderr == nil {
+		return fmt.Errorf("%q failed: %w", cmd.Args, err)
+	}
+	reason, hint := describeStderr(string(stderr.buf))
+	switch {
+	case reason == "":
+		return fmt.Errorf("%q failed: %w", cmd.Args, err)
+	case hint == "":
+		return fmt.Errorf("%q failed: %v: %w", cmd.Args, reason, err)
+	default:
+		return fmt.Errorf("%q failed: %v (%v): %w", cmd.Args, reason, hint, err)
+	}
+}
+
+// apiStatusPat matches the HTTP status of an API error, which pvesh gives
+// after its headline, and qm before it.
+var apiStatusPat = regexp.MustCompile(`^\d{3} |\s*\(\d{3}\)$`)
+
+// stderrHints maps patterns of common proxmox errors to hints at resolving
+// them; any submatch is substituted into the hint.
+var stderrHints = []struct {
+	pat  *regexp.Regexp
+	hint string
+}{
+	{regexp.MustCompile(`^Permission check failed \(([^,]+), ([^)]+)\)`), "run as root, or grant $2 on $1"},
+	{regexp.MustCompile(`^Configuration file '.*' does not exist`), "no such VM on this node, it may be on another cluster node"},
+	{regexp.MustCompile(`^VM is locked \((\w+)\)`), "wait for the $1 to finish, or clear it with qm unlock"},
+	{regexp.MustCompile(`ipcc_send_rec|pve-cluster|Connection refused`), "check that the pve-cluster service is running"},
+	{regexp.MustCompile(`(?i)got timeout|timed out`), "the node may be overloaded, try again"},
+}
+
+// describeStderr returns the error reported on a command's stderr, and any
+// hint at resolving it. Proxmox API errors have a headline, like:
+//
+//	400 Parameter verification failed.
+//	tags: invalid format - value does not match the regex pattern
+//
+// in which case the reason names each failed parameter.
+func describeStderr(stderr string) (reason, hint string) {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "", ""
+	}
+	head := apiStatusPat.ReplaceAllString(lines[0], "")
+	head = strings.TrimSuffix(head, ".")
+	reason = head
+	if strings.HasPrefix(head, "Parameter verification failed") && len(lines) > 1 {
+		reason = head + ": " + strings.Join(lines[1:], "; ")
+	}
+	for _, h := range stderrHints {
+		if match := h.pat.FindStringSubmatchIndex(head); match != nil {
+			hint = string(h.pat.ExpandString(nil, h.hint, head, match))
+			break
+		}
+	}
+	return reason, hint
+}
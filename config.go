@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+// configPath is the qmexmut config file; it lives in the proxmox cluster
+// filesystem by default, so that it applies to every node.
+var configPath = "/etc/pve/qmexmut.conf"
+
+func init() {
+	flag.StringVar(&configPath, "config", configPath, "config file path")
+}
+
+// config is the loaded config file, empty if there is none.
+var config configFile
+
+// givenFlags are the flags given on the command line, which config file
+// settings don't override.
+var givenFlags map[string]bool
+
+// configFile is a parsed config file of the form:
+//
+//	# global settings provide defaults for flags not given on the command line
+//	shutdown-order = startup
+//
+//	# sections are named by a kind and argument, like per-VM settings
+//	[vm 101]
+//	shutdown-timeout = 600
+type configFile struct {
+	path     string
+	global   []configEntry
+	sections map[string][]configEntry
+}
+
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// vmSettings lists keys valid within [vm <vmid>] config sections, mapped to
+// their usage; they may also be given to a VM with a qmexmut.<key>.<value> tag.
+var vmSettings = map[string]string{}
+
+// globalSettings lists the flags that may be given as global settings in the
+// config file: those that change how qmexmut behaves. Flags that only apply
+// to one run, or choose where qmexmut runs, installs itself, or keeps its
+// state, like -cmd, -rm, -ssh, or -state-dir, may only be given on the command
+// line, lest the config file shared by all nodes redirect every hook run.
+var globalSettings = map[string]bool{
+	"after-preempt-exec":       true,
+	"agent-wait":               true,
+	"approval-wait":            true,
+	"auto-unhook":              true,
+	"before-preempt-exec":      true,
+	"cluster-log":              true,
+	"color":                    true,
+	"cooldown":                 true,
+	"debug-timing":             true,
+	"dependents":               true,
+	"disabled":                 true,
+	"force-stop":               true,
+	"hook-exec-timeout":        true,
+	"ignore":                   true,
+	"log-level":                true,
+	"max-cascade":              true,
+	"max-line-bytes":           true,
+	"notify-email":             true,
+	"notify-webhook":           true,
+	"on-ask-exec":              true,
+	"on-deny-exec":             true,
+	"on-shutdown-failure":      true,
+	"on-violation":             true,
+	"on-yield-back-exec":       true,
+	"only":                     true,
+	"pci-granularity":          true,
+	"policy":                   true,
+	"pool-scope":               true,
+	"pre-shutdown-delay":       true,
+	"pre-shutdown-exec":        true,
+	"preempt-grace":            true,
+	"preempt-protected":        true,
+	"queue-wait":               true,
+	"resume-hibernated":        true,
+	"rollback-after":           true,
+	"scan-workers":             true,
+	"shareable":                true,
+	"shared-dirs":              true,
+	"shutdown-method":          true,
+	"shutdown-order":           true,
+	"shutdown-timeout":         true,
+	"spawn-burst":              true,
+	"spawn-rate":               true,
+	"unknown-state":            true,
+	"usb-identity":             true,
+	"verify-attach":            true,
+	"watch-interval":           true,
+	"windows-shutdown-timeout": true,
+	"windows-update-wait":      true,
+	"yield-back":               true,
+}
+
+// configSections maps section kinds to the keys valid within them.
+var configSections = map[string]map[string]string{
+	"vm":    vmSettings,
+	"rules": nil,
+}
+
+// rawSections lists section kinds whose lines are kept verbatim as entry
+// values, rather than parsed as key = value.
+var rawSections = map[string]bool{
+	"rules": true,
+}
+
+// loadConfig reads configPath, if it exists, and applies its global settings
+// to any flags not given on the command line.
+func loadConfig() error {
+	if givenFlags == nil {
+		givenFlags = make(map[string]bool)
+		flag.Visit(func(fl *flag.Flag) { givenFlags[fl.Name] = true })
+	}
+
+	cf, err := readConfig()
+	if err != nil {
+		return err
+	}
+	return applyConfig(cf)
+}
+
+// readConfig parses configPath, returning an empty config if it doesn't exist.
+func readConfig() (configFile, error) {
+	f, err := os.Open(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return configFile{path: configPath}, nil
+	} else if err != nil {
+		return configFile{}, err
+	}
+	defer f.Close()
+	return parseConfig(configPath, f)
+}
+
+// applyConfig makes cf the loaded config, resetting any global settings of the
+// prior config to their defaults before applying its own.
+func applyConfig(cf configFile) error {
+	for _, ents := range [][]configEntry{config.global, cf.global} {
+		for _, ent := range ents {
+			if !givenFlags[ent.key] {
+				resetFlag(ent.key)
+			}
+		}
+	}
+	config = cf
+	for _, ent := range cf.global {
+		if givenFlags[ent.key] {
+			continue
+		}
+		if err := flag.Set(ent.key, ent.value); err != nil {
+			return cf.errorf(ent.line, "invalid %v: %w", ent.key, err)
+		}
+	}
+	return nil
+}
+
+// isConfigured returns true if a flag was given, either on the command line
+// or as a global setting in the config file.
+func isConfigured(name string) bool {
+	if givenFlags[name] {
+		return true
+	}
+	for _, ent := range config.global {
+		if ent.key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resetFlag sets a flag back to its default value.
+func resetFlag(name string) {
+	fl := flag.Lookup(name)
+	switch val := fl.Value.(type) {
+	case *listFlag:
+		*val = nil
+	case classListFlag:
+		*val.listFlag = nil
+	default:
+		if err := fl.Value.Set(fl.DefValue); err != nil {
+			warnf("unable to reset %v to %q: %v", name, fl.DefValue, err)
+		}
+	}
+}
+
+func parseConfig(name string, r io.Reader) (configFile, error) {
+	cf, errs := parseConfigAll(name, r)
+	if len(errs) > 0 {
+		return cf, errs[0]
+	}
+	return cf, nil
+}
+
+// parseConfigAll parses a config file, skipping over any invalid lines to
+// return an error for each of them.
+func parseConfigAll(name string, r io.Reader) (cf configFile, errs []error) {
+	cf = configFile{
+		path:     name,
+		sections: make(map[string][]configEntry),
+	}
+
+	section, skip := "", false
+	sc := newLineScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			// skip lines of an invalid section, rather than misattribute them
+			section, skip = "", true
+			if line[len(line)-1] != ']' {
+				errs = append(errs, cf.errorf(lineNo, "unterminated section header"))
+				continue
+			}
+			header := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if header == "" {
+				errs = append(errs, cf.errorf(lineNo, "empty section header"))
+				continue
+			}
+			kind := strings.Fields(header)[0]
+			if _, known := configSections[kind]; !known {
+				errs = append(errs, cf.errorf(lineNo, "unknown section kind %q", kind))
+				continue
+			}
+			section, skip = header, false
+			if _, dup := cf.sections[section]; !dup {
+				cf.sections[section] = nil
+			}
+			continue
+		}
+		if skip {
+			continue
+		}
+
+		if section != "" && rawSections[strings.Fields(section)[0]] {
+			cf.sections[section] = append(cf.sections[section], configEntry{value: line, line: lineNo})
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			errs = append(errs, cf.errorf(lineNo, "expected key = value"))
+			continue
+		}
+		ent := configEntry{
+			key:   strings.TrimSpace(line[:i]),
+			value: strings.TrimSpace(line[i+1:]),
+			line:  lineNo,
+		}
+
+		if section == "" {
+			if !globalSettings[ent.key] {
+				if flag.Lookup(ent.key) != nil {
+					errs = append(errs, cf.errorf(lineNo, "%v may only be given on the command line", ent.key))
+				} else {
+					errs = append(errs, cf.errorf(lineNo, "unknown setting %q", ent.key))
+				}
+				continue
+			}
+			cf.global = append(cf.global, ent)
+		} else {
+			kind := strings.Fields(section)[0]
+			if _, known := configSections[kind][ent.key]; !known {
+				errs = append(errs, cf.errorf(lineNo, "unknown %v setting %q", kind, ent.key))
+				continue
+			}
+			cf.sections[section] = append(cf.sections[section], ent)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%v: %w", cf.path, lineScanError(err)))
+	}
+	return cf, errs
+}
+
+func (cf configFile) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%v:%v: %w", cf.path, line, fmt.Errorf(format, args...))
+}
+
+// lookup returns the last value of key within the named section.
+func (cf configFile) lookup(section, key string) (string, bool) {
+	ents := cf.sections[section]
+	for i := len(ents) - 1; i >= 0; i-- {
+		if ents[i].key == key {
+			return ents[i].value, true
+		}
+	}
+	return "", false
+}
+
+// sectionNames returns the sorted names of all sections of the given kind.
+func (cf configFile) sectionNames(kind string) (names []string) {
+	for name := range cf.sections {
+		if strings.HasPrefix(name, kind+" ") || name == kind {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tags returns the config's proxmox tags.
+func (conf vmConfig) tags() []string {
+	return strings.FieldsFunc(conf["tags"], func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
+
+// with returns a copy of the config with key set to value, leaving the
+// config itself, which may be shared, unchanged.
+func (conf vmConfig) with(key, value string) vmConfig {
+	dup := make(vmConfig, len(conf)+1)
+	for k, v := range conf {
+		dup[k] = v
+	}
+	dup[key] = value
+	return dup
+}
+
+// setting returns a per-VM setting, given either by a tag like
+// qmexmut.<key>.<value> (or just qmexmut.<key> for boolean true) or within
+// the VM's config file section, or else its pool's section; tags take
+// precedence, since they're visible in the proxmox UI.
+func (vm vmInfo) setting(key string) (string, bool) {
+	prefix := "qmexmut." + key
+	for _, tag := range vm.config.tags() {
+		if tag == prefix {
+			return "true", true
+		}
+		if strings.HasPrefix(tag, prefix+".") {
+			return tag[len(prefix)+1:], true
+		}
+	}
+	if value, ok := config.lookup("vm "+vm.id, key); ok {
+		return value, true
+	}
+	if vm.pool != "" {
+		return config.lookup("pool "+vm.pool, key)
+	}
+	return "", false
+}
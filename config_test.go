@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigAll(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		text     string
+		global   []string // key=value
+		sections map[string][]string
+		errs     []string
+	}{
+		{
+			name:   "global settings",
+			text:   "# comment\n; comment\n\nshutdown-order = startup\nforce-stop=true\n",
+			global: []string{"shutdown-order=startup", "force-stop=true"},
+		},
+		{
+			name:   "unknown setting",
+			text:   "bogus = 1\npolicy = queue\n",
+			errs:   []string{`test.conf:1: unknown setting "bogus"`},
+			global: []string{"policy=queue"},
+		},
+		{
+			name: "command line only settings",
+			text: "state-dir = /tmp\nlib-dir = /tmp\nnode = all\nexpect-sha256 = 00\n",
+			errs: []string{
+				"test.conf:1: state-dir may only be given on the command line",
+				"test.conf:2: lib-dir may only be given on the command line",
+				"test.conf:3: node may only be given on the command line",
+				"test.conf:4: expect-sha256 may only be given on the command line",
+			},
+		},
+		{
+			name: "vm section",
+			text: "[vm 101]\nshutdown-method = agent\nshutdown-timeout = 600\n",
+			sections: map[string][]string{
+				"vm 101": {"shutdown-method=agent", "shutdown-timeout=600"},
+			},
+		},
+		{
+			name: "unknown vm setting",
+			text: "[vm 101]\nbogus = 1\n",
+			errs: []string{`test.conf:2: unknown vm setting "bogus"`},
+			sections: map[string][]string{
+				"vm 101": nil,
+			},
+		},
+		{
+			name: "header whitespace",
+			text: "[  vm   101 ]\nshutdown-method = stop\n",
+			sections: map[string][]string{
+				"vm 101": {"shutdown-method=stop"},
+			},
+		},
+		{
+			name: "raw rules section",
+			text: "[rules]\nwhen target.tag == prod then deny\n",
+			sections: map[string][]string{
+				"rules": {"=when target.tag == prod then deny"},
+			},
+		},
+		{
+			name: "invalid section skipped",
+			text: "[bogus 1]\nkey = value\n[vm 102\nkey = value\n[]\npolicy = queue\n",
+			errs: []string{
+				`test.conf:1: unknown section kind "bogus"`,
+				"test.conf:3: unterminated section header",
+				"test.conf:5: empty section header",
+			},
+		},
+		{
+			name:   "missing equals",
+			text:   "policy queue\npolicy = ask\n",
+			errs:   []string{"test.conf:1: expected key = value"},
+			global: []string{"policy=ask"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cf, errs := parseConfigAll("test.conf", strings.NewReader(tc.text))
+
+			var gotErrs []string
+			for _, err := range errs {
+				gotErrs = append(gotErrs, err.Error())
+			}
+			if strings.Join(gotErrs, "\n") != strings.Join(tc.errs, "\n") {
+				t.Errorf("got errors:\n%v\nwant:\n%v", strings.Join(gotErrs, "\n"), strings.Join(tc.errs, "\n"))
+			}
+
+			if got := entryStrings(cf.global); strings.Join(got, " ") != strings.Join(tc.global, " ") {
+				t.Errorf("got global %q, want %q", got, tc.global)
+			}
+			if len(cf.sections) != len(tc.sections) {
+				t.Errorf("got %v sections, want %v", len(cf.sections), len(tc.sections))
+			}
+			for name, want := range tc.sections {
+				ents, ok := cf.sections[name]
+				if !ok {
+					t.Errorf("missing section %q", name)
+				}
+				if got := entryStrings(ents); strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("got section %q %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func entryStrings(ents []configEntry) (strs []string) {
+	for _, ent := range ents {
+		strs = append(strs, ent.key+"="+ent.value)
+	}
+	return strs
+}
+
+func TestGlobalSettingsAreFlags(t *testing.T) {
+	for name := range globalSettings {
+		if flag.Lookup(name) == nil {
+			t.Errorf("global setting %q is no flag", name)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	h := newFakeHost(t)
+	if shutdownOrder != "tiers" {
+		t.Fatalf("shutdown-order starts as %q", shutdownOrder)
+	}
+	h.setConfig("shutdown-order = startup\n[vm 101]\nshutdown-timeout = 600\n")
+	if shutdownOrder != "startup" {
+		t.Errorf("got shutdown-order %q, want startup", shutdownOrder)
+	}
+	if !isConfigured("shutdown-order") || isConfigured("force-stop") {
+		t.Errorf("got isConfigured shutdown-order %v, force-stop %v", isConfigured("shutdown-order"), isConfigured("force-stop"))
+	}
+	vm := vmInfo{listRec: listRec{id: "101"}, config: vmConfig{"tags": "qmexmut.shutdown-method.stop"}}
+	if val, _ := vm.setting("shutdown-timeout"); val != "600" {
+		t.Errorf("got vm shutdown-timeout %q, want 600", val)
+	}
+	if val, _ := vm.setting("shutdown-method"); val != "stop" {
+		t.Errorf("got vm shutdown-method %q from its tag, want stop", val)
+	}
+
+	// settings of a replaced config revert to their defaults
+	h.setConfig("")
+	if shutdownOrder != "tiers" {
+		t.Errorf("got shutdown-order %q after reload, want tiers", shutdownOrder)
+	}
+}
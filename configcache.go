@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// qemuServerDir holds the config files of the local node's VMs.
+var qemuServerDir = "/etc/pve/qemu-server"
+
+// cachedConfig is a VM config as read by qm config, along with the modification
+// time and size of its config file when it was read.
+type cachedConfig struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Config  vmConfig  `json:"config"`
+}
+
+// configCache holds VM configs read by this or earlier runs, so that
+// repeated hook runs needn't run qm config for every unchanged VM; it's kept
+// within stateDir, apart from the state file, since it's only a cache.
+var configCache struct {
+	sync.Mutex
+	loaded  bool
+	dirty   bool
+	entries map[string]cachedConfig
+}
+
+func configCachePath() string {
+	return filepath.Join(stateDir, "configs.json")
+}
+
+// readVMConfig returns a VM's config, from the config cache if its file is
+// unchanged since it was cached, or else by running qm config.
+func readVMConfig(id string) (vmConfig, error) {
+	if offlineDir != "" {
+		return offlineConfig(id)
+	}
+	info, statErr := os.Stat(filepath.Join(qemuServerDir, id+".conf"))
+	if statErr == nil {
+		if conf, ok := cachedVMConfig(id, info); ok {
+			return conf, nil
+		}
+	}
+	conf, err := scanVMConfig(id)
+	// a file modified within the last couple seconds may change again
+	// without its coarse mtime changing, so isn't cached until later
+	if err == nil && statErr == nil && time.Since(info.ModTime()) > 2*time.Second {
+		configCache.Lock()
+		configCache.entries[id] = cachedConfig{info.ModTime(), info.Size(), conf}
+		configCache.dirty = true
+		configCache.Unlock()
+	}
+	return conf, err
+}
+
+func cachedVMConfig(id string, info fs.FileInfo) (vmConfig, bool) {
+	configCache.Lock()
+	defer configCache.Unlock()
+	if !configCache.loaded {
+		configCache.loaded = true
+		configCache.entries = make(map[string]cachedConfig)
+		data, err := os.ReadFile(configCachePath())
+		if err == nil {
+			err = json.Unmarshal(data, &configCache.entries)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			debugf("ignoring config cache: %v", err)
+			configCache.entries = make(map[string]cachedConfig)
+		}
+	}
+	ent, ok := configCache.entries[id]
+	if ok && ent.ModTime.Equal(info.ModTime()) && ent.Size == info.Size() {
+		return ent.Config, true
+	}
+	return nil, false
+}
+
+// saveConfigCache saves any configs newly read into the config cache, dropping
+// those of VMs that no longer exist; failure only loses the cache, so is just
+// logged.
+func saveConfigCache() {
+	configCache.Lock()
+	defer configCache.Unlock()
+	if !configCache.dirty || dryRun {
+		return
+	}
+	for id := range configCache.entries {
+		if _, err := os.Stat(filepath.Join(qemuServerDir, id+".conf")); errors.Is(err, fs.ErrNotExist) {
+			delete(configCache.entries, id)
+		}
+	}
+	data, err := json.Marshal(configCache.entries)
+	if err == nil {
+		err = os.MkdirAll(stateDir, 0755)
+	}
+	if err == nil {
+		tmp := configCachePath() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, configCachePath())
+		}
+	}
+	if err != nil {
+		warnf("unable to save config cache: %v", err)
+	}
+}
+
+// scanned holds the VM configs read by the last scanVMs, so that reporting on
+// events, like notifications, needn't read them again.
+var scanned struct {
+	sync.Mutex
+	configs map[string]vmConfig
+}
+
+// noteScanned replaces the configs of any previously scanned VMs.
+func noteScanned(vms []vmInfo) {
+	configs := make(map[string]vmConfig, len(vms))
+	for _, vm := range vms {
+		if vm.config != nil {
+			configs[vm.id] = vm.config
+		}
+	}
+	scanned.Lock()
+	scanned.configs = configs
+	scanned.Unlock()
+}
+
+// scannedConfig returns a VM's config as last scanned by scanVMs, or else as
+// read by readVMConfig.
+func scannedConfig(id string) (vmConfig, error) {
+	scanned.Lock()
+	conf, ok := scanned.configs[id]
+	scanned.Unlock()
+	if ok {
+		return conf, nil
+	}
+	return readVMConfig(id)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// configDoc is the effective configuration as a single JSON document, for
+// backup, comparison between nodes, and restoring after a reinstall.
+type configDoc struct {
+	// Settings are global settings, with any repeated list settings joined.
+	Settings map[string]string `json:"settings,omitempty"`
+
+	// Sections are key = value sections, like "vm 101" or "pool lab".
+	Sections map[string]map[string]string `json:"sections,omitempty"`
+
+	// Raw are sections whose lines are kept in order, like "rules".
+	Raw map[string][]string `json:"raw,omitempty"`
+
+	// Hooked are the VMIDs currently hooked.
+	Hooked []string `json:"hooked"`
+}
+
+// runConfig provides config subcommands: export prints the effective
+// configuration, import restores it, and lint validates the config file.
+func runConfig(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			if len(args) == 1 {
+				return configExport()
+			}
+		case "import":
+			if len(args) == 2 {
+				return configImport(args[1])
+			}
+		case "lint":
+			if len(args) == 1 {
+				return configLint()
+			}
+		}
+	}
+	return withExitCode(exitUsage, fmt.Errorf("usage: config export | config import <file|-> | config lint"))
+}
+
+func configExport() error {
+	doc := configDocOf(config)
+	doc.Hooked = []string{}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if isOurHook(vm.config["hookscript"]) {
+			doc.Hooked = append(doc.Hooked, vm.id)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// configDocOf returns the settings and sections of a config file as a
+// document, without any hooked VMs.
+func configDocOf(cf configFile) (doc configDoc) {
+	for _, ent := range cf.global {
+		if doc.Settings == nil {
+			doc.Settings = make(map[string]string)
+		}
+		if prior, ok := doc.Settings[ent.key]; ok && isListSetting(ent.key) {
+			doc.Settings[ent.key] = prior + "," + ent.value
+		} else {
+			doc.Settings[ent.key] = ent.value
+		}
+	}
+
+	for name, ents := range cf.sections {
+		if rawSections[strings.Fields(name)[0]] {
+			if doc.Raw == nil {
+				doc.Raw = make(map[string][]string)
+			}
+			lines := make([]string, len(ents))
+			for i, ent := range ents {
+				lines[i] = ent.value
+			}
+			doc.Raw[name] = lines
+			continue
+		}
+		if doc.Sections == nil {
+			doc.Sections = make(map[string]map[string]string)
+		}
+		settings := make(map[string]string, len(ents))
+		for _, ent := range ents {
+			settings[ent.key] = ent.value
+		}
+		doc.Sections[name] = settings
+	}
+	return doc
+}
+
+// isListSetting returns true if a global setting accumulates when repeated.
+func isListSetting(key string) bool {
+	switch flag.Lookup(key).Value.(type) {
+	case *listFlag, classListFlag:
+		return true
+	}
+	return false
+}
+
+func configImport(name string) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var doc configDoc
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("invalid config document %v: %w", name, err))
+	}
+
+	text := doc.render()
+	if _, err := parseConfig(name, strings.NewReader(text)); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	if dryRun {
+		infof("would write %v:\n%v", configPath, text)
+	} else {
+		tmp := configPath + ".tmp"
+		if err := os.WriteFile(tmp, []byte(text), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, configPath); err != nil {
+			return err
+		}
+		infof("wrote %v", configPath)
+	}
+
+	if len(doc.Hooked) == 0 {
+		return nil
+	}
+	snippetStore, _, err := findSnippets()
+	if err != nil {
+		return err
+	}
+	hookScript := fmt.Sprintf("%s:snippets/%s", snippetStore, hookCmdName)
+	recs, err := listVMs()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		exists[rec.id] = true
+	}
+	for _, id := range doc.Hooked {
+		if !exists[id] {
+			warnf("not hooking vm #%v, which doesn't exist", id)
+			continue
+		}
+		if _, err := hookVM(id, hookScript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render formats the document as a config file.
+func (doc configDoc) render() string {
+	var sb strings.Builder
+	sb.WriteString("# imported by qmexmut config import\n")
+
+	for _, key := range sortedKeys(doc.Settings) {
+		fmt.Fprintf(&sb, "%v = %v\n", key, doc.Settings[key])
+	}
+
+	names := make([]string, 0, len(doc.Sections)+len(doc.Raw))
+	for name := range doc.Sections {
+		names = append(names, name)
+	}
+	for name := range doc.Raw {
+		if _, dup := doc.Sections[name]; !dup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "\n[%v]\n", name)
+		for _, key := range sortedKeys(doc.Sections[name]) {
+			fmt.Fprintf(&sb, "%v = %v\n", key, doc.Sections[name][key])
+		}
+		for _, line := range doc.Raw[name] {
+			fmt.Fprintf(&sb, "%v\n", line)
+		}
+	}
+	return sb.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
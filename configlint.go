@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lintingConfig returns true if the command is config lint, which reports
+// any errors in the config file itself, rather than failing to load it.
+func lintingConfig(args []string) bool {
+	return len(args) >= 2 && args[0] == "config" && args[1] == "lint"
+}
+
+// configLint validates the config file, printing an error for each invalid
+// line, and a warning for each line that's valid but likely mistaken, like
+// rules that can never match or sections naming nonexistent VMs; it fails if
+// there are any errors.
+func configLint() error {
+	f, err := os.Open(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		infof("no config file %v", configPath)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cf, errs := parseConfigAll(configPath, f)
+	var warns []error
+	warn := func(line int, format string, args ...interface{}) {
+		warns = append(warns, cf.errorf(line, "warning: "+format, args...))
+	}
+
+	for _, ent := range cf.global {
+		if err := flag.Set(ent.key, ent.value); err != nil {
+			errs = append(errs, cf.errorf(ent.line, "invalid %v: %w", ent.key, err))
+		}
+	}
+	var names []string
+	for name := range cf.sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ents := cf.sections[name]
+		if kind := strings.Fields(name)[0]; configSections[kind] == nil {
+			continue
+		}
+		for _, ent := range ents {
+			if err := checkVMSetting(ent.key, ent.value); err != nil {
+				errs = append(errs, cf.errorf(ent.line, "invalid %v: %w", ent.key, err))
+			}
+		}
+	}
+
+	rules, ruleErrs := parseRules(cf)
+	errs = append(errs, ruleErrs...)
+	for i, rule := range rules {
+		for _, prior := range rules[:i] {
+			if prior.shadows(rule) {
+				warn(rule.line, "rule is unreachable, since the rule on line %v always matches first", prior.line)
+				break
+			}
+		}
+	}
+
+	_, blackoutErrs := parseBlackouts(cf)
+	errs = append(errs, blackoutErrs...)
+	schedule, scheduleErrs := parseSchedule(cf)
+	errs = append(errs, scheduleErrs...)
+	_, notifyErrs := parseNotifiers(cf)
+	errs = append(errs, notifyErrs...)
+
+	var aliases []configEntry
+	for _, ent := range cf.sections["aliases"] {
+		i := strings.IndexByte(ent.value, '=')
+		if i < 0 {
+			errs = append(errs, cf.errorf(ent.line, "expected alias = resource"))
+			continue
+		}
+		aliases = append(aliases, configEntry{
+			key:   strings.TrimSpace(ent.value[:i]),
+			value: canonicalLabel(strings.TrimSpace(ent.value[i+1:])),
+			line:  ent.line,
+		})
+	}
+
+	// then check references to VMs, pools, and resources, if able to list them
+	vms, err := scanVMs()
+	if err != nil {
+		warnf("not checking references to vms and resources: %v", err)
+	} else {
+		ids := make(map[string]bool, len(vms))
+		pools := make(map[string]bool)
+		var labels []string
+		for _, vm := range vms {
+			ids[vm.id] = true
+			pools[vm.pool] = true
+			for _, label := range vm.resources {
+				if !hasString(label, labels) {
+					labels = append(labels, label)
+				}
+			}
+		}
+		anyLabel := func(pat string) bool {
+			for _, label := range labels {
+				if matched, _ := path.Match(pat, label); matched {
+					return true
+				}
+			}
+			return false
+		}
+
+		for _, name := range names {
+			ents := cf.sections[name]
+			fields := strings.Fields(name)
+			if len(fields) != 2 || len(ents) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "vm":
+				if !ids[fields[1]] {
+					warn(ents[0].line, "no such vm #%v", fields[1])
+				}
+			case "pool":
+				if !pools[fields[1]] {
+					warn(ents[0].line, "no vm is in pool %q", fields[1])
+				}
+			}
+		}
+
+		for _, rule := range rules {
+			for _, cond := range rule.conds {
+				switch {
+				case cond.op == "!=":
+				case cond.subject == "resource" && cond.op == "==" && !hasString(canonicalLabel(cond.value), labels):
+					warn(rule.line, "no vm passes thru %v", cond.value)
+				case cond.subject == "resource" && cond.op == "matches" && !anyLabel(cond.value):
+					warn(rule.line, "no vm passes thru a resource matching %v", cond.value)
+				case strings.HasSuffix(cond.subject, ".id") && cond.op == "==" && !ids[cond.value]:
+					warn(rule.line, "no such vm #%v", cond.value)
+				}
+			}
+		}
+
+		for _, se := range schedule {
+			if !ids[se.vmid] {
+				warn(se.line, "no such vm #%v", se.vmid)
+			}
+		}
+
+		for _, alias := range aliases {
+			if !hasString(alias.value, labels) {
+				warn(alias.line, "no vm passes thru %v, aliased %v", alias.value, alias.key)
+			}
+		}
+
+		for _, ent := range cf.global {
+			if ent.key != "shareable" {
+				continue
+			}
+			for _, pat := range strings.Split(ent.value, ",") {
+				if pat = strings.TrimSpace(pat); pat != "" && !anyLabel(pat) {
+					warn(ent.line, "no vm passes thru a resource matching %v", pat)
+				}
+			}
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	for _, err := range warns {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v error(s), %v warning(s)", len(errs), len(warns))
+	}
+	infof("config ok, %v warning(s)", len(warns))
+	return nil
+}
+
+// checkVMSetting validates the value of a per-VM setting.
+func checkVMSetting(key, value string) error {
+	switch key {
+	case "shutdown-method":
+		return checkChoice(value, shutdownMethods)
+	case "policy":
+		return checkChoice(value, preemptPolicies)
+	case "resume-hibernated":
+		return checkChoice(value, resumeHibernatedChoices)
+	case "on-shutdown-failure":
+		return checkChoice(value, shutdownFailureActions)
+	case "boot-priority", "shutdown-timeout", "pre-shutdown-delay", "agent-wait", "windows-update-wait":
+		_, err := strconv.Atoi(value)
+		return err
+	case "force-stop":
+		_, err := strconv.ParseBool(value)
+		return err
+	case "pre-shutdown-exec":
+		_, err := splitCommandLine(value)
+		return err
+	case "depends-on":
+		if len(splitVMIDs(value)) == 0 {
+			return fmt.Errorf("%q lists no VMIDs", value)
+		}
+	}
+	return nil
+}
+
+func checkChoice(value string, choices []string) error {
+	if !hasString(value, choices) {
+		return fmt.Errorf("%q, expected one of %v", value, strings.Join(choices, ", "))
+	}
+	return nil
+}
+
+// shadows returns true if the rule matches whenever the other does, since its
+// conditions are a subset of the other's.
+func (rule policyRule) shadows(other policyRule) bool {
+	for _, cond := range rule.conds {
+		found := false
+		for _, oc := range other.conds {
+			if oc == cond {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ctlRequest is a command sent to the watch daemon's control socket.
+type ctlRequest struct {
+	Args []string `json:"args"`
+
+	reply chan ctlResponse
+}
+
+type ctlResponse struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pauseRecord records that enforcement was paused by ctl pause, or on every
+// node by the pause command.
+type pauseRecord struct {
+	Time   time.Time  `json:"time"`
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"` // nil until resumed
+	Node   string     `json:"node,omitempty"`  // where the pause command ran
+}
+
+func ctlSocketPath() string {
+	return filepath.Join(stateDir, "ctl.sock")
+}
+
+// listenCtl listens on the control socket, sending each request received to
+// reqs, until the listener is closed.
+func listenCtl(reqs chan<- ctlRequest) (net.Listener, error) {
+	sockPath := ctlSocketPath()
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another watch is listening on %v", sockPath)
+	}
+	if err := os.Remove(sockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					errorf("control socket failed: %v", err)
+				}
+				return
+			}
+			go serveCtl(conn, reqs)
+		}
+	}()
+	return ln, nil
+}
+
+func serveCtl(conn net.Conn, reqs chan<- ctlRequest) {
+	defer conn.Close()
+	var req ctlRequest
+	if err := json.NewDecoder(conn).Decode(&req); errors.Is(err, io.EOF) {
+		return // like another watch checking whether we're listening
+	} else if err != nil {
+		warnf("invalid control request: %v", err)
+		return
+	}
+	req.reply = make(chan ctlResponse, 1)
+	reqs <- req
+	if err := json.NewEncoder(conn).Encode(<-req.reply); err != nil {
+		warnf("unable to reply to control request: %v", err)
+	}
+}
+
+// handleCtl runs a control request within the watch loop, returning its
+// output.
+func handleCtl(args []string) (string, error) {
+	cmd := ""
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	switch {
+	case cmd == "status" && len(args) == 0:
+		return describeWatch()
+
+	case cmd == "health" && len(args) == 0:
+		return watchHealth(false)
+
+	case cmd == "ready" && len(args) == 0:
+		return watchHealth(true)
+
+	case cmd == "reload" && len(args) == 0:
+		changes, err := reloadConfig("ctl reload")
+		if err != nil {
+			return "", err
+		}
+		watchReconcile()
+		if len(changes) == 0 {
+			return "reloaded, nothing changed", nil
+		}
+		return "reloaded:\n  " + strings.Join(changes, "\n  "), nil
+
+	case cmd == "reconcile" && len(args) == 0:
+		if paused, err := enforcementPaused(); err != nil {
+			return "", err
+		} else if paused != nil {
+			return "", fmt.Errorf("enforcement is paused")
+		}
+		watchReconcile()
+		if watchStatus.lastErr != nil {
+			return "", watchStatus.lastErr
+		}
+		return "reconciled", nil
+
+	case cmd == "pause":
+		reason := strings.Join(args, " ")
+		if err := updateState(func(st *state) error {
+			if st.Paused == nil {
+				st.Paused = &pauseRecord{Time: time.Now(), Reason: reason}
+			}
+			return nil
+		}); err != nil {
+			return "", err
+		}
+		recordEvent(event{Kind: kindPause, Reason: reason})
+		if reason != "" {
+			warnf("enforcement paused: %v", reason)
+		} else {
+			warnf("enforcement paused")
+		}
+		return "enforcement paused, until ctl resume", nil
+
+	case cmd == "resume" && len(args) == 0:
+		if err := updateState(func(st *state) error {
+			st.Paused = nil
+			return nil
+		}); err != nil {
+			return "", err
+		}
+		recordEvent(event{Kind: kindResume})
+		infof("enforcement resumed")
+		watchReconcile()
+		return "enforcement resumed", nil
+
+	case cmd == "disable" && len(args) > 0:
+		if err := runDisable(args); err != nil {
+			return "", err
+		}
+		watchReconcile()
+		return "disabled enforcement", nil
+
+	case cmd == "enable" && len(args) > 0:
+		if err := runEnable(args); err != nil {
+			return "", err
+		}
+		watchReconcile()
+		return "enabled enforcement", nil
+
+	case cmd == "cancel" && len(args) == 1:
+		if err := runCancel(args); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("cancelled any pending preemption for starting vm #%v", args[0]), nil
+	}
+	return "", fmt.Errorf("usage: ctl status | health | ready | reload | reconcile | pause [<reason>] | resume | disable [-for <duration>] [-reason <reason>] <resource>... | enable <resource>... | cancel <vmid>")
+}
+
+// enforcementPaused returns any pause of enforcement, on this node by ctl
+// pause, or on every node by the pause command.
+func enforcementPaused() (*pauseRecord, error) {
+	st, err := readState()
+	if err != nil || st.Paused != nil {
+		return st.Paused, err
+	}
+	return clusterPause()
+}
+
+// runCtl sends a command to the watch daemon's control socket, printing its
+// output.
+func runCtl(args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: ctl status | health | ready | reload | reconcile | pause [<reason>] | resume | disable [-for <duration>] [-reason <reason>] <resource>... | enable <resource>... | cancel <vmid>"))
+	}
+	conn, err := net.Dial("unix", ctlSocketPath())
+	if err != nil {
+		return withExitCode(exitEnvironment, fmt.Errorf("unable to reach qmexmut watch, is it running? %w", err))
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(ctlRequest{Args: args}); err != nil {
+		return err
+	}
+	var resp ctlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("invalid control response: %w", err)
+	}
+	if resp.Output != "" {
+		fmt.Println(resp.Output)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
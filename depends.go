@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dependents sets how stopMutuals treats running VMs that depend on a mutual
+// that it's about to stop, as declared by their depends-on setting:
+//   - stop shuts them down first, dependents before what they depend on
+//   - deny denies the start, as if the mutual were protected
+//   - ignore leaves them running, though what they depend on is stopped
+var dependents = "stop"
+
+func init() {
+	flag.Var(choiceFlag{&dependents, []string{"stop", "deny", "ignore"}},
+		"dependents", "how to treat running VMs that depend on a mutual being stopped: stop, deny, or ignore")
+	vmSettings["depends-on"] = "VMIDs of guests that this VM depends on, like 201,202"
+}
+
+// dependsOn returns the VMIDs that a VM depends on.
+func (vm vmInfo) dependsOn() []string {
+	val, _ := vm.setting("depends-on")
+	return splitVMIDs(val)
+}
+
+// splitVMIDs splits VMIDs separated by anything but digits, so that a tag
+// like qmexmut.depends-on.201-202 may list several.
+func splitVMIDs(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+}
+
+// dependent is a VM that depends on one being stopped.
+type dependent struct {
+	vmInfo
+	on string
+}
+
+// dependentsOf returns any VMs, other than self and its mutuals, that depend
+// directly or transitively on any of the VMs being stopped, and that would
+// need stopping themselves; they're ordered so that each comes before any
+// that it depends on, as they should be shut down.
+func dependentsOf(self vmInfo, mutualVMs, stopping, vms []vmInfo) []dependent {
+	seen := map[string]bool{self.id: true}
+	for _, vm := range mutualVMs {
+		seen[vm.id] = true
+	}
+	var deps []dependent
+	frontier := vmIDs(stopping)
+	for len(frontier) > 0 {
+		var next []string
+		for _, vm := range vms {
+			if seen[vm.id] || preemptAction(vm) == actionNone || preemptAction(vm) == actionSkip {
+				continue
+			}
+			for _, on := range vm.dependsOn() {
+				if hasString(on, frontier) {
+					seen[vm.id] = true
+					deps = append(deps, dependent{vm, on})
+					next = append(next, vm.id)
+					break
+				}
+			}
+		}
+		frontier = next
+	}
+
+	// order by how many dependencies deep each is, deepest first, since one
+	// found early may also depend on another found alongside or after it
+	depth := make(map[string]int, len(deps))
+	for round := 0; round < len(deps); round++ {
+		changed := false
+		for _, dep := range deps {
+			d := 1
+			for _, on := range dep.dependsOn() {
+				if od, ok := depth[on]; ok && od+1 > d {
+					d = od + 1
+				}
+			}
+			if d > depth[dep.id] && d <= len(deps) {
+				depth[dep.id] = d
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	sort.SliceStable(deps, func(i, j int) bool {
+		return depth[deps[i].id] > depth[deps[j].id]
+	})
+	return deps
+}
+
+// checkDependents decides what to do about VMs that depend on those being
+// stopped, returning any that should be stopped first, or an error denying
+// the start.
+func checkDependents(self vmInfo, mutualVMs, stopping, vms []vmInfo) ([]vmInfo, error) {
+	if dependents == "ignore" || len(stopping) == 0 {
+		return nil, nil
+	}
+	var stops []vmInfo
+	for _, dep := range dependentsOf(self, mutualVMs, stopping, vms) {
+		switch {
+		case dependents == "deny":
+			return nil, fmt.Errorf("vm #%v depends on mutual vm #%v", dep.id, dep.on)
+		case !isPreempting(preemptAction(dep.vmInfo)):
+			return nil, fmt.Errorf("vm #%v, which depends on mutual vm #%v, can't be stopped", dep.id, dep.on)
+		}
+		// printed to stdout so that it shows in the proxmox start task log
+		fmt.Printf("qmexmut: first stopping vm #%v (%v), which depends on vm #%v\n", dep.id, dep.name, dep.on)
+		stops = append(stops, dep.vmInfo)
+	}
+	return stops, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependentsOf(t *testing.T) {
+	newFakeHost(t)
+	vm := func(id, state, dependsOn string) vmInfo {
+		conf := vmConfig{}
+		if dependsOn != "" {
+			conf["tags"] = "qmexmut.depends-on." + dependsOn
+		}
+		return vmInfo{listRec: listRec{id: id, status: "running"}, config: conf, state: state}
+	}
+	self := vm("101", "stopped", "")
+	mutual := vm("102", "running", "")
+
+	for _, tc := range []struct {
+		name string
+		vms  []vmInfo
+		want string
+	}{
+		{"none", []vmInfo{vm("103", "running", "")}, ""},
+		{"direct", []vmInfo{vm("103", "running", "102"), vm("104", "running", "102")}, "103 104"},
+		{"stopped", []vmInfo{vm("103", "stopped", "102")}, ""},
+		{"transitive", []vmInfo{vm("103", "running", "102"), vm("104", "running", "103"), vm("105", "running", "104")}, "105 104 103"},
+		// 103 depends on both the mutual and 104, found alongside it
+		{"sibling", []vmInfo{vm("103", "running", "102-104"), vm("104", "running", "102")}, "103 104"},
+		// a cycle has no right order, but still has one
+		{"cycle", []vmInfo{vm("103", "running", "102-104"), vm("104", "running", "103")}, "104 103"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vms := append([]vmInfo{self, mutual}, tc.vms...)
+			var got []string
+			for _, dep := range dependentsOf(self, []vmInfo{mutual}, []vmInfo{mutual}, vms) {
+				got = append(got, dep.id)
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Errorf("got dependents %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStopMutualsStopsDependentsFirst(t *testing.T) {
+	h := newFakeHost(t)
+	defer func(prior string) { shutdownOrder = prior }(shutdownOrder)
+	shutdownOrder = "parallel"
+	h.addVM("101", "stopped", "hostpci0: 0000:01:00")
+	h.addVM("102", "running", "hostpci0: 0000:01:00")
+	h.addVM("103", "running", "tags: qmexmut.depends-on.102")
+	h.addVM("104", "running", "tags: qmexmut.depends-on.103")
+	h.addVM("105", "running", "tags: qmexmut.depends-on.102-104")
+
+	if err := stopMutuals("101"); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, cmd := range h.commands() {
+		if fields := strings.Fields(cmd); len(fields) > 2 && fields[1] == "shutdown" {
+			order = append(order, fields[2])
+		}
+	}
+	if got := strings.Join(order, " "); got != "105 104 103 102" {
+		t.Errorf("got shutdown order %q, want 105 104 103 102", got)
+	}
+}
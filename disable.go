@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var disabled listFlag
+
+func init() {
+	flag.Var(&disabled, "disabled", "comma separated resource label patterns whose enforcement is disabled")
+}
+
+type disableRecord struct {
+	Time   time.Time  `json:"time"`
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+	By     string     `json:"by,omitempty"`
+}
+
+// disabledPath is where the disable command records resources whose
+// enforcement is disabled on this node; it's kept apart from the state file
+// so that isEnforced may consult it while the state is locked.
+func disabledPath() string {
+	return filepath.Join(stateDir, "disabled.json")
+}
+
+var (
+	disabledOnce sync.Once
+	disabledRecs map[string]disableRecord
+)
+
+// loadDisabled returns the unexpired records made by the disable command,
+// read once per run, or after any change.
+func loadDisabled() map[string]disableRecord {
+	disabledOnce.Do(func() {
+		recs, err := readDisabled()
+		if err != nil {
+			warnf("unable to read disabled resources: %v", err)
+		}
+		disabledRecs = recs
+	})
+	return disabledRecs
+}
+
+// readDisabled reads the unexpired records made by the disable command.
+func readDisabled() (map[string]disableRecord, error) {
+	recs := make(map[string]disableRecord)
+	data, err := os.ReadFile(disabledPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return recs, nil
+	} else if err != nil {
+		return recs, err
+	}
+	if err := json.Unmarshal(data, &recs); err != nil {
+		return recs, fmt.Errorf("invalid %v: %w", disabledPath(), err)
+	}
+	now := time.Now()
+	for pat, rec := range recs {
+		if rec.Until != nil && now.After(*rec.Until) {
+			delete(recs, pat)
+		}
+	}
+	return recs, nil
+}
+
+func writeDisabled(recs map[string]disableRecord) error {
+	defer func() { disabledOnce = sync.Once{} }()
+	if dryRun {
+		infof("would write %v", disabledPath())
+		return nil
+	}
+	if len(recs) == 0 {
+		if err := os.Remove(disabledPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(recs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	tmp := disabledPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, disabledPath())
+}
+
+// isDisabled returns true if enforcement of a label is disabled, by the
+// disabled config key or the disable command.
+func isDisabled(label string) bool {
+	for _, pat := range disabled {
+		if matched, _ := path.Match(pat, label); matched {
+			return true
+		}
+	}
+	for pat := range loadDisabled() {
+		if matched, _ := path.Match(pat, label); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// disablePatterns resolves arguments to the disable and enable commands:
+// resource label patterns, aliases of resources, or VMIDs standing for all
+// resources passed thru by that VM.
+func disablePatterns(args []string) ([]string, error) {
+	var pats []string
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			if _, err := path.Match(arg, ""); err != nil {
+				return nil, withExitCode(exitUsage, fmt.Errorf("invalid resource pattern %q: %w", arg, err))
+			}
+			pats = append(pats, arg)
+			continue
+		}
+		labels, err := resolveResources([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		pats = append(pats, labels...)
+	}
+	return pats, nil
+}
+
+// runDisable disables enforcement of host resources on this node, without
+// pausing enforcement of any others, until enabled again or for the given
+// duration. With no arguments, it lists resources whose enforcement is
+// disabled.
+func runDisable(args []string) error {
+	flags := flag.NewFlagSet("disable", flag.ContinueOnError)
+	dur := flags.Duration("for", 0, "how long to disable enforcement for, until enabled if zero")
+	reason := flags.String("reason", "", "reason for disabling enforcement, shown by status")
+	args, err := parseInterspersed(flags, args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if len(args) == 0 {
+		return listDisabled()
+	}
+	pats, err := disablePatterns(args)
+	if err != nil {
+		return err
+	}
+
+	rec := disableRecord{
+		Time:   time.Now(),
+		Reason: *reason,
+		By:     os.Getenv("SUDO_USER"),
+	}
+	if rec.By == "" {
+		rec.By = os.Getenv("USER")
+	}
+	if *dur > 0 {
+		until := rec.Time.Add(*dur)
+		rec.Until = &until
+	}
+
+	recs, err := readDisabled()
+	if err != nil {
+		return err
+	}
+	for _, pat := range pats {
+		recs[pat] = rec
+	}
+	if err := writeDisabled(recs); err != nil {
+		return err
+	}
+	for _, pat := range pats {
+		recordEvent(event{Kind: kindDisable, Reason: describeDisabled(pat, rec)})
+		warnf("disabled enforcement of %v", describeDisabled(pat, rec))
+	}
+	return nil
+}
+
+// runEnable enables enforcement of host resources disabled by runDisable.
+func runEnable(args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: enable <resource|pattern|vmid>..."))
+	}
+	pats, err := disablePatterns(args)
+	if err != nil {
+		return err
+	}
+	recs, err := readDisabled()
+	if err != nil {
+		return err
+	}
+	var enabled []string
+	for _, pat := range pats {
+		if _, has := recs[pat]; has {
+			delete(recs, pat)
+			enabled = append(enabled, pat)
+		} else {
+			infof("enforcement of %v isn't disabled by the disable command", pat)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+	if err := writeDisabled(recs); err != nil {
+		return err
+	}
+	for _, pat := range enabled {
+		recordEvent(event{Kind: kindEnable, Reason: pat})
+		infof("enabled enforcement of %v", pat)
+	}
+	return nil
+}
+
+func describeDisabled(pat string, rec disableRecord) string {
+	desc := pat
+	if rec.Until != nil {
+		desc += " until " + rec.Until.Format(time.RFC3339)
+	}
+	if rec.Reason != "" {
+		desc += ": " + rec.Reason
+	}
+	return desc
+}
+
+func listDisabled() error {
+	recs, err := readDisabled()
+	if err != nil {
+		return err
+	}
+	pats := make([]string, 0, len(recs))
+	for pat := range recs {
+		pats = append(pats, pat)
+	}
+	sort.Strings(pats)
+
+	var tab table
+	tab.header("RESOURCE", "SINCE", "UNTIL", "BY", "REASON")
+	for _, pat := range disabled {
+		tab.add(plain(pat), plain(""), plain("config"), plain(""), plain(""))
+	}
+	for _, pat := range pats {
+		rec := recs[pat]
+		until := plain("enabled")
+		if rec.Until != nil {
+			until = plain(rec.Until.Format(time.RFC3339))
+		}
+		tab.add(colored(colorYellow, pat), plain(rec.Time.Format(time.RFC3339)), until, plain(rec.By), plain(rec.Reason))
+	}
+	return printTable(&tab)
+}
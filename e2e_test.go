@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// e2eBinary is the qmexmut binary, built once for every end to end test, with
+// its host paths relative to the fake host dir that it's run in.
+var e2eBinary struct {
+	sync.Once
+	dir string
+	err error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if e2eBinary.dir != "" {
+		os.RemoveAll(e2eBinary.dir)
+	}
+	os.Exit(code)
+}
+
+// buildE2E returns the dir holding the built binary, both as the hook and as
+// qmexmut, building it if needed.
+func buildE2E(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the qmexmut binary")
+	}
+	e2eBinary.Do(func() {
+		dir, err := os.MkdirTemp("", "qmexmut-e2e")
+		if err != nil {
+			e2eBinary.err = err
+			return
+		}
+		e2eBinary.dir = dir
+		var ldflags []string
+		for name, val := range map[string]string{
+			"configPath":    "qmexmut.conf",
+			"libDir":        "lib",
+			"pciSysfs":      "pci",
+			"qemuServerDir": "vms",
+			"stateDir":      "state",
+			"usbSysfs":      "usb",
+		} {
+			ldflags = append(ldflags, "-X main."+name+"="+val)
+		}
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, hookCmdName), "-ldflags", strings.Join(ldflags, " "), ".")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			e2eBinary.err = fmt.Errorf("go build failed: %w\n%s", err, out)
+			return
+		}
+		e2eBinary.err = os.Symlink(hookCmdName, filepath.Join(dir, "qmexmut"))
+	})
+	if e2eBinary.err != nil {
+		t.Fatal(e2eBinary.err)
+	}
+	return e2eBinary.dir
+}
+
+// runE2E runs a command line in the fake host dir, as proxmox would run the
+// hook, returning its exit code and output; a name other than qmexmut or the
+// hook is run as is.
+func runE2E(t *testing.T, h *fakeHost, name string, args ...string) (int, string) {
+	t.Helper()
+	if name == "qmexmut" || name == hookCmdName {
+		name = filepath.Join(buildE2E(t), name)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = h.dir
+	out, err := cmd.CombinedOutput()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode(), string(out)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// checkRan checks the fake host's command log for commands that should, and
+// shouldn't, have run; no pct commands should ever run.
+func checkRan(t *testing.T, h *fakeHost, ran, notRan []string) {
+	t.Helper()
+	for _, prefix := range ran {
+		if !h.ran(prefix) {
+			t.Errorf("no %q command ran", prefix)
+		}
+	}
+	for _, prefix := range append(notRan, "pct") {
+		if h.ran(prefix) {
+			t.Errorf("unexpected %q command ran", prefix)
+		}
+	}
+	if t.Failed() {
+		t.Logf("commands run:\n%v", strings.Join(h.commands(), "\n"))
+	}
+}
+
+// addSnippets adds a directory storage with snippets content, where init
+// installs the hook stub.
+func addSnippets(h *fakeHost) {
+	h.t.Helper()
+	if err := os.MkdirAll(h.path("storage", "snippets"), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+	h.setPvesh("/storage", fmt.Sprintf(
+		`[{"storage":"local","type":"dir","content":"iso,snippets","path":%q}]`, h.path("storage")))
+}
+
+func TestE2EInit(t *testing.T) {
+	buildE2E(t)
+
+	t.Run("hooks mutuals", func(t *testing.T) {
+		h := newFakeHost(t)
+		addSnippets(h)
+		h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00,pcie=1")
+		h.addVM("102", "running", "name: work", "hostpci0: 01:00.0")
+		h.addVM("103", "running", "name: plain", "net0: virtio=BC:24:11:00:00:01,bridge=vmbr0")
+
+		code, out := runE2E(t, h, "qmexmut", "init")
+		if code != exitOK {
+			t.Fatalf("init exited %v, want %v:\n%s", code, exitOK, out)
+		}
+		checkRan(t, h, []string{
+			"qm set 101 --hookscript local:snippets/" + hookCmdName,
+			"qm set 102 --hookscript local:snippets/" + hookCmdName,
+		}, []string{"qm set 103", "qm shutdown", "qm stop"})
+
+		// the installed stub runs the installed binary, as proxmox would
+		stub := h.path("storage", "snippets", hookCmdName)
+		if code, out := runE2E(t, h, stub, "101", "pre-start"); code != exitOK {
+			t.Fatalf("hook stub exited %v, want %v:\n%s", code, exitOK, out)
+		}
+		checkRan(t, h, []string{"qm shutdown 102"}, nil)
+
+		// a binary that no longer matches its stub refuses to run
+		f, err := os.OpenFile(h.path("lib", "qmexmut"), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("tampered"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if code, out := runE2E(t, h, stub, "101", "pre-start"); code != exitEnvironment {
+			t.Errorf("tampered hook stub exited %v, want %v:\n%s", code, exitEnvironment, out)
+		}
+	})
+
+	t.Run("no snippets storage", func(t *testing.T) {
+		h := newFakeHost(t)
+		h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00")
+		code, out := runE2E(t, h, "qmexmut", "init")
+		if code != exitNoSnippets {
+			t.Errorf("init exited %v, want %v:\n%s", code, exitNoSnippets, out)
+		}
+		checkRan(t, h, []string{"pvesh get /storage"}, []string{"qm set"})
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		h := newFakeHost(t)
+		if code, out := runE2E(t, h, "qmexmut", "bogus"); code != exitUsage {
+			t.Errorf("exited %v, want %v:\n%s", code, exitUsage, out)
+		}
+	})
+}
+
+func TestE2EHook(t *testing.T) {
+	buildE2E(t)
+
+	for _, tc := range []struct {
+		name     string
+		config   string
+		setup    func(h *fakeHost)
+		hooks    []string // run in turn, each but the last exiting ok
+		exitCode int      // of the last hook
+		output   string   // of the last hook
+		ran      []string // command prefixes
+		notRan   []string
+	}{
+		{
+			name:   "pre-start stops mutuals",
+			hooks:  []string{"101 pre-start"},
+			ran:    []string{"qm set 102 --tags", "qm shutdown 102"},
+			notRan: []string{"qm shutdown 103", "qm stop"},
+		},
+		{
+			name:   "pre-start without mutuals running",
+			setup:  func(h *fakeHost) { h.addVM("102", "stopped", "name: work", "hostpci0: 0000:01:00") },
+			hooks:  []string{"101 pre-start"},
+			notRan: []string{"qm shutdown", "qm stop", "qm set"},
+		},
+		{
+			name:   "pre-start of an unmanaged vm",
+			hooks:  []string{"104 pre-start"},
+			output: "needs no management",
+			notRan: []string{"qm list", "qm shutdown", "qm stop"},
+		},
+		{
+			name:   "pre-start escalates to a hard stop",
+			config: "shutdown-method = acpi\non-shutdown-failure = stop\n",
+			setup:  func(h *fakeHost) { h.failCommand("102", "shutdown", "shutdown timed out") },
+			hooks:  []string{"101 pre-start"},
+			ran:    []string{"qm shutdown 102", "qm stop 102"},
+		},
+		{
+			name:   "pre-start fails when the hard stop fails too",
+			config: "shutdown-method = acpi\non-shutdown-failure = stop\n",
+			setup: func(h *fakeHost) {
+				h.failCommand("102", "shutdown", "shutdown timed out")
+				h.failCommand("102", "stop", "unable to stop")
+			},
+			hooks:    []string{"101 pre-start"},
+			exitCode: exitPreemptFailed,
+			ran:      []string{"qm shutdown 102", "qm stop 102"},
+		},
+		{
+			name:     "pre-start fails when shutdown fails",
+			setup:    func(h *fakeHost) { h.failCommand("102", "shutdown", "shutdown timed out") },
+			hooks:    []string{"101 pre-start"},
+			exitCode: exitPreemptFailed,
+			ran:      []string{"qm shutdown 102"},
+			notRan:   []string{"qm stop"},
+		},
+		{
+			name:     "pre-start denied by rule",
+			config:   "[rules]\nwhen target.name == work then deny\n",
+			hooks:    []string{"101 pre-start"},
+			exitCode: exitDenied,
+			output:   "denied starting vm #101",
+			notRan:   []string{"qm shutdown", "qm stop"},
+		},
+		{
+			name: "pre-start without qm",
+			setup: func(h *fakeHost) {
+				if err := os.Remove(h.path("bin", "qm")); err != nil {
+					h.t.Fatal(err)
+				}
+			},
+			hooks:    []string{"101 pre-start"},
+			exitCode: exitEnvironment,
+		},
+		{
+			name:  "post-start after preempting",
+			hooks: []string{"101 pre-start", "101 post-start"},
+			ran:   []string{"qm shutdown 102"},
+		},
+		{
+			name: "post-start clears being stopped-by",
+			setup: func(h *fakeHost) {
+				h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00", "tags: qmexmut.stopped-by.103")
+			},
+			hooks: []string{"101 post-start"},
+			ran:   []string{"qm set 101 --delete tags"},
+		},
+		{
+			name:   "pre-stop",
+			hooks:  []string{"101 pre-stop"},
+			notRan: []string{"qm shutdown", "qm stop", "qm start", "qm set"},
+		},
+		{
+			name:   "post-stop yields back",
+			config: "yield-back = true\n",
+			hooks:  []string{"101 pre-start", "101 post-start", "101 post-stop"},
+			ran:    []string{"qm shutdown 102", "qm start 102"},
+			notRan: []string{"qm start 103"},
+		},
+		{
+			name:   "post-stop without yield-back",
+			hooks:  []string{"101 pre-start", "101 post-start", "101 post-stop"},
+			notRan: []string{"qm start"},
+		},
+		{
+			name:   "post-stop of a preempted vm",
+			config: "yield-back = true\n",
+			hooks:  []string{"101 pre-start", "102 post-stop"},
+			notRan: []string{"qm start"},
+		},
+		{
+			name:     "unknown phase",
+			hooks:    []string{"101 mid-start"},
+			exitCode: exitUsage,
+			output:   `unknown phase "mid-start"`,
+		},
+		{
+			name:     "missing phase",
+			hooks:    []string{"101"},
+			exitCode: exitUsage,
+			output:   "usage:",
+		},
+		{
+			name:     "unknown flag",
+			hooks:    []string{"-bogus 101 pre-start"},
+			exitCode: exitUsage,
+			notRan:   []string{"qm"},
+		},
+		{
+			name:     "mismatched checksum",
+			hooks:    []string{"-expect-sha256 00 101 pre-start"},
+			exitCode: exitEnvironment,
+			notRan:   []string{"qm"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			h.write(h.path("qmexmut.conf"), tc.config)
+			h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00,pcie=1", "hookscript: local:snippets/"+hookCmdName)
+			h.addVM("102", "running", "name: work", "hostpci0: 0000:01:00", "hookscript: local:snippets/"+hookCmdName)
+			h.addVM("103", "running", "name: other", "hostpci0: 0000:02:00", "hookscript: local:snippets/"+hookCmdName)
+			h.addVM("104", "stopped", "name: plain", "net0: virtio=BC:24:11:00:00:01,bridge=vmbr0")
+			if tc.setup != nil {
+				tc.setup(h)
+			}
+
+			for i, hook := range tc.hooks {
+				code, out := runE2E(t, h, hookCmdName, strings.Fields(hook)...)
+				want := exitOK
+				if i == len(tc.hooks)-1 {
+					want = tc.exitCode
+					if !strings.Contains(out, tc.output) {
+						t.Errorf("%v output lacks %q:\n%s", hook, tc.output, out)
+					}
+				}
+				if code != want {
+					t.Fatalf("%v exited %v, want %v:\n%s", hook, code, want, out)
+				}
+			}
+			checkRan(t, h, tc.ran, tc.notRan)
+		})
+	}
+}
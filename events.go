@@ -0,0 +1,123 @@
+package main
+
+import "fmt"
+
+// eventKind is the kind of an event, as recorded in the event log.
+type eventKind string
+
+// Kinds of event, as recorded by recordEvent.
+const (
+	kindAdopt       eventKind = "adopt"       // an unmanaged VM was adopted
+	kindApprove     eventKind = "approve"     // a preemption was approved
+	kindAsk         eventKind = "ask"         // a preemption awaits approval
+	kindAttach      eventKind = "attach"      // passed thru devices weren't attached
+	kindBoot        eventKind = "boot"        // onboot was cleared for a mutual
+	kindCancel      eventKind = "cancel"      // a pending preemption was cancelled
+	kindDeny        eventKind = "deny"        // a start was denied
+	kindDisable     eventKind = "disable"     // enforcement was disabled
+	kindEnable      eventKind = "enable"      // enforcement was enabled again
+	kindInterrupted eventKind = "interrupted" // a hook run died midway
+	kindLease       eventKind = "lease"       // a queued start got its resources
+	kindPartial     eventKind = "partial"     // only some mutuals were stopped
+	kindPause       eventKind = "pause"       // enforcement was paused
+	kindPaused      eventKind = "paused"      // a start was let thru while paused
+	kindPreempt     eventKind = "preempt"     // mutuals are about to be stopped
+	kindReconcile   eventKind = "reconcile"   // a reconcile changed something, or failed to
+	kindReload      eventKind = "reload"      // the config file was reloaded
+	kindResume      eventKind = "resume"      // enforcement was resumed
+	kindRollback    eventKind = "rollback"    // a mutual was restarted after a failed start
+	kindSchedule    eventKind = "schedule"    // a VM was started by schedule
+	kindShutdown    eventKind = "shutdown"    // a mutual was stopped
+	kindStopping    eventKind = "stopping"    // a mutual is being stopped
+	kindSummary     eventKind = "summary"     // a hook run finished
+	kindUnmanaged   eventKind = "unmanaged"   // a start was let thru unmanaged
+	kindViolation   eventKind = "violation"   // mutuals were found running together
+	kindYieldBack   eventKind = "yield-back"  // a mutual was restarted after a stop
+)
+
+// eventKinds lists every kind of event.
+var eventKinds = []eventKind{
+	kindAdopt, kindApprove, kindAsk, kindAttach, kindBoot, kindCancel,
+	kindDeny, kindDisable, kindEnable, kindInterrupted, kindLease,
+	kindPartial, kindPause, kindPaused, kindPreempt, kindReconcile,
+	kindReload, kindResume, kindRollback, kindSchedule, kindShutdown,
+	kindStopping, kindSummary, kindUnmanaged, kindViolation, kindYieldBack,
+}
+
+// hasKind returns true if kinds includes kind.
+func hasKind(kind eventKind, kinds []eventKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSink is a subscriber to every event recorded by recordEvent, like the
+// event log, or the cluster log.
+type eventSink struct {
+	name string
+
+	// dryRun has the sink receive events even under -dry-run, since it
+	// changes nothing, like the hook run summary.
+	dryRun bool
+
+	handle func(ev event) error
+}
+
+// eventSinks are the subscribers to recorded events, in the order that they
+// subscribed; they subscribe from init, so are fixed before any event is
+// recorded.
+var eventSinks []eventSink
+
+// subscribeEvents registers a sink to receive every recorded event. Since
+// events may be recorded concurrently, like while shutting down several
+// mutuals at once, handle must be safe to call concurrently.
+func subscribeEvents(name string, dryRun bool, handle func(ev event) error) {
+	eventSinks = append(eventSinks, eventSink{name, dryRun, handle})
+}
+
+// publishEvent hands an event to every sink; failure of any one sink is only
+// logged, since it shouldn't prevent a VM from starting, nor other sinks from
+// receiving the event.
+func publishEvent(ev event) {
+	for _, sink := range eventSinks {
+		if dryRun && !sink.dryRun {
+			continue
+		}
+		if err := sink.handle(ev); err != nil {
+			warnf("unable to pass %v event to %v: %v", ev.Kind, sink.name, err)
+		}
+	}
+}
+
+func init() {
+	subscribeEvents("the log", true, logEvent)
+}
+
+// infoKinds lists the kinds of event logged at info level: preemptions, and
+// what's done about them.
+var infoKinds = []eventKind{kindPreempt, kindStopping, kindShutdown, kindRollback, kindYieldBack, kindSchedule, kindBoot}
+
+// logEvent logs every event: violations, and any failures, as warnings;
+// those of infoKinds as info; and the rest, like denials, which are already
+// returned as the hook's error, at debug level.
+func logEvent(ev event) error {
+	level := levelDebug
+	switch {
+	case ev.Kind == kindViolation || ev.Error != "" && ev.Kind != kindDeny:
+		level = levelWarn
+	case hasKind(ev.Kind, infoKinds):
+		level = levelInfo
+	}
+	msg := describeEvent(ev)
+	if ev.VMID != "" {
+		msg = fmt.Sprintf("vm #%v %v", ev.VMID, msg)
+	}
+	if dryRun {
+		msg = "would record: " + msg
+	}
+	logf(level, "%v", msg)
+	return nil
+}
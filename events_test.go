@@ -0,0 +1,121 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureEvents subscribes a sink for the rest of the test, returning a
+// function that returns the kinds of every event published so far.
+func captureEvents(t *testing.T) func() []eventKind {
+	var mu sync.Mutex
+	var kinds []eventKind
+	prior := eventSinks
+	subscribeEvents("the test", true, func(ev event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		kinds = append(kinds, ev.Kind)
+		return nil
+	})
+	t.Cleanup(func() { eventSinks = prior })
+	return func() []eventKind {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]eventKind(nil), kinds...)
+	}
+}
+
+func TestStopMutualsEvents(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   []eventKind
+	}{
+		{"preempted", "", []eventKind{kindPreempt, kindStopping, kindShutdown}},
+		{"denied", "[rules]\nwhen target.id == 102 then deny\n", []eventKind{kindDeny}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			h.setConfig(tc.config)
+			h.addVM("101", "stopped", "hostpci0: 0000:01:00")
+			h.addVM("102", "running", "hostpci0: 0000:01:00")
+			events := captureEvents(t)
+
+			_ = stopMutuals("101")
+			var got []string
+			for _, kind := range events() {
+				got = append(got, string(kind))
+			}
+			var want []string
+			for _, kind := range tc.want {
+				want = append(want, string(kind))
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got events %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNotifierEvents(t *testing.T) {
+	cf, err := parseConfig("test.conf", strings.NewReader(
+		"[notify ops]\ntype = webhook\nurl = http://localhost\nevents = deny,preempt,bogus\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifiers, errs := parseNotifiers(cf)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `invalid event kind "bogus"`) {
+		t.Errorf("got errors %v, want one for the invalid event kind", errs)
+	}
+	if len(notifiers) != 1 {
+		t.Fatalf("got %v notifiers, want 1", len(notifiers))
+	}
+	n := notifiers[0]
+	for kind, want := range map[eventKind]bool{kindDeny: true, kindPreempt: true, kindShutdown: false} {
+		if got := n.wants(event{Kind: kind}); got != want {
+			t.Errorf("got wants %v event %v, want %v", kind, got, want)
+		}
+	}
+}
+
+// TestEventKindLiterals checks that every event is recorded with one of the
+// kind constants, rather than a string literal that may not be a kind at all.
+func TestEventKindLiterals(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			if ident, ok := lit.Type.(*ast.Ident); !ok || ident.Name != "event" {
+				return true
+			}
+			for _, elt := range lit.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					continue
+				}
+				if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Kind" {
+					if _, ok := kv.Value.(*ast.BasicLit); ok {
+						t.Errorf("%v: event kind given as a literal, not a constant", fset.Position(kv.Value.Pos()))
+					}
+				}
+			}
+			return true
+		})
+	}
+}
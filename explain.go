@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// runExplain compares the host resources of two VMs, showing which labels
+// they share, which shared labels aren't enforced and why, and any near
+// misses, where both refer to related parts of one physical device under
+// different labels; it's for debugging why two VMs are, or aren't, mutuals.
+func runExplain(args []string) error {
+	if len(args) != 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: explain <vmid> <vmid>"))
+	}
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	a, b := findVM(vms, args[0]), findVM(vms, args[1])
+	for i, vm := range []*vmInfo{a, b} {
+		if vm == nil {
+			return withExitCode(exitUsage, fmt.Errorf("no such vm #%v", args[i]))
+		}
+	}
+
+	aKeys, bKeys := resourceKeys(a.config), resourceKeys(b.config)
+	labels := append([]string(nil), a.resources...)
+	for _, label := range b.resources {
+		if !hasString(label, labels) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	var tab table
+	tab.header("RESOURCE", "#"+a.id, "#"+b.id, "RESULT")
+	for _, label := range labels {
+		inA, inB := hasString(label, a.resources), hasString(label, b.resources)
+		result := plain("")
+		switch {
+		case !inA || !inB:
+			if miss := nearMisses(label, a.resources, b.resources, inA); len(miss) > 0 {
+				result = colored(colorYellow, "near miss: "+strings.Join(miss, "; "))
+			}
+		case isEnforced(label):
+			result = colored(colorRed, "shared")
+		default:
+			result = plain("shared, but " + notEnforcedReason(label))
+		}
+		tab.add(plain(describeDevices([]string{label})), plain(strings.Join(aKeys[label], ",")), plain(strings.Join(bKeys[label], ",")), result)
+	}
+
+	fmt.Printf("vm #%v (%v) and vm #%v (%v)", a.id, a.name, b.id, b.name)
+	shared := sharedResources(a.resources, b.resources)
+	switch {
+	case a.id == b.id:
+		fmt.Printf(" are the same vm\n")
+	case len(shared) == 0:
+		fmt.Printf(" are not mutuals, sharing no enforced resources\n")
+	case !samePool(*a, *b):
+		fmt.Printf(" are not mutuals, being in different pools %q and %q\n", a.pool, b.pool)
+	default:
+		fmt.Printf(" are mutuals, sharing %v\n", describeDevices(shared))
+	}
+	if len(tab.rows) == 1 {
+		return nil
+	}
+	return printTable(&tab)
+}
+
+// resourceKeys maps each resource label of a config to the keys, like
+// hostpci0, that pass it thru.
+func resourceKeys(conf vmConfig) map[string][]string {
+	keys := make(map[string][]string)
+	for key, val := range conf {
+		for _, label := range hostResourceLabels(key, val) {
+			keys[label] = append(keys[label], key)
+		}
+	}
+	for _, ks := range keys {
+		sort.Strings(ks)
+	}
+	return keys
+}
+
+// notEnforcedReason explains why a label isn't enforced.
+func notEnforcedReason(label string) string {
+	switch {
+	case isShareable(label):
+		return "shareable"
+	case isIgnoredClass(label):
+		return "of an ignored class"
+	case isIdenticalUSB(label):
+		return "one of several identical usb devices"
+	case isSpareMdev(label):
+		n, _ := mdevAvailable(label)
+		return fmt.Sprintf("a vgpu profile with %v instances free", n)
+	case isDisabled(label):
+		return "disabled"
+	}
+	return "not enforced"
+}
+
+// nearMisses explains how a label, passed thru by only one of two VMs,
+// relates to any different label of the same physical device passed thru by
+// the other VM.
+func nearMisses(label string, aLabels, bLabels []string, inA bool) (misses []string) {
+	others := aLabels
+	if inA {
+		others = bLabels
+	}
+	for _, other := range others {
+		if other == label || resourceClass(other) != resourceClass(label) {
+			continue
+		}
+		if why := relatedDevices(label, other); why != "" {
+			misses = append(misses, fmt.Sprintf("%v %v", why, other))
+		}
+	}
+	return misses
+}
+
+// relatedDevices describes how two different labels refer to parts of one
+// physical device, or returns the empty string if they don't.
+func relatedDevices(label, other string) string {
+	switch resourceClass(label) {
+	case "hostpci":
+		base := func(l string) string {
+			l = strings.TrimPrefix(l, "hostpci:")
+			if i := strings.IndexByte(l, '/'); i >= 0 {
+				l = l[:i]
+			}
+			if i := strings.LastIndexByte(l, '.'); i >= 0 {
+				l = l[:i]
+			}
+			return l
+		}
+		if base(label) != base(other) {
+			return ""
+		}
+		if strings.ContainsRune(label, '/') || strings.ContainsRune(other, '/') {
+			return "same gpu as"
+		}
+		return "same pci device as"
+
+	case "hostusb":
+		id, port := strings.TrimPrefix(label, "hostusb:"), strings.TrimPrefix(other, "hostusb:")
+		if usbIDPat.MatchString(port) {
+			id, port = port, id
+		}
+		if usbIDPat.MatchString(id) && strings.EqualFold(usbIDsByPort()[port], id) {
+			return "same usb device as"
+		}
+
+	case "hostdir":
+		dir, otherDir := strings.TrimPrefix(label, "hostdir:"), strings.TrimPrefix(other, "hostdir:")
+		if strings.HasPrefix(dir, otherDir+"/") || otherDir == "/" {
+			return "directory inside"
+		}
+		if strings.HasPrefix(otherDir, dir+"/") || dir == "/" {
+			return "directory containing"
+		}
+	}
+	return ""
+}
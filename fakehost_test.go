@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHost stubs out a proxmox host for tests: qm and pvesh are replaced by
+// shell scripts, first in PATH, that serve VMs from files in a temporary
+// directory, and log every command run; the state directory and sysfs trees
+// are temporary too.
+type fakeHost struct {
+	t   testing.TB
+	dir string
+}
+
+// fakeQM serves VMs from @DIR@/vms, where each has a <vmid>.conf, a
+// <vmid>.status as qm list reports it, optionally a <vmid>.qmp qemu status,
+// which is otherwise the same, optionally a <vmid>.slow number of seconds
+// that stopping it takes, and optionally a <vmid>.fail-<command> error that
+// the command fails with.
+const fakeQM = `#!/bin/sh
+D='@DIR@'
+echo "qm $*" >> "$D/log"
+if [ -e "$D/vms/$2.fail-$1" ]; then
+	cat "$D/vms/$2.fail-$1" >&2
+	exit 2
+fi
+case "$1" in
+list)
+	echo "      VMID NAME                 STATUS     MEM(MB)    BOOTDISK(GB) PID"
+	for f in "$D"/vms/*.conf; do
+		[ -e "$f" ] || continue
+		id=$(basename "$f" .conf)
+		name=$(sed -n 's/^name: //p' "$f")
+		printf '%10s %-20s %-10s %-10s %-12s %s\n' "$id" "${name:-vm$id}" "$(cat "$D/vms/$id.status")" 2048 32.00 0
+	done ;;
+config)
+	sed -e '/^\[/,$d' -e '/^#/d' "$D/vms/$2.conf" ;;
+status)
+	st=$(cat "$D/vms/$2.status")
+	echo "status: $st"
+	if [ "$3" = --verbose ]; then
+		[ -e "$D/vms/$2.qmp" ] && st=$(cat "$D/vms/$2.qmp")
+		echo "qmpstatus: $st"
+	fi ;;
+shutdown|stop)
+	[ -e "$D/vms/$2.slow" ] && sleep "$(cat "$D/vms/$2.slow")"
+	echo stopped > "$D/vms/$2.status"
+	rm -f "$D/vms/$2.qmp" ;;
+start)
+	echo running > "$D/vms/$2.status" ;;
+set)
+	f="$D/vms/$2.conf"
+	shift 2
+	while [ $# -gt 1 ]; do
+		key=${1#-}
+		key=${key#-}
+		if [ "$key" = delete ]; then
+			for k in $(echo "$2" | tr , ' '); do sed -i "/^$k: /d" "$f"; done
+		else
+			sed -i "/^$key: /d" "$f"
+			{ echo "$key: $2"; cat "$f"; } > "$f.new" && mv "$f.new" "$f"
+		fi
+		shift 2
+	done ;;
+esac
+`
+
+// fakePvesh serves any @DIR@/pvesh/<path>.json for a get of that path, and
+// otherwise an empty list.
+const fakePvesh = `#!/bin/sh
+D='@DIR@'
+echo "pvesh $*" >> "$D/log"
+if [ -e "$D/pvesh$2.json" ]; then
+	cat "$D/pvesh$2.json"
+else
+	echo '[]'
+fi
+`
+
+// fakePct is only logged, since only VMs are managed, and containers never
+// should be.
+const fakePct = `#!/bin/sh
+echo "pct $*" >> '@DIR@/log'
+`
+
+func newFakeHost(t testing.TB) *fakeHost {
+	t.Helper()
+	h := &fakeHost{t, t.TempDir()}
+	for _, sub := range []string{"bin", "vms", "state", "pci", "usb"} {
+		if err := os.Mkdir(h.path(sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range map[string]string{"qm": fakeQM, "pvesh": fakePvesh, "pct": fakePct} {
+		script = strings.ReplaceAll(script, "@DIR@", h.dir)
+		if err := os.WriteFile(h.path("bin", name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", h.path("bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	priorQemu, priorState, priorPCI, priorUSB := qemuServerDir, stateDir, pciSysfs, usbSysfs
+	qemuServerDir, stateDir, pciSysfs, usbSysfs = h.path("vms"), h.path("state"), h.path("pci"), h.path("usb")
+	h.resetCaches()
+	t.Cleanup(func() {
+		qemuServerDir, stateDir, pciSysfs, usbSysfs = priorQemu, priorState, priorPCI, priorUSB
+		if err := applyConfig(configFile{}); err != nil {
+			t.Error(err)
+		}
+		h.resetCaches()
+	})
+	return h
+}
+
+func (h *fakeHost) path(elem ...string) string {
+	return filepath.Join(append([]string{h.dir}, elem...)...)
+}
+
+func (h *fakeHost) resetCaches() {
+	resetConfigCaches()
+	resetHostCaches()
+	noteScanned(nil)
+	configCache.Lock()
+	configCache.loaded, configCache.dirty, configCache.entries = false, false, nil
+	configCache.Unlock()
+}
+
+func (h *fakeHost) write(name, content string) {
+	h.t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// addVM adds a VM with the given qm list status, and config lines.
+func (h *fakeHost) addVM(id, status string, conf ...string) {
+	h.t.Helper()
+	h.write(h.path("vms", id+".conf"), strings.Join(conf, "\n")+"\n")
+	h.write(h.path("vms", id+".status"), status+"\n")
+}
+
+// slowShutdown has shutting down or stopping a VM take the given seconds.
+func (h *fakeHost) slowShutdown(id string, seconds float64) {
+	h.t.Helper()
+	h.write(h.path("vms", id+".slow"), fmt.Sprint(seconds)+"\n")
+}
+
+// failCommand has a qm command, like shutdown, fail for a VM with the given
+// error message.
+func (h *fakeHost) failCommand(id, cmd, msg string) {
+	h.t.Helper()
+	h.write(h.path("vms", id+".fail-"+cmd), msg+"\n")
+}
+
+// setQemuStatus sets the finer qemu status of a running VM, like paused.
+func (h *fakeHost) setQemuStatus(id, status string) {
+	h.t.Helper()
+	h.write(h.path("vms", id+".qmp"), status+"\n")
+}
+
+// addPCI adds a PCI function to sysfs, in the given IOMMU group, if any.
+func (h *fakeHost) addPCI(addr, group string) {
+	h.t.Helper()
+	dev := h.path("pci", addr)
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		h.t.Fatal(err)
+	}
+	if group != "" {
+		if err := os.Symlink("../../../kernel/iommu_groups/"+group, filepath.Join(dev, "iommu_group")); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+}
+
+// setConfig applies the given config file text, as loadConfig would.
+func (h *fakeHost) setConfig(text string) {
+	h.t.Helper()
+	cf, err := parseConfig("test.conf", strings.NewReader(text))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := applyConfig(cf); err != nil {
+		h.t.Fatal(err)
+	}
+	resetConfigCaches()
+}
+
+// setPvesh has pvesh get the given path return the given JSON.
+func (h *fakeHost) setPvesh(path, json string) {
+	h.t.Helper()
+	h.write(h.path("pvesh", path+".json"), json+"\n")
+}
+
+// commands returns every qm, pvesh, and pct command run so far.
+func (h *fakeHost) commands() []string {
+	h.t.Helper()
+	data, err := os.ReadFile(h.path("log"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// ran returns true if any command run so far starts with the given prefix.
+func (h *fakeHost) ran(prefix string) bool {
+	for _, cmd := range h.commands() {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runFree vacates host resources on demand, like before maintenance on a
+// device, by shutting down any running VMs that hold them; they're shut down
+// as the hook would preempt them, honoring each VM's shutdown settings.
+func runFree(args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: free <resource|vmid>..."))
+	}
+	labels, err := resolveResources(args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	var holders []vmInfo
+	for _, vm := range vms {
+		if vm.status != "running" || len(heldLabels(vm, labels)) == 0 {
+			continue
+		}
+		switch action := preemptAction(vm); {
+		case action == actionDeny:
+			return withExitCode(exitDenied, fmt.Errorf("vm #%v holds %v, but is protected", vm.id, strings.Join(labels, ",")))
+		case isPreempting(action):
+			holders = append(holders, vm)
+		default:
+			warnf("not stopping vm #%v in state %q", vm.id, vm.state)
+		}
+	}
+	if len(holders) == 0 {
+		infof("%v not held by any running vm", strings.Join(labels, ","))
+		return nil
+	}
+	for _, vm := range holders {
+		infof("freeing %v from vm #%v (%v)", describeDevices(heldLabels(vm, labels)), vm.id, vm.name)
+	}
+	if err := shutdownVMs("", holders); err != nil {
+		return withExitCode(exitPreemptFailed, err)
+	}
+	return nil
+}
+
+// heldLabels returns those of the given labels that a VM passes thru.
+func heldLabels(vm vmInfo, labels []string) (held []string) {
+	for _, label := range labels {
+		if hasString(label, vm.resources) && !hasString(label, held) {
+			held = append(held, label)
+		}
+	}
+	return held
+}
+
+// canonicalLabel canonicalizes a resource label given by the user, as
+// hostResourceLabels would have labeled the device, so that hostpci:01:00.0
+// names the same device as hostpci:0000:01:00.
+func canonicalLabel(label string) string {
+	switch resourceClass(label) {
+	case "hostpci":
+		dev := strings.TrimPrefix(label, "hostpci:")
+		suffix := ""
+		if i := strings.IndexByte(dev, '/'); i >= 0 {
+			dev, suffix = dev[:i], dev[i:]
+		}
+		if suffix != "" {
+			return "hostpci:" + pciDevice(dev) + suffix
+		}
+		return "hostpci:" + pciResource(dev)
+	case "hostusb":
+		return usbLabel(strings.TrimPrefix(label, "hostusb:"))
+	case "hostdir":
+		if dir := strings.TrimPrefix(label, "hostdir:"); strings.HasPrefix(dir, "/") {
+			return hostDirLabel(dir)
+		}
+	}
+	return label
+}
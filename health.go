@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthCheck is the result of one check made by ctl health or ready.
+type healthCheck struct {
+	name   string
+	err    error
+	detail string
+}
+
+// watchHealth checks that the watch daemon is healthy, and if ready is set,
+// that it's ready to reconcile, by reaching qm and pvesh; it's run by the
+// watch loop, so any answer at all means the loop isn't wedged.
+func watchHealth(ready bool) (string, error) {
+	var checks []healthCheck
+
+	// a reconcile may take as long as shutting down a violating mutual, so
+	// allow it a couple intervals before calling it stale
+	last := healthCheck{name: "reconcile"}
+	paused, err := enforcementPaused()
+	switch {
+	case err != nil:
+		last.err = err
+	case paused != nil:
+		last.detail = fmt.Sprintf("paused since %v", paused.Time.Format(time.RFC3339))
+	case watchStatus.lastReconcile.IsZero():
+		last.err = fmt.Errorf("never reconciled")
+	case time.Since(watchStatus.lastReconcile) > 2*watchInterval+time.Minute:
+		last.err = fmt.Errorf("last reconciled %v ago", time.Since(watchStatus.lastReconcile).Round(time.Second))
+	case watchStatus.lastErr != nil:
+		last.err = watchStatus.lastErr
+	default:
+		last.detail = fmt.Sprintf("%v ago", time.Since(watchStatus.lastReconcile).Round(time.Second))
+	}
+	checks = append(checks, last)
+
+	if ready {
+		qm := healthCheck{name: "qm"}
+		if recs, err := listVMs(); err != nil {
+			qm.err = err
+		} else {
+			qm.detail = fmt.Sprintf("%v vm(s)", len(recs))
+		}
+		checks = append(checks, qm)
+
+		pvesh := healthCheck{name: "pvesh"}
+		if store, _, err := findSnippets(); err != nil {
+			pvesh.err = err
+		} else {
+			pvesh.detail = fmt.Sprintf("snippets on %v", store)
+		}
+		checks = append(checks, pvesh)
+	}
+
+	failed := 0
+	var tab table
+	tab.header("CHECK", "RESULT", "DETAIL")
+	for _, check := range checks {
+		if check.err != nil {
+			failed++
+			// only the first line, since some errors explain at length
+			detail := strings.SplitN(check.err.Error(), "\n", 2)[0]
+			tab.add(plain(check.name), plain("fail"), plain(detail))
+		} else {
+			tab.add(plain(check.name), plain("ok"), plain(check.detail))
+		}
+	}
+	var sb strings.Builder
+	if err := tab.writeTo(&sb, false); err != nil {
+		return "", err
+	}
+	out := strings.TrimRight(sb.String(), "\n")
+	if failed > 0 {
+		return out, fmt.Errorf("%v check(s) failed", failed)
+	}
+	return out, nil
+}
+
+// sdNotify sends a state notification to systemd, if it's supervising us
+// with Type=notify; it returns false if not.
+func sdNotify(state string) bool {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return false
+	}
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		warnf("unable to notify systemd: %v", err)
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		warnf("unable to notify systemd: %v", err)
+		return false
+	}
+	return true
+}
+
+// sdWatchdogInterval returns how often to ping any systemd watchdog: half of
+// its timeout, or 0 if there's none.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runHolders lists the VMs that reference a device in any of their configs,
+// whether current, pending, or within a snapshot, and which of them holds it
+// by running with it passed thru.
+func runHolders(args []string) error {
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: holders <resource|pci address|usb id|mapping>"))
+	}
+	label := resolveDevice(args[0])
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v:\n", describeDevices([]string{label}))
+	var tab table
+	tab.header("VMID", "NAME", "STATUS", "CONFIG", "HOLDS")
+	for _, vm := range vms {
+		sections, err := referencingSections(vm.id, label)
+		if err != nil {
+			return err
+		}
+		// current configs are read by qm config, since there may be no local file
+		if hasString(label, vm.resources) && !hasString("current", sections) {
+			sections = append([]string{"current"}, sections...)
+		}
+		if len(sections) == 0 {
+			continue
+		}
+		holds := plain("no")
+		if vm.status == "running" && hasString(label, vm.resources) {
+			holds = colored(colorGreen, "yes")
+		}
+		tab.add(plain(vm.id), plain(vm.name), plain(vm.state), plain(strings.Join(sections, ",")), holds)
+	}
+	if len(tab.rows) == 1 {
+		fmt.Printf("  no vm references it\n")
+		return nil
+	}
+	return printTable(&tab)
+}
+
+// resolveDevice resolves a device given as an alias, a resource label, a bare
+// PCI address or USB vendor:product id, or else the name of a proxmox resource
+// mapping, into a resource label.
+func resolveDevice(arg string) string {
+	if label, ok := aliasLabel(arg); ok {
+		return label
+	}
+	switch {
+	case strings.ContainsRune(arg, ':') && hasString(resourceClass(arg), resourceClasses):
+		return canonicalLabel(arg)
+	case pciAddrPat.MatchString(arg):
+		return "hostpci:" + pciResource(arg)
+	case usbIDPat.MatchString(arg):
+		return usbLabel(strings.ToLower(arg))
+	}
+	return "hostpci:mapping=" + arg
+}
+
+// referencingSections returns the sections of a VM's config file that pass
+// thru the labeled device: current, pending, or a snapshot name.
+func referencingSections(id, label string) (sections []string, rerr error) {
+	f, err := os.Open(filepath.Join(qemuServerDir, id+".conf"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := "current"
+	sc := newLineScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			if section == "PENDING" {
+				section = "pending"
+			} else {
+				section = "snapshot " + section
+			}
+			continue
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 || hasString(section, sections) {
+			continue
+		}
+		if hasString(label, hostResourceLabels(line[:i], line[i+2:])) {
+			sections = append(sections, section)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vm #%v config: %w", id, lineScanError(err))
+	}
+	return sections, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// sharedDirs is how host directories shared with VMs, by virtiofs or 9p, are
+// treated: not at all by default; as shareable, only reported; or as
+// exclusive, so that VMs sharing the same directory are mutuals.
+var sharedDirs = "off"
+
+var sharedDirModes = []string{"off", "shareable", "exclusive"}
+
+func init() {
+	flag.Var(choiceFlag{&sharedDirs, sharedDirModes}, "shared-dirs",
+		"treat host directories shared by virtiofs or 9p as resources: off, shareable, or exclusive")
+}
+
+// virtiofsLabel returns the label of the directory shared by a virtiofs
+// config value, like "dirid=share,cache=auto"; since the directory is given
+// as a cluster mapping, it's labeled by mapping name.
+func virtiofsLabel(value string) string {
+	for i, opt := range strings.Split(value, ",") {
+		if strings.HasPrefix(opt, "dirid=") {
+			return "hostdir:mapping=" + strings.TrimPrefix(opt, "dirid=")
+		}
+		if i == 0 && !strings.ContainsRune(opt, '=') {
+			return "hostdir:mapping=" + opt
+		}
+	}
+	return ""
+}
+
+// hostDirLabel returns the label of a host directory, cleaned so that each
+// directory has one label however it's written.
+func hostDirLabel(dir string) string {
+	return "hostdir:" + path.Clean(dir)
+}
+
+// isShareableDir returns true if a label is a shared directory, and those
+// are shareable.
+func isShareableDir(label string) bool {
+	return sharedDirs == "shareable" && resourceClass(label) == "hostdir"
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// hotplugRule is a udev rule that runs hotplug whenever a USB device is
+// plugged or unplugged; it's run by systemd, since udev kills long running
+// commands, and a reconcile may have to wait for a mutual to shutdown.
+const hotplugRule = `ACTION=="add|remove", SUBSYSTEM=="usb", ENV{DEVTYPE}=="usb_device", RUN+="/usr/bin/systemd-run --no-block %v hotplug"
+`
+
+// hotplugRulePath is where the hotplug rule should be installed.
+const hotplugRulePath = "/etc/udev/rules.d/90-qmexmut.rules"
+
+// runHotplug re-evaluates VMs after a USB device is plugged or unplugged,
+// since that changes which ports USB ids resolve to, and so which VMs are
+// mutuals: it has any running watch daemon reconcile, or else reconciles
+// itself.
+//
+// With a -udev-rule argument, it instead prints a udev rule to run it.
+func runHotplug(args []string) error {
+	if len(args) == 1 && args[0] == "-udev-rule" {
+		fmt.Printf(hotplugRule, libPath())
+		return nil
+	}
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: hotplug [-udev-rule]"))
+	}
+
+	if conn, err := net.Dial("unix", ctlSocketPath()); err == nil {
+		conn.Close()
+		debugf("having watch reconcile")
+		return runCtl([]string{"reconcile"})
+	}
+	return runReconcile(nil)
+}
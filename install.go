@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// libDir is where init installs the qmexmut binary; the hook snippet is then
+// just a stub that execs it, since snippet storage may be slow shared storage
+// that would otherwise be read in full on every hook run.
+var libDir = "/usr/local/lib/qmexmut"
+
+// expectSum is passed by the hook stub, so that a binary that doesn't match
+// the stub, like one left over from a partial init, refuses to run.
+var expectSum string
+
+func init() {
+	flag.StringVar(&libDir, "lib-dir", libDir, "directory to install the qmexmut binary in")
+	flag.StringVar(&expectSum, "expect-sha256", "", "fail unless the running executable has this sha256 checksum")
+}
+
+func libPath() string {
+	return filepath.Join(libDir, "qmexmut")
+}
+
+// hookStub is the shell script installed as the hook snippet.
+const hookStub = `#!/bin/sh
+# qmexmut hook stub, installed by qmexmut init
+exec %v -cmd %v -expect-sha256 %v "$@"
+`
+
+var hookStubPat = regexp.MustCompile(`(?m)^exec (\S+) .*-expect-sha256 ([0-9a-f]+)`)
+
+// installSelf copies the current executable into libDir, and then writes a
+// hook stub for it at hookDest. Both are replaced by renaming, so that any
+// hook running concurrently keeps working.
+func installSelf(hookDest string) error {
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		return err
+	}
+	tmp := libPath() + ".tmp"
+	if err := copySelfTo(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, libPath()); err != nil {
+		return err
+	}
+
+	sum, err := fileSHA256(libPath())
+	if err != nil {
+		return err
+	}
+	stub := fmt.Sprintf(hookStub, libPath(), hookCmdName, sum)
+	tmp = hookDest + ".tmp"
+	if err := os.WriteFile(tmp, []byte(stub), 0755); err != nil {
+		return fmt.Errorf("unable to write %q: %w", tmp, err)
+	}
+	return os.Rename(tmp, hookDest)
+}
+
+// verifySelf checks the running executable against any -expect-sha256.
+func verifySelf() error {
+	if expectSum == "" {
+		return nil
+	}
+	selfExe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to get self executable: %w", err)
+	}
+	sum, err := fileSHA256(selfExe)
+	if err != nil {
+		return err
+	}
+	if sum != expectSum {
+		return fmt.Errorf("%q does not match its hook stub, rerun qmexmut init", selfExe)
+	}
+	return nil
+}
+
+// checkStub returns a description of any problem with the hook stub at
+// hookDest, or the empty string if it's fine or not installed.
+func checkStub(hookDest string) string {
+	stub, err := os.ReadFile(hookDest)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		return err.Error()
+	}
+	match := hookStubPat.FindSubmatch(stub)
+	if match == nil {
+		return fmt.Sprintf("%q is not a hook stub, rerun qmexmut init", hookDest)
+	}
+	sum, err := fileSHA256(string(match[1]))
+	if err != nil {
+		return err.Error()
+	}
+	if sum != string(match[2]) {
+		return fmt.Sprintf("%q does not match hook stub %q, rerun qmexmut init", match[1], hookDest)
+	}
+	return ""
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("unable to read %q: %w", name, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
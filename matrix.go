@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// runMatrix prints an N×N matrix of every VM against every other, with the
+// resources that make them mutuals in each cell, as a table, or with -csv or
+// -json for documentation and capacity planning.
+func runMatrix(args []string) error {
+	format := "table"
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && (args[0] == "-csv" || args[0] == "-json"):
+		format = args[0][1:]
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("usage: matrix [-csv|-json]"))
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	shared := make([][][]string, len(vms))
+	for i, a := range vms {
+		shared[i] = make([][]string, len(vms))
+		for j, b := range vms {
+			if areMutuals(a, b) {
+				shared[i][j] = sharedResources(a.resources, b.resources)
+			}
+		}
+	}
+
+	switch format {
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		header := []string{"vmid"}
+		for _, vm := range vms {
+			header = append(header, vm.id)
+		}
+		_ = w.Write(header)
+		for i, vm := range vms {
+			row := []string{vm.id}
+			for j := range vms {
+				row = append(row, describeDevices(shared[i][j]))
+			}
+			_ = w.Write(row)
+		}
+		w.Flush()
+		return w.Error()
+
+	case "json":
+		type matrixVM struct {
+			VMID    string              `json:"vmid"`
+			Name    string              `json:"name"`
+			Mutuals map[string][]string `json:"mutuals"`
+		}
+		doc := make([]matrixVM, len(vms))
+		for i, vm := range vms {
+			doc[i] = matrixVM{VMID: vm.id, Name: vm.name, Mutuals: make(map[string][]string)}
+			for j, other := range vms {
+				if len(shared[i][j]) > 0 {
+					doc[i].Mutuals[other.id] = shared[i][j]
+				}
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	}
+
+	var tab table
+	header := []string{"VMID"}
+	for _, vm := range vms {
+		header = append(header, "#"+vm.id)
+	}
+	tab.header(header...)
+	for i, vm := range vms {
+		row := []cell{plain("#" + vm.id)}
+		for j := range vms {
+			switch {
+			case i == j:
+				row = append(row, plain("-"))
+			case len(shared[i][j]) > 0:
+				row = append(row, colored(colorRed, describeDevices(shared[i][j])))
+			default:
+				row = append(row, plain(""))
+			}
+		}
+		tab.add(row...)
+	}
+	return printTable(&tab)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// runMetrics prints metrics in the prometheus text format, suitable for the
+// node exporter's textfile collector: counters of enforcement outcomes, taken
+// from the event log, and gauges of current contention, from a scan of VMs.
+func runMetrics(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: metrics"))
+	}
+
+	var preemptions, failed, hardStops, denials, violations int
+	if err := readEvents(func(ev event) {
+		switch ev.Kind {
+		case kindShutdown:
+			preemptions++
+			if ev.Error != "" {
+				failed++
+			}
+			if strings.HasSuffix(ev.Method, "+stop") {
+				hardStops++
+			}
+		case kindDeny:
+			denials++
+		case kindViolation:
+			violations++
+		}
+	}); err != nil {
+		return err
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	domains, contended := 0, 0
+	for _, domain := range exclusionDomains(vms) {
+		if len(domain) < 2 {
+			continue
+		}
+		domains++
+		if isContended(domain, st) {
+			contended++
+		}
+	}
+
+	metric := func(name, kind, help string, value int) {
+		fmt.Printf("# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, kind, name, value)
+	}
+	metric("qmexmut_preemptions_total", "counter", "Mutuals that the hook tried to stop.", preemptions)
+	metric("qmexmut_preemption_failures_total", "counter", "Mutuals that the hook failed to stop.", failed)
+	metric("qmexmut_hard_stop_escalations_total", "counter", "Mutuals hard stopped after failing to shutdown in time.", hardStops)
+	metric("qmexmut_denials_total", "counter", "VM starts denied.", denials)
+	metric("qmexmut_violations_total", "counter", "Pairs of mutuals found running together.", violations)
+	metric("qmexmut_exclusion_domains", "gauge", "Sets of VMs connected by sharing host resources.", domains)
+	metric("qmexmut_exclusion_domains_contended", "gauge", "Exclusion domains with mutuals running together, or VMs waiting in queue.", contended)
+	return nil
+}
+
+// isContended returns true if more than one VM of an exclusion domain is
+// running, or any is waiting in queue.
+func isContended(domain []vmInfo, st state) bool {
+	running := 0
+	for _, vm := range domain {
+		if vm.status == "running" {
+			running++
+		}
+		for _, entries := range st.Queue {
+			for _, ent := range entries {
+				if ent.VMID == vm.id {
+					return true
+				}
+			}
+		}
+	}
+	return running > 1
+}
+
+// readEvents calls fn with every event in the event log, skipping any lines
+// that aren't valid events; a missing log has no events.
+func readEvents(fn func(ev event)) error {
+	f, err := os.Open(eventLogPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := newLineScanner(f)
+	for sc.Scan() {
+		var ev event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			debugf("skipping invalid event %q: %v", sc.Text(), err)
+			continue
+		}
+		fn(ev)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read %q: %w", eventLogPath(), lineScanError(err))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// idsDirs are searched, in order, for the pci.ids and usb.ids databases used
+// to name devices, as installed by pciutils, usbutils, or hwdata.
+var idsDirs = []string{"/usr/share/misc", "/usr/share/hwdata", "/usr/share"}
+
+// idsDB maps lower case hex vendor ids, and vendor:device ids, to names.
+type idsDB map[string]string
+
+var (
+	pciNamesOnce, usbNamesOnce sync.Once
+	pciNames, usbNames         idsDB
+)
+
+// deviceName returns a human readable description of the device identified
+// by a resource label, like "NVIDIA Corporation GA102 [GeForce RTX 3080]",
+// or the empty string if unknown. Device ids are read from sysfs, and named
+// by the pci.ids and usb.ids databases, without needing lspci or lsusb.
+func deviceName(label string) string {
+	id := strings.TrimPrefix(label, resourceClass(label)+":")
+	switch resourceClass(label) {
+	case "hostpci":
+		if i := strings.IndexByte(id, '/'); i >= 0 {
+			id = id[:i] // a vGPU is named as its GPU
+		}
+		vendor, device := pciSysfsID(id)
+		if vendor == "" {
+			return ""
+		}
+		pciNamesOnce.Do(func() { pciNames = loadIDs("pci.ids") })
+		return pciNames.name(vendor, device)
+
+	case "hostusb":
+		if !usbIDPat.MatchString(id) {
+			id = usbIDsByPort()[id]
+		}
+		if id == "" {
+			return ""
+		}
+		usbNamesOnce.Do(func() { usbNames = loadIDs("usb.ids") })
+		return usbNames.name(id[:4], id[5:])
+	}
+	return ""
+}
+
+// pciSysfsID returns the vendor and device ids of a PCI device or function,
+// as labeled by pciDevice; a device is identified by its first function.
+func pciSysfsID(addr string) (vendor, device string) {
+	fn := addr
+	if strings.Count(addr, ".") == 0 {
+		matches, _ := filepath.Glob(filepath.Join(pciSysfs, addr+".*"))
+		if len(matches) == 0 {
+			return "", ""
+		}
+		fn = filepath.Base(matches[0])
+	}
+	readID := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(pciSysfs, fn, name))
+		if err != nil {
+			return ""
+		}
+		return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	}
+	return readID("vendor"), readID("device")
+}
+
+// name returns "<vendor> <device>" names, falling back to the vendor name
+// alone if the device is unknown, or the empty string if the vendor is.
+func (db idsDB) name(vendor, device string) string {
+	vendor, device = strings.ToLower(vendor), strings.ToLower(device)
+	vendorName, ok := db[vendor]
+	if !ok {
+		return ""
+	}
+	if deviceName, ok := db[vendor+":"+device]; ok {
+		return vendorName + " " + deviceName
+	}
+	return vendorName + " device " + device
+}
+
+// loadIDs parses the vendor and device entries of the first ids database file
+// of the given name found in idsDirs; if none is found, all devices are
+// unnamed. Lines look like:
+//
+//	10de  NVIDIA Corporation
+//		2206  GA102 [GeForce RTX 3080]
+//			<subsystem entries, ignored>
+//
+// Any other top level line, like a device class "C 03  Display controller",
+// starts a section that isn't of vendors, and so is skipped.
+func loadIDs(file string) idsDB {
+	db := make(idsDB)
+	for _, dir := range idsDirs {
+		f, err := os.Open(filepath.Join(dir, file))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		vendor := ""
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if line[0] != '\t' {
+				vendor = ""
+				if id, name, ok := parseIDLine(line); ok {
+					vendor = id
+					db[id] = name
+				}
+			} else if vendor != "" && !strings.HasPrefix(line, "\t\t") {
+				if id, name, ok := parseIDLine(line[1:]); ok {
+					db[vendor+":"+id] = name
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			debugf("unable to read %q: %v", f.Name(), err)
+		}
+		return db
+	}
+	debugf("no %v database found in %v", file, strings.Join(idsDirs, ", "))
+	return db
+}
+
+// parseIDLine parses a "<4 hex digit id>  <name>" line.
+func parseIDLine(line string) (id, name string, ok bool) {
+	if len(line) < 7 || line[4:6] != "  " {
+		return "", "", false
+	}
+	for _, r := range line[:4] {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return "", "", false
+		}
+	}
+	return line[:4], line[6:], true
+}
+
+// describeDevices joins resource labels for display, along with any device
+// names.
+func describeDevices(labels []string) string {
+	descs := make([]string, len(labels))
+	for i, label := range labels {
+		descs[i] = displayLabel(label)
+		if name := deviceName(label); name != "" {
+			descs[i] += " (" + name + ")"
+		}
+	}
+	return strings.Join(descs, ", ")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// nodeNames selects cluster nodes to run a command on over ssh, rather than
+// just the local node; "all" selects every online node.
+var nodeNames listFlag
+
+// nodeParallel bounds how many nodes a command is run on at once.
+var nodeParallel = 4
+
+// nodeJSON prints the per-node results as JSON, for automation.
+var nodeJSON = false
+
+// nodeLive shows each node's output as it happens, prefixed by the node name,
+// rather than under a heading once it's done.
+var nodeLive = false
+
+// nodeLogDir, if set, is a directory to write each node's output to, as
+// <node>.log.
+var nodeLogDir string
+
+func init() {
+	flag.Var(&nodeNames, "node", "comma separated cluster nodes to run on over ssh as root, or all")
+	flag.IntVar(&nodeParallel, "node-parallel", nodeParallel, "number of nodes to run on at once")
+	flag.BoolVar(&nodeJSON, "node-json", false, "print per-node results as JSON")
+	flag.BoolVar(&nodeLive, "node-live", false, "show node output as it happens, prefixed by node name")
+	flag.StringVar(&nodeLogDir, "node-log-dir", "", "directory to write each node's output to, as <node>.log")
+}
+
+// nodeResult is the outcome of running a command on one node, along with
+// the result reported by the node itself.
+type nodeResult struct {
+	Node string `json:"node"`
+	OK   bool   `json:"ok"`
+	runResult
+}
+
+// resolveNodes expands any "all" in nodeNames to every online cluster node.
+func resolveNodes() ([]string, error) {
+	if !hasString("all", nodeNames) {
+		return nodeNames, nil
+	}
+	var nodes []struct {
+		Node   string `json:"node"`
+		Status string `json:"status"`
+	}
+	if err := decodeJSONCommand(&nodes, exec.Command("pvesh", "get", "/nodes", "--output-format", "json")); err != nil {
+		return nil, withExitCode(exitEnvironment, err)
+	}
+	var names []string
+	for _, node := range nodes {
+		if node.Status == "online" {
+			names = append(names, node.Node)
+		} else {
+			warnf("skipping node %v, which is %v", node.Node, node.Status)
+		}
+	}
+	return names, nil
+}
+
+// runNodes runs a command on the selected nodes, up to nodeParallel at once,
+// as -ssh would. Each node's output is captured, and shown under a heading
+// for the node once it's done, or as it happens with -node-live, followed by a
+// summary of the result on every node.
+func runNodes(args []string) error {
+	nodes, err := resolveNodes()
+	if err != nil {
+		return err
+	}
+	if nodeLogDir != "" {
+		if err := os.MkdirAll(nodeLogDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	w := os.Stdout
+	if nodeJSON {
+		w = os.Stderr // keep stdout for the results
+	}
+
+	results := make([]nodeResult, len(nodes))
+	var outMu sync.Mutex
+	_ = forEachLimit(len(nodes), nodeParallel, func(i int) error {
+		var out bytes.Buffer
+		writers := []io.Writer{&out}
+		if nodeLogDir != "" {
+			logPath := filepath.Join(nodeLogDir, nodes[i]+".log")
+			f, err := os.Create(logPath)
+			if err != nil {
+				warnf("unable to log node %v output: %v", nodes[i], err)
+			} else {
+				defer f.Close()
+				writers = append(writers, f)
+			}
+		}
+		var live *prefixWriter
+		if nodeLive {
+			live = &prefixWriter{mu: &outMu, w: w, prefix: nodes[i] + ": "}
+			writers = append(writers, live)
+		}
+		nodeOut := io.MultiWriter(writers...)
+
+		res, err := runRemoteTo("root@"+nodes[i], args, nodeOut, nodeOut)
+		results[i] = newNodeResult(nodes[i], res, err)
+
+		if live != nil {
+			live.flush()
+			return nil
+		}
+		outMu.Lock()
+		defer outMu.Unlock()
+		fmt.Fprintf(w, "== node %v ==\n", nodes[i])
+		w.Write(out.Bytes())
+		fmt.Fprintln(w)
+		return nil
+	})
+
+	failed := 0
+	for _, res := range results {
+		if !res.OK {
+			failed++
+		}
+	}
+	if nodeJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		var tab table
+		tab.header("NODE", "RESULT", "HOOKED", "SKIPPED", "FAILED", "DETAIL")
+		count := func(n *int) cell {
+			if n == nil {
+				return plain("")
+			}
+			return plain(strconv.Itoa(*n))
+		}
+		for _, res := range results {
+			result := colored(colorGreen, "ok")
+			if !res.OK {
+				result = colored(colorRed, "failed")
+			}
+			tab.add(plain(res.Node), result, count(res.Hooked), count(res.Skipped), count(res.Failed), plain(res.Error))
+		}
+		if err := printTable(&tab); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %v of %v node(s)", failed, len(nodes))
+	}
+	return nil
+}
+
+func newNodeResult(node string, remote *runResult, err error) nodeResult {
+	res := nodeResult{Node: node, OK: err == nil}
+	if remote != nil {
+		res.runResult = *remote
+	} else if err != nil {
+		// the remote didn't get far enough to report its own result
+		res.Error = err.Error()
+		res.ExitCode = exitFailure
+		var xerr *exec.ExitError
+		if errors.As(err, &xerr) {
+			res.ExitCode = xerr.ExitCode()
+		}
+	}
+	return res
+}
+
+// prefixWriter writes each complete line to w, under mu, prefixed so that
+// the interleaved output of several nodes remains attributable.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	if i := bytes.LastIndexByte(pw.buf, '\n'); i >= 0 {
+		pw.writeLines(pw.buf[:i+1])
+		pw.buf = append(pw.buf[:0], pw.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// flush writes any final partial line.
+func (pw *prefixWriter) flush() {
+	if len(pw.buf) > 0 {
+		pw.writeLines(append(pw.buf, '\n'))
+		pw.buf = nil
+	}
+}
+
+func (pw *prefixWriter) writeLines(lines []byte) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		fmt.Fprintf(pw.w, "%v%s\n", pw.prefix, lines[:i])
+		lines = lines[i+1:]
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A summary of what init or reconcile did may be sent, once each run, by
+// email or to a webhook, for when they're run from automation; reconcile
+// only sends one when it changed something, or failed to.
+var (
+	notifyEmail   listFlag
+	notifyWebhook = ""
+)
+
+// notifyTimeout bounds sending each summary notification.
+const notifyTimeout = 10 * time.Second
+
+func init() {
+	flag.Var(&notifyEmail, "notify-email", "comma separated addresses to email a summary of each init or reconcile")
+	flag.StringVar(&notifyWebhook, "notify-webhook", "", "URL to post a JSON summary of each init or reconcile to")
+}
+
+// runSummary is what init or reconcile did about each VM.
+type runSummary struct {
+	Command   string   `json:"command"`
+	Node      string   `json:"node"`
+	Time      string   `json:"time"`
+	Hooked    []string `json:"hooked"`
+	Compliant []string `json:"compliant"`
+	Skipped   []string `json:"skipped"`
+	Unhooked  []string `json:"unhooked,omitempty"`
+	Failed    []string `json:"failed"`
+}
+
+func newRunSummary(command string) *runSummary {
+	node, _ := os.Hostname()
+	return &runSummary{
+		Command:   command,
+		Node:      node,
+		Time:      time.Now().Format(time.RFC3339),
+		Hooked:    []string{},
+		Compliant: []string{},
+		Skipped:   []string{},
+		Failed:    []string{},
+	}
+}
+
+// text formats the summary for email.
+func (rs *runSummary) text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "qmexmut %v on %v at %v:\n\n", rs.Command, rs.Node, rs.Time)
+	for _, part := range []struct {
+		name string
+		ids  []string
+	}{
+		{"newly hooked", rs.Hooked},
+		{"already compliant", rs.Compliant},
+		{"skipped", rs.Skipped},
+		{"unhooked", rs.Unhooked},
+		{"failed", rs.Failed},
+	} {
+		if len(part.ids) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "%v: vm #%v\n", part.name, strings.Join(part.ids, ", #"))
+	}
+	return sb.String()
+}
+
+// sendRunSummary sends the summary by any notify-email and notify-webhook;
+// failure to do so is only logged.
+func sendRunSummary(rs *runSummary) {
+	if len(notifyEmail) == 0 && notifyWebhook == "" {
+		return
+	}
+	for _, ids := range [][]string{rs.Hooked, rs.Compliant, rs.Skipped, rs.Unhooked, rs.Failed} {
+		sortVMIDs(ids)
+	}
+	if dryRun {
+		infof("would send %v summary notification", rs.Command)
+		return
+	}
+	if len(notifyEmail) > 0 {
+		if err := emailRunSummary(rs); err != nil {
+			warnf("unable to email %v summary: %v", rs.Command, err)
+		}
+	}
+	if notifyWebhook != "" {
+		if err := postRunSummary(rs); err != nil {
+			warnf("unable to post %v summary: %v", rs.Command, err)
+		}
+	}
+}
+
+func emailRunSummary(rs *runSummary) error {
+	subject := fmt.Sprintf("qmexmut %v on %v: %v hooked, %v failed", rs.Command, rs.Node, len(rs.Hooked), len(rs.Failed))
+	return sendmail(notifyEmail, subject, rs.text())
+}
+
+func postRunSummary(rs *runSummary) error {
+	return postJSON(notifyWebhook, rs)
+}
+
+// sendmail emails a message thru the local MTA, as proxmox itself does.
+func sendmail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "To: %v\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %v\n\n", subject)
+	msg.WriteString(body)
+
+	cmd := exec.Command("sendmail", "-t")
+	cmd.Stdin = &msg
+	stderr := captureStderr(cmd)
+	done, err := startCommand(cmd)
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(notifyTimeout, func() { _ = cmd.Process.Kill() })
+	err = cmd.Wait()
+	timer.Stop()
+	done(err)
+	if err != nil {
+		return commandError(cmd, stderr, err)
+	}
+	return nil
+}
+
+// postJSON posts a value as JSON to a URL, failing unless it responds OK.
+func postJSON(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responded %v", url, resp.Status)
+	}
+	return nil
+}
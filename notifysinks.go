@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events may be sent as notifications to any number of sinks, each configured
+// by a section like:
+//
+//	[notify ops]
+//	type = gotify
+//	url = https://gotify.example.com
+//	token = AbCdEf
+//	events = violation,deny
+//	tagged = prod
+//	subject = [{{.Node}}] {{.Name}} {{.Description}}
+var notifySettings = map[string]string{
+	"type":    "how to deliver: email, webhook, gotify, or mqtt",
+	"to":      "comma separated email addresses, for type email",
+	"url":     "URL to post to, or of the mqtt broker",
+	"token":   "application token, for type gotify",
+	"topic":   "topic to publish to, for type mqtt",
+	"events":  "comma separated event kinds to send, or all; decisions by default",
+	"tagged":  "only send events about VMs with this proxmox tag",
+	"subject": "go template for the subject, given a notificationData",
+	"body":    "go template for the body, given a notificationData",
+}
+
+// notifySink delivers a notification to a configured notifier.
+type notifySink struct {
+	// needs lists settings that the sink requires.
+	needs []string
+	send  func(n notifier, msg notification) error
+}
+
+// notifySinks are the types of notifier, by name.
+var notifySinks = map[string]notifySink{}
+
+// registerNotifySink adds a type of notifier.
+func registerNotifySink(kind string, sink notifySink) {
+	notifySinks[kind] = sink
+}
+
+func init() {
+	configSections["notify"] = notifySettings
+	subscribeEvents("notifications", false, notifyEvent)
+
+	registerNotifySink("email", notifySink{[]string{"to"}, emailNotification})
+	registerNotifySink("webhook", notifySink{[]string{"url"}, postNotification})
+	registerNotifySink("gotify", notifySink{[]string{"url", "token"}, gotifyNotification})
+	registerNotifySink("mqtt", notifySink{[]string{"url"}, mqttNotification})
+}
+
+// notifier is a [notify <name>] config section.
+type notifier struct {
+	name     string
+	line     int
+	kind     string
+	settings map[string]string
+	events   []eventKind // nil for all
+	tagged   string
+
+	// subject and body customize notifications, if set.
+	subject, body *template.Template
+}
+
+// wants returns true if the notifier should be sent an event.
+func (n notifier) wants(ev event) bool {
+	if n.events != nil && !hasKind(ev.Kind, n.events) {
+		return false
+	}
+	if n.tagged == "" {
+		return true
+	}
+	if ev.VMID == "" {
+		return false
+	}
+	conf, err := scannedConfig(ev.VMID)
+	if err != nil {
+		return false
+	}
+	for _, tag := range conf.tags() {
+		if strings.EqualFold(tag, n.tagged) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	loadNotifiersOnce sync.Once
+	loadedNotifiers   []notifier
+	loadNotifiersErr  error
+)
+
+// configNotifiers returns the notifiers configured by the config file,
+// failing on the first invalid one.
+func configNotifiers() ([]notifier, error) {
+	loadNotifiersOnce.Do(func() {
+		var errs []error
+		loadedNotifiers, errs = parseNotifiers(config)
+		if len(errs) > 0 {
+			loadNotifiersErr = errs[0]
+		}
+	})
+	return loadedNotifiers, loadNotifiersErr
+}
+
+// parseNotifiers parses all [notify <name>] sections of the config,
+// returning all valid notifiers, and an error for each invalid one.
+func parseNotifiers(cf configFile) (notifiers []notifier, errs []error) {
+	for _, section := range cf.sectionNames("notify") {
+		ents := cf.sections[section]
+		if len(ents) == 0 {
+			continue
+		}
+		n := notifier{
+			name:     strings.TrimSpace(strings.TrimPrefix(section, "notify")),
+			line:     ents[0].line,
+			settings: make(map[string]string),
+			events:   decisionKinds,
+		}
+		for _, ent := range ents {
+			n.settings[ent.key] = ent.value
+		}
+		n.kind = n.settings["type"]
+		sink, ok := notifySinks[n.kind]
+		if !ok {
+			errs = append(errs, cf.errorf(n.line, "[%v] has invalid type %q", section, n.kind))
+			continue
+		}
+		var missing []string
+		for _, key := range sink.needs {
+			if n.settings[key] == "" {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, cf.errorf(n.line, "[%v] of type %v needs %v", section, n.kind, strings.Join(missing, ", ")))
+			continue
+		}
+		if val, ok := n.settings["events"]; ok {
+			n.events = nil
+			if val != "all" {
+				for _, kind := range strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ' ' }) {
+					if !hasKind(eventKind(kind), eventKinds) {
+						errs = append(errs, cf.errorf(n.line, "[%v] has invalid event kind %q", section, kind))
+						continue
+					}
+					n.events = append(n.events, eventKind(kind))
+				}
+			}
+		}
+		n.tagged = n.settings["tagged"]
+		var err error
+		if n.subject, err = parseNotifyTemplate(n.settings["subject"]); err != nil {
+			errs = append(errs, cf.errorf(n.line, "[%v] has invalid subject: %w", section, err))
+			continue
+		}
+		if n.body, err = parseNotifyTemplate(n.settings["body"]); err != nil {
+			errs = append(errs, cf.errorf(n.line, "[%v] has invalid body: %w", section, err))
+			continue
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, errs
+}
+
+// parseNotifyTemplate parses a notification subject or body template, if any;
+// config values are single lines, so \n in them stands for a newline.
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	text = strings.ReplaceAll(text, `\n`, "\n")
+	return template.New("").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+// notificationData is given to notification templates: the event's fields,
+// along with names and descriptions looked up for it.
+type notificationData struct {
+	event
+	Node        string
+	Name        string        // of the VM
+	ByName      string        // of the VM whose start caused the event
+	Description string        // a brief description of the event
+	Devices     string        // described resources shared by the VM and by VM
+	Duration    time.Duration // how long the event took
+}
+
+func newNotificationData(node string, ev event) notificationData {
+	data := notificationData{
+		event:       ev,
+		Node:        node,
+		Description: describeEvent(ev),
+		Duration:    time.Duration(ev.Took * float64(time.Second)).Round(100 * time.Millisecond),
+	}
+	var resources, byResources []string
+	if ev.VMID != "" {
+		if conf, err := scannedConfig(ev.VMID); err == nil {
+			data.Name = conf["name"]
+			resources = conf.hostResources()
+		}
+	}
+	if ev.By != "" {
+		if conf, err := scannedConfig(ev.By); err == nil {
+			data.ByName = conf["name"]
+			byResources = conf.hostResources()
+		}
+	}
+	data.Devices = describeDevices(sharedResources(resources, byResources))
+	return data
+}
+
+// notification is what's sent to notifiers about an event.
+type notification struct {
+	Node    string `json:"node"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	Event   event  `json:"event"`
+}
+
+// newNotification formats a notification about an event for a notifier,
+// using any templates that it's configured with.
+func newNotification(n notifier, ev event) (notification, error) {
+	node, _ := os.Hostname()
+	msg := notification{Node: node, Event: ev}
+	if ev.VMID != "" {
+		msg.Subject = fmt.Sprintf("qmexmut on %v: vm #%v %v", node, ev.VMID, describeEvent(ev))
+	} else {
+		msg.Subject = fmt.Sprintf("qmexmut on %v: %v", node, describeEvent(ev))
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%v\n\n", msg.Subject)
+	for _, field := range []struct{ name, value string }{
+		{"time", ev.Time.Format(time.RFC3339)},
+		{"event", string(ev.Kind)},
+		{"vm", ev.VMID},
+		{"by vm", ev.By},
+		{"method", ev.Method},
+		{"reason", ev.Reason},
+		{"error", ev.Error},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&body, "%v: %v\n", field.name, field.value)
+		}
+	}
+	msg.Body = body.String()
+
+	if n.subject == nil && n.body == nil {
+		return msg, nil
+	}
+	data := newNotificationData(node, ev)
+	for _, tmpl := range []struct {
+		t   *template.Template
+		out *string
+	}{
+		{n.subject, &msg.Subject},
+		{n.body, &msg.Body},
+	} {
+		if tmpl.t == nil {
+			continue
+		}
+		var sb strings.Builder
+		if err := tmpl.t.Execute(&sb, data); err != nil {
+			return msg, err
+		}
+		*tmpl.out = sb.String()
+	}
+	return msg, nil
+}
+
+// describeEvent describes any event briefly, as describeDecision does those
+// that record decisions.
+func describeEvent(ev event) string {
+	if hasKind(ev.Kind, decisionKinds) {
+		return describeDecision(ev, nil)
+	}
+	switch {
+	case ev.Kind == kindPreempt:
+		return fmt.Sprintf("%v to start", ev.Reason)
+	case ev.Kind == kindStopping:
+		return fmt.Sprintf("stopping for vm #%v", ev.By)
+	case ev.Error != "":
+		return fmt.Sprintf("%v: %v", ev.Kind, ev.Error)
+	case ev.Reason != "":
+		return fmt.Sprintf("%v: %v", ev.Kind, ev.Reason)
+	}
+	return string(ev.Kind)
+}
+
+// notifyDeadline bounds how long a run waits, once done, for notifications
+// still being sent, so that an unreachable notifier can't hold up a VM start
+// by more than this, however many events it's sent.
+const notifyDeadline = 5 * time.Second
+
+// pendingNotifications tracks notifications being sent by notifyEvent.
+var pendingNotifications struct {
+	sync.WaitGroup
+	sync.Mutex
+	count int
+}
+
+// notifyEvent sends an event to every notifier that wants it, each in the
+// background; any failure is only logged. See flushNotifications.
+func notifyEvent(ev event) error {
+	notifiers, err := configNotifiers()
+	if err != nil {
+		return err
+	}
+	for _, n := range notifiers {
+		n := n
+		pendingNotifications.Add(1)
+		pendingNotifications.Lock()
+		pendingNotifications.count++
+		pendingNotifications.Unlock()
+		go func() {
+			defer func() {
+				pendingNotifications.Lock()
+				pendingNotifications.count--
+				pendingNotifications.Unlock()
+				pendingNotifications.Done()
+			}()
+			if !n.wants(ev) {
+				return
+			}
+			msg, err := newNotification(n, ev)
+			if err == nil {
+				err = notifySinks[n.kind].send(n, msg)
+			}
+			if err != nil {
+				warnf("unable to send %v event to [notify %v]: %v", ev.Kind, n.name, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// flushNotifications waits for any notifications still being sent, for up to
+// notifyDeadline in all, abandoning any that haven't been sent by then.
+func flushNotifications() {
+	done := make(chan struct{})
+	go func() {
+		pendingNotifications.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notifyDeadline):
+		pendingNotifications.Lock()
+		count := pendingNotifications.count
+		pendingNotifications.Unlock()
+		warnf("abandoned %v notification(s) not sent within %v", count, notifyDeadline)
+	}
+}
+
+func emailNotification(n notifier, msg notification) error {
+	to := strings.FieldsFunc(n.settings["to"], func(r rune) bool { return r == ',' || r == ' ' })
+	return sendmail(to, msg.Subject, msg.Body)
+}
+
+func postNotification(n notifier, msg notification) error {
+	return postJSON(n.settings["url"], msg)
+}
+
+// gotifyNotification posts a message to a gotify server, with high priority
+// for failures and denials, so that they alert.
+func gotifyNotification(n notifier, msg notification) error {
+	priority := 4
+	if decisionColor(msg.Event) == colorRed {
+		priority = 8
+	}
+	data, err := json.Marshal(struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}{msg.Subject, msg.Body, priority})
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(n.settings["url"], "/") + "/message"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.settings["token"])
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responded %v", url, resp.Status)
+	}
+	return nil
+}
+
+// mqttNotification publishes the notification as JSON to an mqtt broker,
+// using mosquitto_pub, under the topic qmexmut/<kind> unless configured.
+func mqttNotification(n notifier, msg notification) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	topic := n.settings["topic"]
+	if topic == "" {
+		topic = "qmexmut/" + string(msg.Event.Kind)
+	}
+	url := strings.TrimSuffix(n.settings["url"], "/") + "/" + topic
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "mosquitto_pub", "-L", url, "-m", string(data))
+	stderr := captureStderr(cmd)
+	done, err := startCommand(cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	done(err)
+	if err != nil {
+		return commandError(cmd, stderr, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyEvent(t *testing.T) {
+	h := newFakeHost(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var msg notification
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, msg)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	h.setConfig("[notify ops]\ntype = webhook\nurl = " + srv.URL + "\nevents = all\ntagged = prod\n")
+	h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00")
+	h.addVM("102", "running", "name: work", "tags: prod", "hostpci0: 0000:01:00")
+	if _, err := scanVMs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(h.path("log")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sending doesn't wait on the notifier
+	t0 := time.Now()
+	for _, ev := range []event{
+		{Kind: kindShutdown, VMID: "102", By: "101", Method: "acpi"},
+		{Kind: kindShutdown, VMID: "101", By: "102", Method: "acpi"}, // not tagged
+	} {
+		if err := notifyEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(t0); took > time.Second {
+		t.Errorf("notifyEvent took %v", took)
+	}
+
+	close(release)
+	flushNotifications()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].Event.VMID != "102" {
+		t.Fatalf("got notifications %+v, want one about vm #102", got)
+	}
+	if want := "vm #102 stopped by acpi for vm #101"; !strings.Contains(got[0].Subject, want) {
+		t.Errorf("got subject %q, want it to contain %q", got[0].Subject, want)
+	}
+	if cmds := h.commands(); len(cmds) > 0 {
+		t.Errorf("ran commands to notify, rather than using the scanned configs:\n%v", strings.Join(cmds, "\n"))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// offlineDir, if set, is a directory of VM config files, like a copy of
+// /etc/pve/qemu-server, to read instead of running qm on a live host; all
+// VMs are then taken to be stopped, and nothing is changed.
+var offlineDir string
+
+func init() {
+	flag.StringVar(&offlineDir, "offline", "", "read VM configs from this directory of <vmid>.conf files, rather than a live host; implies -dry-run")
+}
+
+// setupOffline applies any -offline directory; one containing a qemu-server
+// directory, like a copy of /etc/pve, is also accepted.
+func setupOffline() error {
+	if offlineDir == "" {
+		return nil
+	}
+	if info, err := os.Stat(filepath.Join(offlineDir, "qemu-server")); err == nil && info.IsDir() {
+		offlineDir = filepath.Join(offlineDir, "qemu-server")
+	}
+	if _, err := os.Stat(offlineDir); err != nil {
+		return err
+	}
+	qemuServerDir = offlineDir
+	dryRun = true
+	return nil
+}
+
+// offlineVMs lists the VMs with config files in offlineDir, by VMID.
+func offlineVMs() ([]listRec, error) {
+	matches, err := filepath.Glob(filepath.Join(offlineDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	var recs []listRec
+	for _, match := range matches {
+		id := strings.TrimSuffix(filepath.Base(match), ".conf")
+		conf, err := offlineConfig(id)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, listRec{id: id, name: conf["name"], status: "stopped"})
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		return vmidLess(recs[i].id, recs[j].id)
+	})
+	return recs, nil
+}
+
+// offlineConfig reads the current config of a VM from its file in
+// offlineDir, ignoring any pending changes or snapshots, and comments, which
+// hold its description.
+func offlineConfig(id string) (vmConfig, error) {
+	f, err := os.Open(filepath.Join(offlineDir, id+".conf"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := make(vmConfig)
+	sc := newLineScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			break
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if i := strings.Index(line, ":"); i > 0 && !unusedConfigKeys[line[:i]] {
+			conf[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vm #%v config: %w", id, lineScanError(err))
+	}
+	return conf, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+var colorMode = "auto"
+
+func init() {
+	flag.Var(choiceFlag{&colorMode, []string{"auto", "always", "never"}},
+		"color", "colorize output: auto, always, or never")
+}
+
+// ANSI SGR color codes used to highlight output cells.
+const (
+	colorNone   = ""
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// wantColor returns true if output written to f should be colorized: either
+// because it was asked for, or because f is an interactive terminal.
+func wantColor(f *os.File) bool {
+	switch colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+type cell struct {
+	text  string
+	color string
+}
+
+func plain(text string) cell          { return cell{text, colorNone} }
+func colored(color, text string) cell { return cell{text, color} }
+
+// table collects rows of cells to be written in aligned columns. Unlike
+// text/tabwriter, column widths only count cell text, so that colored cells
+// still line up.
+type table struct {
+	rows [][]cell
+}
+
+func (tab *table) add(cells ...cell) {
+	tab.rows = append(tab.rows, cells)
+}
+
+func (tab *table) header(names ...string) {
+	cells := make([]cell, len(names))
+	for i, name := range names {
+		cells[i] = plain(name)
+	}
+	tab.add(cells...)
+}
+
+func (tab *table) writeTo(w io.Writer, color bool) error {
+	var widths []int
+	for _, row := range tab.rows {
+		for i, c := range row {
+			n := utf8.RuneCountInString(c.text)
+			if i >= len(widths) {
+				widths = append(widths, n)
+			} else if n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var line strings.Builder
+	for _, row := range tab.rows {
+		line.Reset()
+		for i, c := range row {
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			if color && c.color != colorNone {
+				fmt.Fprintf(&line, "\x1b[%sm%s\x1b[0m", c.color, c.text)
+			} else {
+				line.WriteString(c.text)
+			}
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c.text)))
+			}
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line.String(), " ")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printTable writes tab to stdout, colorized if appropriate.
+func printTable(tab *table) error {
+	return tab.writeTo(os.Stdout, wantColor(os.Stdout))
+}
+
+// initProgress counts init outcomes so that progress may be reported while
+// scanning many VMs.
+type initProgress struct {
+	total   int
+	scanned int32
+	hooked  int32
+	skipped int32
+	failed  int32
+}
+
+func (ip *initProgress) String() string {
+	return fmt.Sprintf("scanned %v/%v, hooked %v, skipped %v, failed %v",
+		atomic.LoadInt32(&ip.scanned), ip.total,
+		atomic.LoadInt32(&ip.hooked),
+		atomic.LoadInt32(&ip.skipped),
+		atomic.LoadInt32(&ip.failed))
+}
+
+// bar renders a fixed width progress bar of scanned VMs.
+func (ip *initProgress) bar(width int) string {
+	n := width
+	if ip.total > 0 {
+		n = width * int(atomic.LoadInt32(&ip.scanned)) / ip.total
+	}
+	return "[" + strings.Repeat("#", n) + strings.Repeat(" ", width-n) + "]"
+}
+
+// report starts reporting progress in the background: a progress bar when
+// stderr is a terminal, or a periodic log line otherwise. Progress is not
+// reported in quiet mode. The returned function stops reporting.
+func (ip *initProgress) report() (stop func()) {
+	if minLogLevel > levelInfo {
+		return func() {}
+	}
+
+	tty := isTerminal(os.Stderr)
+	interval := 5 * time.Second
+	if tty {
+		interval = 100 * time.Millisecond
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if tty {
+					fmt.Fprint(os.Stderr, "\r\x1b[K")
+				}
+				return
+			case <-ticker.C:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r\x1b[K%s %v", ip.bar(20), ip)
+				} else {
+					infof("init progress: %v", ip)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pausePath is where the pause command records that enforcement is paused;
+// it's next to the config file, in the proxmox cluster filesystem by
+// default, so that the pause applies to every node.
+func pausePath() string {
+	return filepath.Join(filepath.Dir(configPath), "qmexmut.paused")
+}
+
+// clusterPause returns any unexpired pause recorded by the pause command.
+func clusterPause() (*pauseRecord, error) {
+	data, err := os.ReadFile(pausePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rec pauseRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", pausePath(), err)
+	}
+	if rec.Until != nil && time.Now().After(*rec.Until) {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// runPause pauses enforcement on every node, making the hook stop no mutuals
+// and watch not reconcile, until resumed or for the given duration; unlike
+// ctl pause, it doesn't need watch to be running.
+func runPause(args []string) error {
+	var rec pauseRecord
+	if len(args) >= 2 && (args[0] == "-for" || args[0] == "--for") {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return withExitCode(exitUsage, fmt.Errorf("invalid pause duration %q", args[1]))
+		}
+		until := time.Now().Add(d)
+		rec.Until = &until
+		args = args[2:]
+	}
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		return withExitCode(exitUsage, fmt.Errorf("usage: pause [-for <duration>] [<reason>]"))
+	}
+	rec.Time = time.Now()
+	rec.Reason = strings.Join(args, " ")
+	rec.Node, _ = os.Hostname()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		infof("would write %v", pausePath())
+	} else {
+		tmp := pausePath() + ".tmp"
+		if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, pausePath()); err != nil {
+			return err
+		}
+	}
+	recordEvent(event{Kind: kindPause, Reason: rec.Reason})
+
+	until := "until resumed"
+	if rec.Until != nil {
+		until = "until " + rec.Until.Format(time.RFC3339)
+	}
+	if rec.Reason != "" {
+		warnf("enforcement paused on every node %v: %v", until, rec.Reason)
+	} else {
+		warnf("enforcement paused on every node %v", until)
+	}
+	return nil
+}
+
+// runResume resumes enforcement paused by the pause command.
+func runResume(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: resume"))
+	}
+	if dryRun {
+		infof("would remove %v", pausePath())
+	} else if err := os.Remove(pausePath()); errors.Is(err, fs.ErrNotExist) {
+		infof("enforcement isn't paused by the pause command")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recordEvent(event{Kind: kindResume})
+	infof("enforcement resumed on every node")
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pciSysfs is where the host's PCI devices are found.
+var pciSysfs = "/sys/bus/pci/devices"
+
+// pciGranularity is what a passed thru PCI address conflicts as: its own
+// function, its whole physical device, or its whole IOMMU group.
+var pciGranularity = "device"
+
+var pciGranularities = []string{"function", "device", "iommu-group"}
+
+func init() {
+	flag.Var(choiceFlag{&pciGranularity, pciGranularities}, "pci-granularity",
+		"what passed thru PCI addresses conflict as: function, device, or iommu-group")
+}
+
+var pciAddrPat = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}:[0-9a-fA-F]{2})(?:\.([0-7]))?$`)
+
+// pciDevice canonicalizes a passed thru PCI address, as proxmox allows them
+// to be given, into a domain qualified physical device: both 01:00.1 and
+// 0000:01:00 become 0000:01:00, since functions like a GPU's audio are part
+// of the same device. SR-IOV virtual functions, found in sysfs, are devices
+// of their own, so keep their function. Anything else, like a mapped device
+// name, is returned as-is.
+func pciDevice(addr string) string {
+	match := pciAddrPat.FindStringSubmatch(addr)
+	if match == nil {
+		return addr
+	}
+	domain, slot, fn := match[1], match[2], match[3]
+	if domain == "" {
+		domain = "0000"
+	}
+	dev := strings.ToLower(domain + ":" + slot)
+	if fn != "" {
+		if _, err := os.Lstat(filepath.Join(pciSysfs, dev+"."+fn, "physfn")); err == nil {
+			return dev + "." + fn
+		}
+	}
+	return dev
+}
+
+// pciResource canonicalizes a passed thru PCI address, like pciDevice, into
+// what it conflicts as under pciGranularity: a function, like 0000:01:00.1;
+// a physical device; or an IOMMU group, like iommu-group=12, found in sysfs,
+// falling back to the device if it has none. An address given without a
+// function passes thru all of the device's functions, so is labeled as its
+// device under function granularity, and by its function 0's IOMMU group;
+// see pciResources for all of them.
+func pciResource(addr string) string {
+	match := pciAddrPat.FindStringSubmatch(addr)
+	if match == nil {
+		return addr
+	}
+	domain, slot, fn := match[1], match[2], match[3]
+	if domain == "" {
+		domain = "0000"
+	}
+	if fn == "" {
+		if pciGranularity == "function" {
+			return pciDevice(addr)
+		}
+		fn = "0"
+	}
+	function := strings.ToLower(domain + ":" + slot + "." + fn)
+
+	switch pciGranularity {
+	case "function":
+		return function
+	case "iommu-group":
+		if link, err := os.Readlink(filepath.Join(pciSysfs, function, "iommu_group")); err == nil {
+			return "iommu-group=" + filepath.Base(link)
+		}
+	}
+	return pciDevice(addr)
+}
+
+// pciResources returns what a passed thru PCI address conflicts as, like
+// pciResource, except that an address given without a function conflicts as
+// each of the device's functions found in sysfs, so that it conflicts with
+// any other VM passing thru one of them.
+func pciResources(addr string) []string {
+	match := pciAddrPat.FindStringSubmatch(addr)
+	if match == nil || match[3] != "" || pciGranularity == "device" {
+		return []string{pciResource(addr)}
+	}
+	functions, _ := filepath.Glob(filepath.Join(pciSysfs, pciDevice(addr)+".[0-7]"))
+	var labels []string
+	for _, function := range functions {
+		if label := pciResource(filepath.Base(function)); !hasString(label, labels) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		return []string{pciResource(addr)}
+	}
+	return labels
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPCIResource(t *testing.T) {
+	h := newFakeHost(t)
+	h.addPCI("0000:01:00.0", "12")
+	h.addPCI("0000:01:00.1", "12")
+	h.addPCI("0000:02:00.0", "")
+	h.addPCI("0000:03:00.0", "14")
+	h.addPCI("0000:03:10.2", "15")
+	if err := os.Symlink("../0000:03:00.0", filepath.Join(h.path("pci", "0000:03:10.2"), "physfn")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(prior string) { pciGranularity = prior }(pciGranularity)
+
+	for _, tc := range []struct {
+		addr                          string
+		function, device, iommuGroups string
+	}{
+		{"01:00.1", "0000:01:00.1", "0000:01:00", "iommu-group=12"},
+		{"0000:01:00", "0000:01:00", "0000:01:00", "iommu-group=12"},
+		{"0000:01:00.0", "0000:01:00.0", "0000:01:00", "iommu-group=12"},
+		{"0000:02:00.0", "0000:02:00.0", "0000:02:00", "0000:02:00"},  // no group
+		{"03:10.2", "0000:03:10.2", "0000:03:10.2", "iommu-group=15"}, // virtual function
+		{"0000:0A:00.0", "0000:0a:00.0", "0000:0a:00", "0000:0a:00"},  // not in sysfs
+		{"mapped-gpu", "mapped-gpu", "mapped-gpu", "mapped-gpu"},      // mapped device
+	} {
+		for _, gran := range []struct{ name, want string }{
+			{"function", tc.function},
+			{"device", tc.device},
+			{"iommu-group", tc.iommuGroups},
+		} {
+			pciGranularity = gran.name
+			if got := pciResource(tc.addr); got != gran.want {
+				t.Errorf("%v pciResource(%q) = %q, want %q", gran.name, tc.addr, got, gran.want)
+			}
+		}
+	}
+}
+
+func TestPCIResources(t *testing.T) {
+	h := newFakeHost(t)
+	h.addPCI("0000:01:00.0", "12")
+	h.addPCI("0000:01:00.1", "12")
+	h.addPCI("0000:02:00.0", "13")
+	h.addPCI("0000:02:00.1", "14")
+	defer func(prior string) { pciGranularity = prior }(pciGranularity)
+
+	for _, tc := range []struct {
+		granularity, addr string
+		want              string
+	}{
+		{"function", "01:00", "0000:01:00.0 0000:01:00.1"},
+		{"function", "01:00.1", "0000:01:00.1"},
+		{"function", "03:00", "0000:03:00"}, // not in sysfs
+		{"device", "01:00", "0000:01:00"},
+		{"iommu-group", "01:00", "iommu-group=12"},
+		{"iommu-group", "02:00", "iommu-group=13 iommu-group=14"},
+		{"iommu-group", "03:00", "0000:03:00"},
+		{"function", "mapping=gpu", "mapping=gpu"},
+	} {
+		pciGranularity = tc.granularity
+		if got := pciResources(tc.addr); strings.Join(got, " ") != tc.want {
+			t.Errorf("%v pciResources(%q) = %q, want %q", tc.granularity, tc.addr, got, tc.want)
+		}
+	}
+}
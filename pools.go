@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os/exec"
+	"strconv"
+)
+
+// poolScope limits mutuals to VMs within the same proxmox resource pool, so
+// that tenants of a shared host are isolated from each other; VMs that aren't
+// in any pool are then only mutuals of each other.
+var poolScope bool
+
+func init() {
+	flag.BoolVar(&poolScope, "pool-scope", false, "only consider VMs within the same resource pool as mutuals")
+	configSections["pool"] = vmSettings
+}
+
+// wantPools returns true if VM pool membership matters, either to scope
+// mutuals, or to apply any [pool <name>] config sections.
+func wantPools() bool {
+	return poolScope || len(config.sectionNames("pool")) > 0
+}
+
+// vmPools returns the resource pool of every VM in the cluster that's in one,
+// keyed by vmid.
+func vmPools() (map[string]string, error) {
+	if offlineDir != "" {
+		return nil, nil // pools are kept elsewhere, in user.cfg
+	}
+	var resources []struct {
+		VMID int    `json:"vmid"`
+		Pool string `json:"pool"`
+	}
+	if err := decodeJSONCommand(
+		&resources,
+		exec.Command("pvesh", "get", "/cluster/resources", "--type", "vm", "--output-format", "json"),
+	); err != nil {
+		return nil, err
+	}
+	pools := make(map[string]string, len(resources))
+	for _, res := range resources {
+		if res.Pool != "" {
+			pools[strconv.Itoa(res.VMID)] = res.Pool
+		}
+	}
+	return pools, nil
+}
+
+// samePool returns true if two VMs may be mutuals under poolScope.
+func samePool(a, b vmInfo) bool {
+	return !poolScope || a.pool == b.pool
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// preemptGrace is how long to wait before stopping mutuals, during which the
+// preemption may be cancelled.
+var preemptGrace = 0
+
+// cooldown is how long after a preemption over some resource that further
+// preemptions over it are denied, so that users starting mutuals against
+// each other don't ping-pong them.
+var cooldown time.Duration
+
+func init() {
+	flag.IntVar(&preemptGrace, "preempt-grace", 0, "seconds to wait before stopping mutuals, allowing cancellation")
+	flag.DurationVar(&cooldown, "cooldown", 0, "deny preemption over a resource within this long of its last preemption")
+}
+
+// explainConflicts prints the mutuals affected by starting self, which
+// resources they share, and what will be done about them under the given
+// policy. It's printed to stdout so that it shows in the proxmox start task
+// log.
+func explainConflicts(self vmInfo, mutualVMs []vmInfo, actions map[string]string, policy string) {
+	var tab table
+	tab.header("  VMID", "NAME", "STATUS", "SHARED", "ACTION")
+	for _, vm := range mutualVMs {
+		action := actions[vm.id]
+		if action == actionNone {
+			continue
+		}
+		tab.add(
+			plain("  #"+vm.id),
+			plain(vm.name),
+			plain(vm.state),
+			plain(describeDevices(sharedResources(self.resources, vm.resources))),
+			plain(action))
+	}
+	if len(tab.rows) == 1 {
+		return
+	}
+	fmt.Printf("qmexmut: starting vm #%v (%v) under policy %v conflicts with:\n", self.id, self.name, policy)
+	_ = tab.writeTo(os.Stdout, false)
+}
+
+// checkCooldown denies stopping any mutuals over resources that were
+// preempted within the cooldown period.
+func checkCooldown(self vmInfo, stopping []vmInfo) error {
+	if cooldown <= 0 || len(stopping) == 0 {
+		return nil
+	}
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, vm := range stopping {
+		for _, label := range sharedResources(self.resources, vm.resources) {
+			rec, has := st.Preemptions[label]
+			if !has {
+				continue
+			}
+			if ago := now.Sub(rec.Time); ago < cooldown {
+				err := fmt.Errorf("%v was preempted by vm #%v %v ago, not preempting vm #%v within cooldown of %v",
+					label, rec.By, ago.Round(time.Second), vm.id, cooldown)
+				return withExitCode(exitDenied, recordDenial(self.id, err))
+			}
+		}
+	}
+	return nil
+}
+
+// recordPreemption notes the time of preempting the stopped mutuals for
+// every resource that they shared with self.
+func recordPreemption(self vmInfo, stopped []vmInfo) {
+	if len(stopped) == 0 {
+		return
+	}
+	recs := make(map[string]*preemptRecord)
+	for _, vm := range stopped {
+		for _, label := range sharedResources(self.resources, vm.resources) {
+			rec := recs[label]
+			if rec == nil {
+				rec = &preemptRecord{Time: time.Now(), By: self.id}
+				recs[label] = rec
+			}
+			rec.Stopped = append(rec.Stopped, vm.id)
+		}
+	}
+	if err := updateState(func(st *state) error {
+		if st.Preemptions == nil {
+			st.Preemptions = make(map[string]preemptRecord)
+		}
+		for label, rec := range recs {
+			st.Preemptions[label] = *rec
+		}
+		return nil
+	}); err != nil {
+		warnf("unable to record preemption: %v", err)
+	}
+}
+
+// stoppedVMs returns those of the given VMs that shutdownVMs stopped, given
+// the error it returned.
+func stoppedVMs(vms []vmInfo, err error) []vmInfo {
+	var sf shutdownFailures
+	if !errors.As(err, &sf) {
+		return vms
+	}
+	var stopped []vmInfo
+	for _, vm := range vms {
+		if !sf.has(vm.id) {
+			stopped = append(stopped, vm)
+		}
+	}
+	return stopped
+}
+
+// reportPartialPreemption reports a preemption that stopped only some of the
+// VMs that it needed to, which leaves shared resources held, so the start
+// fails; the report tells which VMs were stopped, and so are restarted by
+// rollback, which failed to stop and why, and which weren't tried.
+func reportPartialPreemption(vmid string, stopped []vmInfo, err error) {
+	var sf shutdownFailures
+	errors.As(err, &sf)
+	var results []mutualResult
+	for _, vm := range stopped {
+		results = append(results, mutualResult{VMID: vm.id, Action: "stopped"})
+	}
+	for _, f := range sf.failed {
+		results = append(results, mutualResult{VMID: f.id, Action: "failed", Error: f.err.Error()})
+	}
+	for _, id := range sf.skipped {
+		results = append(results, mutualResult{VMID: id, Action: "skipped"})
+	}
+
+	// printed to stdout so that it shows in the proxmox start task log
+	fmt.Printf("qmexmut: preempted only some mutuals of vm #%v, which can't start while the rest hold shared resources:\n", vmid)
+	var tab table
+	tab.header("  VMID", "OUTCOME", "ERROR")
+	for _, res := range results {
+		tab.add(plain("  #"+res.VMID), plain(res.Action), plain(res.Error))
+	}
+	_ = tab.writeTo(os.Stdout, false)
+
+	recordEvent(event{Kind: kindPartial, VMID: vmid, Error: err.Error(), Mutuals: results})
+}
+
+// errCancelled is returned when a pending preemption is cancelled.
+var errCancelled = errors.New("preemption cancelled")
+
+// awaitPreemptGrace announces an impending preemption of the given mutuals,
+// and then waits for preemptGrace seconds, returning errCancelled if the
+// preemption was cancelled meanwhile by runCancel.
+func awaitPreemptGrace(vmid string, stopping []vmInfo) error {
+	if preemptGrace <= 0 || len(stopping) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(stopping))
+	for i, vm := range stopping {
+		ids[i] = "#" + vm.id
+	}
+
+	cancelFile := cancelPath(vmid)
+	if dryRun {
+		infof("would wait %vs before preempting vm %v", preemptGrace, strings.Join(ids, ", "))
+		return nil
+	}
+	if err := os.Remove(cancelFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// printed to stdout so that it shows in the proxmox start task log
+	fmt.Printf("preempting vm %v in %vs to start vm #%v; to cancel, run: qmexmut cancel %v\n",
+		strings.Join(ids, ", "), preemptGrace, vmid, vmid)
+
+	deadline := time.Now().Add(time.Duration(preemptGrace) * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(cancelFile); err == nil {
+			_ = os.Remove(cancelFile)
+			recordEvent(event{Kind: kindCancel, VMID: vmid})
+			return withExitCode(exitDenied, errCancelled)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+func cancelPath(vmid string) string {
+	return filepath.Join(stateDir, "cancel-"+vmid)
+}
+
+// runCancel cancels any pending preemption on behalf of starting the given
+// VM, causing its start to fail.
+func runCancel(args []string) error {
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: cancel <vmid>"))
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(cancelPath(args[0]), nil, 0644); err != nil {
+		return err
+	}
+	infof("cancelled any pending preemption for starting vm #%v", args[0])
+	return nil
+}
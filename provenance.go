@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stoppedByTag prefixes a tag put on preempted VMs, naming the VM whose start
+// preempted it, so that anyone looking at it in the proxmox UI can see why it
+// was stopped.
+const stoppedByTag = "qmexmut.stopped-by."
+
+// yieldBack enables restarting VMs preempted by a VM once it stops.
+var yieldBack = false
+
+func init() {
+	flag.BoolVar(&yieldBack, "yield-back", false, "restart any mutuals preempted by a VM once it stops")
+}
+
+// stoppedBy returns the VMID named by any stopped-by tag.
+func (conf vmConfig) stoppedBy() string {
+	for _, tag := range conf.tags() {
+		if strings.HasPrefix(tag, stoppedByTag) {
+			return tag[len(stoppedByTag):]
+		}
+	}
+	return ""
+}
+
+// withStoppedBy returns the config's tags with any stopped-by tag replaced by
+// one naming the given VM, or removed if by is empty.
+func (conf vmConfig) withStoppedBy(by string) []string {
+	var tags []string
+	for _, tag := range conf.tags() {
+		if !strings.HasPrefix(tag, stoppedByTag) {
+			tags = append(tags, tag)
+		}
+	}
+	if by != "" {
+		tags = append(tags, stoppedByTag+by)
+	}
+	return tags
+}
+
+// markStoppedBy tags a VM as stopped by the given VM, or clears any such tag
+// if by is empty.
+func markStoppedBy(vm vmInfo, by string) error {
+	if vm.config.stoppedBy() == by {
+		return nil
+	}
+	tags := vm.config.withStoppedBy(by)
+	if len(tags) == 0 {
+		return maybeRun("qm", "set", vm.id, "--delete", "tags")
+	}
+	return maybeRun("qm", "set", vm.id, "--tags", strings.Join(tags, ";"))
+}
+
+// clearStoppedBy removes any stopped-by tag from a VM once it has started.
+func clearStoppedBy(id string) error {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return err
+	}
+	return markStoppedBy(vmInfo{listRec: listRec{id: id}, config: conf}, "")
+}
+
+// stopCause returns the id of the VM whose start preempted the given VM, or
+// the empty string if it was stopped by anything else; this tells stops
+// caused by the hook apart from user initiated ones when the hook runs for
+// the stopped VM.
+func stopCause(id string) (string, error) {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return "", err
+	}
+	return conf.stoppedBy(), nil
+}
+
+// restartPreempted starts any VMs that were preempted by the given VM, in
+// proxmox startup order, waiting for each one's startup up delay, recording
+// an event of the given kind for each. Nothing is restarted if the given VM
+// was itself preempted, since its preemptor now holds the resources.
+func restartPreempted(id string, kind eventKind) error {
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	if self := findVM(vms, id); self == nil || self.config.stoppedBy() != "" {
+		return nil
+	}
+
+	var victims []vmInfo
+	for _, vm := range vms {
+		if vm.status == "stopped" && vm.config.stoppedBy() == id {
+			victims = append(victims, vm)
+		}
+	}
+	sort.SliceStable(victims, func(i, j int) bool {
+		return startupLess(victims[i], victims[j])
+	})
+
+	if kind == kindYieldBack && len(victims) > 0 {
+		runUserHook(onYieldBackExec, userHookEvent{Point: "on-yield-back", VMID: id, Mutuals: vmIDs(victims)})
+	}
+
+	var started []vmInfo
+	for i, vm := range victims {
+		if conflict := conflictsWith(vm, started); conflict != "" {
+			warnf("not restarting vm #%v, since it would preempt restarted vm #%v", vm.id, conflict)
+			continue
+		}
+		started = append(started, vm)
+
+		if err := recordChain(vm.id); err != nil {
+			warnf("unable to record hook chain: %v", err)
+		}
+		err := maybeRun("qm", "start", vm.id)
+		ev := event{Kind: kind, VMID: vm.id, By: id}
+		if err != nil {
+			ev.Error = err.Error()
+			if cerr := clearChain(vm.id); cerr != nil {
+				warnf("unable to clear hook chain: %v", cerr)
+			}
+		}
+		recordEvent(ev)
+		if err != nil {
+			return err
+		}
+		if up := vm.config.startup().up; up > 0 && i < len(victims)-1 && !dryRun {
+			time.Sleep(time.Duration(up) * time.Second)
+		}
+	}
+	return nil
+}
+
+// yieldBackHeld returns why the VMs preempted by the given VM shouldn't be
+// yielded back to now that it stopped, or "" if they should: not while the
+// host is shutting down, or proxmox is stopping all guests, lest they start
+// as it goes down; nor while the VM is being backed up in stop mode, since
+// vzdump starts it again once done.
+func yieldBackHeld(id string) string {
+	if conf, err := readVMConfig(id); err != nil {
+		warnf("unable to read vm #%v config: %v", id, err)
+	} else if conf["lock"] == "backup" {
+		return "it's being backed up"
+	}
+	if hostStopping() {
+		return "the host is shutting down"
+	}
+	if stopping, err := stoppingAllGuests(); err != nil {
+		warnf("unable to check for a task stopping all guests: %v", err)
+	} else if stopping {
+		return "all guests are being stopped"
+	}
+	return ""
+}
+
+// hostStopping returns true if systemd is shutting down the host.
+func hostStopping() bool {
+	cmd := exec.Command("systemctl", "is-system-running")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	done, err := startCommand(cmd)
+	if err != nil {
+		debugf("unable to check whether the host is shutting down: %v", err)
+		return false
+	}
+	// exits non-zero for any state but running, so only its output matters
+	done(cmd.Wait())
+	return strings.TrimSpace(out.String()) == "stopping"
+}
+
+// stoppingAllGuests returns true if a proxmox task stopping all guests of
+// this node, as pve-guests runs on shutdown, or a bulk stop does, is active.
+func stoppingAllGuests() (bool, error) {
+	var tasks []struct {
+		UPID string `json:"upid"`
+	}
+	err := decodeJSONCommand(&tasks, exec.Command("pvesh", "get", "/nodes/localhost/tasks",
+		"--source", "active", "--typefilter", "stopall", "--output-format", "json"))
+	return len(tasks) > 0, err
+}
+
+// conflictsWith returns the id of any of the given VMs that is a mutual of
+// vm, or the empty string if none are.
+func conflictsWith(vm vmInfo, others []vmInfo) string {
+	for _, other := range others {
+		if areMutuals(vm, other) {
+			return other.id
+		}
+	}
+	return ""
+}
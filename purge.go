@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// runPurge reverts everything that init and the hook have done: unhooking all
+// VMs (restoring any hookscripts that init replaced), removing any stopped-by
+// tags, the installed binary and its hook stub, any boot unit, and all state.
+// Combined with -ssh, this allows a trial run on a remote host to be fully
+// undone.
+func runPurge(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: purge"))
+	}
+
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, vm := range vms {
+		if err := unhookVM(vm, st.Hookscripts[vm.id]); err != nil {
+			errorf("failed to unhook vm #%v: %v", vm.id, err)
+			failed++
+		}
+	}
+
+	_, storeDir, err := findSnippets()
+	if err != nil {
+		return err
+	}
+	if err := removePath(path.Join(storeDir, "snippets", hookCmdName)); err != nil {
+		return err
+	}
+	if err := removePath(libDir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(bootUnitPath); err == nil {
+		if err := maybeRun("systemctl", "disable", path.Base(bootUnitPath)); err != nil {
+			return err
+		}
+		if err := removePath(bootUnitPath); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(watchUnitPath); err == nil {
+		if err := maybeRun("systemctl", "disable", "--now", path.Base(watchUnitPath)); err != nil {
+			return err
+		}
+		if err := removePath(watchUnitPath); err != nil {
+			return err
+		}
+	}
+	if err := removePath(hotplugRulePath); err != nil {
+		return err
+	}
+
+	if err := removePath(stateDir); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to unhook %v vm(s)", failed)
+	}
+	return nil
+}
+
+// unhookVM removes our hookscript from a VM, restoring any prior one, and
+// removes any stopped-by tag.
+func unhookVM(vm vmInfo, prev string) error {
+	if isOurHook(vm.config["hookscript"]) {
+		args := []string{"qm", "set", vm.id, "--delete", "hookscript"}
+		if prev != "" {
+			args = []string{"qm", "set", vm.id, "--hookscript", prev}
+		}
+		if err := maybeRun(args...); err != nil {
+			return err
+		}
+	}
+	if vm.config.stoppedBy() != "" {
+		return markStoppedBy(vm, "")
+	}
+	return nil
+}
+
+// backupHookscript records a VM's prior hookscript before init replaces it.
+func backupHookscript(id, prev string) error {
+	return updateState(func(st *state) error {
+		if st.Hookscripts == nil {
+			st.Hookscripts = make(map[string]string)
+		}
+		st.Hookscripts[id] = prev
+		return nil
+	})
+}
+
+// removePath removes a file or directory tree, if it exists.
+func removePath(name string) error {
+	if _, err := os.Lstat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if dryRun {
+		infof("would remove %q", name)
+		scriptCommand("rm", "-rf", name)
+		return nil
+	}
+	infof("remove %q", name)
+	return os.RemoveAll(name)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -12,9 +13,13 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -23,18 +28,106 @@ const hookCmdName = "qmexmut.hook"
 
 func main() {
 	cmdName := path.Base(flag.CommandLine.Name())
-	if err := run(cmdName); err != nil {
-		log.Fatal(err)
+	err := run(cmdName)
+	if err != nil {
+		log.Print(err)
+	}
+	writeResultTrailer(err)
+	if err != nil {
+		os.Exit(exitCode(err))
 	}
 }
 
+// Exit codes returned by main(), so that proxmox task results and any wrapper
+// scripts can tell a correctly denied start apart from a crashed tool.
+const (
+	exitOK            = 0
+	exitFailure       = 1 // unexpected or uncategorized failure
+	exitDenied        = 2 // start denied by policy
+	exitPreemptFailed = 3 // unable to stop conflicting mutuals
+	exitEnvironment   = 4 // missing commands, storage, or other host setup
+	exitPartialInit   = 5 // init hooked some, but not all, VMs
+	exitUsage         = 6 // invalid command line
+	exitNoSnippets    = 7 // no storage suitable for the hook snippet
+)
+
+// exitError annotates an error with the exit code that main() should use.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (ee exitError) Error() string { return ee.err.Error() }
+func (ee exitError) Unwrap() error { return ee.err }
+
+// withExitCode annotates any non-nil error with an exit code; the outermost
+// annotation wins when an error is wrapped multiple times.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return exitError{code, err}
+}
+
+// exitCode returns the process exit code appropriate for any error returned
+// by run().
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return exitEnvironment
+	}
+	return exitFailure
+}
+
 // run provides command dispatch and flag parsing logic for main(),
 // returning an error to log on failure.
 func run(cmdName string) error {
 	server := flag.String("ssh", "", "upload to and execute on remote host using ssh")
 	rmSelf := flag.Bool("rm", false, "remove self executable once done")
 	cmdFlag := flag.String("cmd", "", "overide argv[0] command name")
-	flag.Parse()
+
+	// handle parse errors ourselves, since flag's default exit code would
+	// collide with exitDenied
+	flag.CommandLine.Init(flag.CommandLine.Name(), flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+
+	if err := verifySelf(); err != nil {
+		return withExitCode(exitEnvironment, err)
+	}
+	if err := loadConfig(); err != nil && !lintingConfig(flag.Args()) {
+		return withExitCode(exitEnvironment, err)
+	}
+	if err := setupOffline(); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	closeScript, err := openScript()
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	defer func() {
+		if err := closeScript(); err != nil {
+			errorf("unable to write script: %v", err)
+		}
+	}()
+
+	stopProfile, err := startProfile()
+	if err != nil {
+		return withExitCode(exitEnvironment, err)
+	}
+	defer stopProfile()
+	defer saveConfigCache()
+	defer flushNotifications()
 
 	if *rmSelf {
 		if selfExe, err := os.Executable(); err == nil {
@@ -45,6 +138,9 @@ func run(cmdName string) error {
 	if *server != "" {
 		return runRemote(*server, flag.Args())
 	}
+	if len(nodeNames) > 0 {
+		return runNodes(flag.Args())
+	}
 
 	if *cmdFlag != "" {
 		cmdName = *cmdFlag
@@ -54,35 +150,152 @@ func run(cmdName string) error {
 	case hookCmdName:
 		return runHook(cmdName, flag.Args())
 	default:
-		return runInit(flag.Args())
+		return runCommand(flag.Args())
+	}
+}
+
+// runCommand dispatches any subcommand named by the first positional
+// argument, defaulting to init when none is given.
+func runCommand(args []string) error {
+	sub := "init"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+	switch sub {
+	case "init":
+		return runInit(args)
+	case "status":
+		return runStatus(args)
+	case "plan":
+		return runPlan(args)
+	case "check":
+		return runCheck(args)
+	case "cancel":
+		return runCancel(args)
+	case "approve":
+		return runApprove(args)
+	case "pause":
+		return runPause(args)
+	case "resume":
+		return runResume(args)
+	case "disable":
+		return runDisable(args)
+	case "enable":
+		return runEnable(args)
+	case "reserve":
+		return runReserve(args)
+	case "unreserve":
+		return runUnreserve(args)
+	case "hook-vm":
+		return runHookVM(args)
+	case "unhook-vm":
+		return runUnhookVM(args)
+	case "purge":
+		return runPurge(args)
+	case "boot":
+		return runBoot(args)
+	case "reconcile":
+		return runReconcile(args)
+	case "metrics":
+		return runMetrics(args)
+	case "free":
+		return runFree(args)
+	case "holders":
+		return runHolders(args)
+	case "explain":
+		return runExplain(args)
+	case "policy":
+		return runPolicy(args)
+	case "config":
+		return runConfig(args)
+	case "watch":
+		return runWatch(args)
+	case "ctl":
+		return runCtl(args)
+	case "selftest":
+		return runSelftest(args)
+	case "hotplug":
+		return runHotplug(args)
+	case "rescan":
+		return runRescan(args)
+	case "matrix":
+		return runMatrix(args)
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("unknown command %q", sub))
 	}
 }
 
 // runRemote executes the currently ran executable on a remote ssh server with
 // all positional args passed along.
-func runRemote(server string, args []string) (rerr error) {
-	log.Printf("running on remote %q", server)
+func runRemote(server string, args []string) error {
+	res, err := runRemoteTo(server, args, os.Stdout, os.Stderr)
+	if err != nil && res != nil {
+		// exit as the remote did, so that wrappers can tell why it failed
+		return withExitCode(res.ExitCode, err)
+	}
+	return err
+}
+
+// runRemoteTo is runRemote with the remote output written to the given
+// writers, rather than ours, returning its result trailer, if it got that far.
+func runRemoteTo(server string, args []string, stdout, stderr io.Writer) (res *runResult, rerr error) {
+	infof("running on remote %q", server)
+
+	upload := true
+	var script string
+	if sshCache {
+		selfExe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get self executable: %w", err)
+		}
+		sum, err := fileSHA256(selfExe)
+		if err != nil {
+			return nil, err
+		}
+		upload = !remoteHasSelf(server, sum)
+		script = remoteCachedScript(sum, upload)
+	} else {
+		script = "self=`mktemp` && gzip -dc >$self && chmod +x $self && exec $self -rm \"$@\""
+	}
 
-	sshArgs := []string{
-		server, "sh", "-c",
-		"'self=`mktemp` && cat >$self && chmod +x $self && exec $self -rm \"$@\"'",
-		"--",
+	remoteArgs := append(sshArgs(), server, "sh", "-c", shellJoin([]string{script}), "--")
+	remoteArgs = append(remoteArgs, shellJoin(append([]string{"-result-trailer"}, args...)))
+
+	cmd := exec.Command("ssh", remoteArgs...)
+	// the same filter is used for both when they're the same, since exec
+	// then writes to it from one goroutine
+	filter := &trailerFilter{w: stderr}
+	cmd.Stdout = stdout
+	cmd.Stderr = filter
+	if stdout == stderr {
+		cmd.Stdout = filter
 	}
-	for _, arg := range args {
-		sshArgs = append(sshArgs, strconv.Quote(arg))
+	finish := func(err error) (*runResult, error) {
+		if ferr := filter.flush(); err == nil && ferr != nil {
+			err = ferr
+		}
+		if err != nil {
+			err = fmt.Errorf("remote self failed: %w", err)
+		}
+		return filter.result, err
+	}
+
+	if !upload {
+		debugf("remote %q already has this executable", server)
+		done := traceCommand(cmd)
+		err := cmd.Run()
+		done(err)
+		return finish(err)
 	}
 
-	cmd := exec.Command("ssh", sshArgs...)
 	in, err := cmd.StdinPipe()
 	if err != nil {
-		return fmt.Errorf("failed to stdin pipe: %w", err)
+		return nil, fmt.Errorf("failed to stdin pipe: %w", err)
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
+	done := traceCommand(cmd)
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start ssh: %w", err)
+		return nil, fmt.Errorf("failed to start ssh: %w", err)
 	}
 
 	defer func() {
@@ -90,16 +303,27 @@ func runRemote(server string, args []string) (rerr error) {
 			rerr = fmt.Errorf("failed to close in: %w", err)
 		}
 
-		if err := cmd.Wait(); rerr == nil && err != nil {
-			rerr = fmt.Errorf("remote self failed: %w", err)
+		err := cmd.Wait()
+		done(err)
+		res, err = finish(err)
+		if rerr == nil {
+			rerr = err
 		}
 	}()
 
-	return copySelfInto(in)
+	// the executable compresses to about a third, which matters on slow links
+	gz, err := gzip.NewWriterLevel(in, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if err := copySelfInto(gz); err != nil {
+		return nil, err
+	}
+	return nil, gz.Close()
 }
 
-// runInit installs the current executable into proxmox snippets storage, and
-// then sets that snippet as hookscript for any VMs that have host hardware
+// runInit installs the current executable, along with a hook stub for it in
+// proxmox snippets storage, and then sets that snippet as hookscript for any VMs that have host hardware
 // passed through.
 func runInit(args []string) error {
 	snippetStore, storeDir, err := findSnippets()
@@ -111,64 +335,150 @@ func runInit(args []string) error {
 	hookDest := path.Join(storeDir, "snippets", hookCmdName)
 
 	if dryRun {
-		log.Printf("would copy self execuable to %q", hookDest)
+		infof("would install self execuable to %q, with hook stub %q", libPath(), hookDest)
+		scriptComment("requires qmexmut installed to %v, with hook stub %v", libPath(), hookDest)
 	} else {
-		if err := copySelfTo(hookDest); err != nil {
-			return err
+		if err := installSelf(hookDest); err != nil {
+			return withExitCode(exitEnvironment, err)
 		}
-		log.Printf("copied self execuable to %q", hookDest)
+		infof("installed self execuable to %q, with hook stub %q", libPath(), hookDest)
 	}
 
-	g := new(errgroup.Group)
-	g.Go(func() error {
-		cmm := matchCommand(exec.Command("qm", "list"), listPat)
-		cmm.Scan() // skip first (header) line
-		for cmm.Scan() {
-			id := cmm.MatchText(1)
-			g.Go(func() error {
-				if should, err := shouldHook(id); err != nil || !should {
-					return err
+	recs, err := listVMs()
+	if err != nil {
+		return err
+	}
+	if _, err := establishRegistry(); err != nil {
+		return err
+	}
+
+	prog := initProgress{total: len(recs)}
+	stopProgress := prog.report()
+	var summaryMu sync.Mutex
+	runSum := newRunSummary("init")
+
+	// failures to hook any one VM are logged and counted, rather than
+	// aborting, so that init hooks as many VMs as it can
+	err = forEachLimit(len(recs), scanWorkers, func(i int) error {
+		id := recs[i].id
+		t0 := time.Now()
+		hooked, err := hookVM(id, hookScript)
+		outcome := "skipped"
+		switch {
+		case err != nil:
+			outcome = "failed"
+			errorf("failed to hook vm #%v: %v", id, err)
+			atomic.AddInt32(&prog.failed, 1)
+		case hooked:
+			outcome = "hooked"
+			atomic.AddInt32(&prog.hooked, 1)
+		default:
+			atomic.AddInt32(&prog.skipped, 1)
+			if conf, err := readVMConfig(id); err == nil && conf["hookscript"] == hookScript {
+				outcome = "compliant"
+				if err := registerVM(id, conf); err != nil {
+					warnf("unable to register vm #%v: %v", id, err)
 				}
-				return maybeRun("qm", "set", id, "--hookscript", hookScript)
-			})
+			}
+		}
+		summaryMu.Lock()
+		switch outcome {
+		case "failed":
+			runSum.Failed = append(runSum.Failed, id)
+		case "hooked":
+			runSum.Hooked = append(runSum.Hooked, id)
+		case "compliant":
+			runSum.Compliant = append(runSum.Compliant, id)
+		default:
+			runSum.Skipped = append(runSum.Skipped, id)
 		}
-		return cmm.Err()
+		summaryMu.Unlock()
+		atomic.AddInt32(&prog.scanned, 1)
+		debugf("vm #%v %s in %v", id, outcome, time.Since(t0))
+		return nil
 	})
-	return g.Wait()
+	stopProgress()
+	if err != nil {
+		return err
+	}
+	infof("init %v", &prog)
+	noteInitResult(&prog, runSum.Hooked)
+	sendRunSummary(runSum)
+
+	if prog.failed > 0 {
+		return withExitCode(exitPartialInit, fmt.Errorf("failed to hook %v vm(s)", prog.failed))
+	}
+	return nil
+}
+
+// hookVM sets hookScript on the given VM if it passes thru any host resources
+// and isn't already hooked, returning true if it did so.
+func hookVM(id, hookScript string) (bool, error) {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return false, err
+	}
+	if len(exclusiveResources(conf.hostResources())) == 0 || conf["hookscript"] == hookScript {
+		return false, nil
+	}
+	if conf.protected() && !preemptProtected {
+		infof("vm #%v is protected, so starting its mutuals while it runs will be denied", id)
+	}
+	if prev := conf["hookscript"]; prev != "" && !isOurHook(prev) {
+		if err := backupHookscript(id, prev); err != nil {
+			return false, err
+		}
+		warnf("replacing vm #%v hookscript %q, which purge will restore", id, prev)
+	}
+	if err := maybeRun("qm", "set", id, "--hookscript", hookScript); err != nil {
+		return false, err
+	}
+	return true, registerVM(id, conf)
 }
 
+// findSnippets returns the first enabled directory storage with snippets
+// content, where the hook stub is installed; if there's none, the error
+// explains why each storage was rejected.
 func findSnippets() (store, dir string, _ error) {
 	var stores []struct {
 		Name    string `json:"storage"`
+		Type    string `json:"type"`
 		Content string `json:"content"`
 		Path    string `json:"path"`
+		Disable int    `json:"disable"`
 	}
 
 	if err := decodeJSONCommand(
 		&stores,
 		exec.Command("pvesh", "get", "/storage", "--output-format", "json"),
 	); err != nil {
-		return "", "", err
+		return "", "", withExitCode(exitEnvironment, err)
 	}
 
+	var rejected []string
+	hint := ""
 	for _, st := range stores {
-		if st.Path == "" {
-			continue
-		}
-		if !hasString("snippets", strings.Split(st.Content, ",")) {
-			continue
+		var why string
+		switch {
+		case st.Disable != 0:
+			why = "disabled"
+		case st.Path == "":
+			why = fmt.Sprintf("%v storage has no path", st.Type)
+		case !hasString("snippets", strings.Split(st.Content, ",")):
+			why = "no snippets content"
+			if hint == "" {
+				hint = fmt.Sprintf("; enable it with: pvesm set %v --content %v,snippets", st.Name, st.Content)
+			}
+		default:
+			return st.Name, st.Path, nil
 		}
-
-		store = st.Name
-		dir = st.Path
-		break
+		rejected = append(rejected, fmt.Sprintf("%v (%v)", st.Name, why))
 	}
-	return store, dir, nil
-}
-
-func shouldHook(id string) (bool, error) {
-	rec := resourceRecognizer(id)
-	return rec.Scan(), rec.Err()
+	if len(rejected) == 0 {
+		return "", "", withExitCode(exitNoSnippets, errors.New("no storage configured for snippets"))
+	}
+	return "", "", withExitCode(exitNoSnippets, fmt.Errorf(
+		"no storage suitable for snippets, rejected %v%v", strings.Join(rejected, ", "), hint))
 }
 
 func copySelfTo(dest string) (rerr error) {
@@ -186,12 +496,12 @@ func copySelfTo(dest string) (rerr error) {
 
 func copySelfInto(dst io.Writer) (rerr error) {
 	selfExe, err := os.Executable()
-	if err != err {
+	if err != nil {
 		return fmt.Errorf("unable to get self executable: %w", err)
 	}
 
 	self, err := os.Open(selfExe)
-	if err != err {
+	if err != nil {
 		return fmt.Errorf("unable to open self executable: %w", err)
 	}
 	defer self.Close()
@@ -214,27 +524,114 @@ func hasString(wanted string, ss []string) bool {
 // runHook provides proxmox hookscript logic when dispatched by runHook based
 // on the command name. returning an error to log on failure.
 func runHook(progName string, args []string) error {
-	log.Printf("hook %v %q", progName, args)
+	infof("hook %v %q", progName, args)
 
 	if len(args) < 2 {
-		return fmt.Errorf("usage: %s <vmid> <phase>", progName)
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s <vmid> <phase>", progName))
 	}
 	vmid := args[0]
 	phase := args[1]
 
+	if err := loadHookChain(vmid); err != nil {
+		warnf("unable to load hook chain: %v", err)
+	}
+	if err := rollbackFailedStarts(vmid); err != nil {
+		warnf("unable to rollback failed starts: %v", err)
+	}
+
 	switch phase {
 	case "pre-start":
-		return stopMutuals(vmid)
+		if paused, err := enforcementPaused(); err != nil {
+			warnf("unable to check whether enforcement is paused: %v", err)
+		} else if paused != nil {
+			// printed to stdout so that it shows in the proxmox start task log
+			fmt.Printf("qmexmut: enforcement paused, not stopping any mutuals of vm #%v\n", vmid)
+			recordEvent(event{Kind: kindPaused, VMID: vmid, Reason: paused.Reason})
+			return nil
+		}
+		if conf, unmanaged, err := unmanagedConfig(vmid); err != nil {
+			warnf("unable to read vm #%v config: %v", vmid, err)
+		} else if unmanaged {
+			// no need to scan every other VM for mutuals that it can't have
+			fmt.Printf("qmexmut: vm #%v passes thru no exclusive host resources, so needs no management\n", vmid)
+			recordEvent(event{Kind: kindUnmanaged, VMID: vmid})
+			return nil
+		} else if adopted, err := adoptHooked(vmid, conf, false); err != nil {
+			warnf("unable to register vm #%v: %v", vmid, err)
+		} else if adopted {
+			fmt.Printf("qmexmut: %v\n", describeAdopted(vmid, conf))
+		}
+		t0 := time.Now()
+		hookDone := timeStage("pre-start")
+		err := stopMutuals(vmid)
+		hookDone()
+		if len(hookChain) > 1 {
+			if cerr := clearChain(vmid); cerr != nil {
+				warnf("unable to clear hook chain: %v", cerr)
+			}
+		}
+		if exitCode(err) == exitDenied {
+			// printed to stdout so that it shows in the proxmox start task log
+			fmt.Printf("qmexmut: denied starting vm #%v: %v\n", vmid, err)
+			runUserHook(onDenyExec, userHookEvent{Point: "on-deny", VMID: vmid, Error: err.Error()})
+		}
+		summary.report(vmid, time.Since(t0), err)
+		if err != nil {
+			if rerr := rollbackStart(vmid); rerr != nil {
+				warnf("unable to rollback failed start: %v", rerr)
+			}
+		}
+		return err
 
 	case "post-start":
+		if err := finishStart(vmid); err != nil {
+			warnf("unable to clear pending start: %v", err)
+		}
+		if verifyAttach {
+			if err := verifyAttached(vmid); err != nil {
+				warnf("unable to verify devices attached: %v", err)
+			}
+		}
+		if err := releaseLeases(vmid); err != nil {
+			warnf("unable to release leases: %v", err)
+		}
+		if err := clearStoppedBy(vmid); err != nil {
+			warnf("unable to clear stopped-by tag: %v", err)
+		}
+		if autoUnhook {
+			// unhooked after starting, since the VM's config is locked until then
+			if conf, unmanaged, err := unmanagedConfig(vmid); err != nil {
+				warnf("unable to read vm #%v config: %v", vmid, err)
+			} else if unmanaged {
+				if err := unhookAndForget(vmid, conf); err != nil {
+					return fmt.Errorf("unable to unhook vm #%v: %w", vmid, err)
+				}
+				infof("unhooked vm #%v, which passes thru no exclusive host resources", vmid)
+				return nil
+			}
+		}
 		return claimMutualOnboot(vmid) // start the last one started on boot
 
 	case "pre-stop":
 
 	case "post-stop":
+		// don't react to stops that we caused by preempting the VM
+		if by, err := stopCause(vmid); err != nil {
+			return err
+		} else if by != "" {
+			infof("vm #%v was preempted by vm #%v", vmid, by)
+			return nil
+		}
+		if yieldBack {
+			if held := yieldBackHeld(vmid); held != "" {
+				infof("not yielding back from vm #%v, since %v", vmid, held)
+				return nil
+			}
+			return restartPreempted(vmid, kindYieldBack)
+		}
 
 	default:
-		return fmt.Errorf("got unknown phase %q", phase)
+		return withExitCode(exitUsage, fmt.Errorf("got unknown phase %q", phase))
 	}
 
 	return nil
@@ -248,17 +645,17 @@ func claimMutualOnboot(id string) error {
 		return err
 	}
 
-	mutualRecs, err := mutuals(id)
+	mutualVMs, err := mutuals(id)
 	if err != nil {
 		return err
 	}
 
-	willMutualBoot := make([]bool, len(mutualRecs))
+	willMutualBoot := make([]bool, len(mutualVMs))
 	willAnyMutualBoot := false
-	for i, mutual := range mutualRecs {
-		willTheyBoot, err := willBoot(mutual.id)
+	for i, mutual := range mutualVMs {
+		willTheyBoot, err := mutual.config.willBoot()
 		if err != nil {
-			return err
+			return fmt.Errorf("vm #%v: %w", mutual.id, err)
 		}
 		willMutualBoot[i] = willTheyBoot
 		willAnyMutualBoot = willAnyMutualBoot || willTheyBoot
@@ -278,7 +675,7 @@ func claimMutualOnboot(id string) error {
 		if !willTheyBoot {
 			continue
 		}
-		if err := maybeRun("qm", "set", mutualRecs[i].id, "-onboot", "0"); err != nil {
+		if err := maybeRun("qm", "set", mutualVMs[i].id, "-onboot", "0"); err != nil {
 			return err
 		}
 	}
@@ -286,46 +683,233 @@ func claimMutualOnboot(id string) error {
 	return nil
 }
 
-func willBoot(id string) (will bool, rerr error) {
-	rec := configMatcher(id)
-	defer rec.Cleanup(&rerr)
-	for rec.Scan() {
-		key := rec.MatchText(1)
-		if key != "onboot" {
-			continue
-		}
-		val := rec.MatchText(2)
-		n, err := strconv.ParseInt(val, 10, strconv.IntSize)
-		if err != nil {
-			// TODO ideally this would be a multi-line "verbose error"
-			return false, fmt.Errorf("invalid -onboot config for vm #%v: %w; line:%q", id, err, rec.Bytes())
-		}
-		return n != 0, nil
+func willBoot(id string) (bool, error) {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	will, err := conf.willBoot()
+	if err != nil {
+		return false, fmt.Errorf("vm #%v: %w", id, err)
+	}
+	return will, nil
 }
 
 // stopMutuals shuts down any running VMs that share host resources like
 // passed-through PCI and USB devices.
 func stopMutuals(vmid string) error {
-	mutualRecs, err := mutuals(vmid)
+	vms, err := scanVMs()
 	if err != nil {
 		return err
 	}
-	g := new(errgroup.Group)
-	for _, mutual := range mutualRecs {
-		switch mutual.status {
-		case "running":
-			id := mutual.id
-			g.Go(func() error {
-				return maybeRun("qm", "shutdown", id)
-			})
-		case "stopped":
-		default:
-			log.Printf("not stopping mutual %q in unknown state %q", mutual.id, mutual.status)
+	self := findVM(vms, vmid)
+	if self == nil {
+		return fmt.Errorf("no such vm #%v", vmid)
+	}
+	conflictsDone := timeStage("conflict computation")
+
+	if err := checkReservations(*self); err != nil {
+		return err
+	}
+
+	policy, err := policyFor(*self)
+	if err != nil {
+		return err
+	}
+	rules, err := configRules()
+	if err != nil {
+		return withExitCode(exitEnvironment, err)
+	}
+	blackout, err := activeBlackout(time.Now())
+	if err != nil {
+		return withExitCode(exitEnvironment, err)
+	}
+
+	// decide what to do about each mutual, by state, policy, and rules
+	mutualVMs := mutualsOf(vmid, vms)
+	actions := make(map[string]string, len(mutualVMs))
+	var stopping, waiting []vmInfo
+	var denial error
+	needsApproval := false
+	for _, mutual := range mutualVMs {
+		action, ask, err := decideAction(*self, mutual, policy, rules, blackout)
+		if err != nil && denial == nil {
+			denial = err
+		}
+		actions[mutual.id] = action
+
+		switch {
+		case isPreempting(action):
+			stopping = append(stopping, mutual)
+			needsApproval = needsApproval || ask
+		case action == actionWait:
+			waiting = append(waiting, mutual)
+		case action == actionSkip:
+			warnf("not stopping mutual %q in unknown state %q", mutual.id, mutual.state)
 		}
 	}
-	return g.Wait()
+	explainConflicts(*self, mutualVMs, actions, policy)
+	var deps []vmInfo
+	if denial == nil {
+		deps, denial = checkDependents(*self, mutualVMs, stopping, vms)
+		for _, dep := range deps {
+			actions[dep.id] = preemptAction(dep)
+		}
+	}
+	summary.noteActions(actions)
+	conflictsDone()
+
+	if denial != nil {
+		return withExitCode(exitDenied, recordDenial(vmid, denial))
+	}
+	if err := checkCascade(append(deps, stopping...)); err != nil {
+		return recordDenial(vmid, err)
+	}
+	if err := checkResume(*self, stopping); err != nil {
+		return recordDenial(vmid, err)
+	}
+
+	if err := checkCooldown(*self, stopping); err != nil {
+		return err
+	}
+	if needsApproval {
+		approvalDone := timeStage("approval wait")
+		if err := awaitApproval(vmid, stopping); err != nil {
+			return err
+		}
+		approvalDone()
+	}
+	graceDone := timeStage("preempt grace")
+	if err := awaitPreemptGrace(vmid, stopping); err != nil {
+		return err
+	}
+	graceDone()
+	if len(stopping) > 0 {
+		recordEvent(event{Kind: kindPreempt, VMID: vmid, Reason: "preempting vm #" + strings.Join(vmIDs(append(deps, stopping...)), ", #")})
+		runUserHook(beforePreemptExec, userHookEvent{Point: "before-preempt", VMID: vmid, Mutuals: vmIDs(stopping)})
+		recordStartIntent(*self, append(deps, stopping...))
+		shutdownDone := timeStage("shutdown wait")
+		// dependents are stopped first, one at a time, each before anything
+		// that it depends on, so as not to break them midway
+		err := shutdownEach(vmid, deps)
+		if err == nil {
+			err = shutdownVMs(vmid, stopping)
+		} else {
+			var sf shutdownFailures
+			if errors.As(err, &sf) {
+				sf.skipped = append(sf.skipped, vmIDs(stopping)...)
+				err = sf
+			}
+			err = fmt.Errorf("unable to stop dependents of mutuals: %w", err)
+		}
+		shutdownDone()
+		stopped := stoppedVMs(append(deps, stopping...), err)
+		recordPreemption(*self, stopped)
+		if err != nil && len(stopped) > 0 {
+			reportPartialPreemption(vmid, stopped, err)
+		}
+		markStartActed(vmid)
+		after := userHookEvent{Point: "after-preempt", VMID: vmid, Mutuals: vmIDs(stopping)}
+		if err != nil {
+			after.Error = err.Error()
+		}
+		runUserHook(afterPreemptExec, after)
+		if err != nil {
+			return withExitCode(exitPreemptFailed, err)
+		}
+	}
+
+	if len(waiting) == 0 && policy == "queue" {
+		var unstopped []vmInfo
+		for _, mutual := range mutualVMs {
+			if actions[mutual.id] != actionIgnore && !isPreempting(actions[mutual.id]) {
+				unstopped = append(unstopped, mutual)
+			}
+		}
+		queued, err := anyQueued(*self, unstopped)
+		if err != nil {
+			return err
+		}
+		if queued {
+			waiting = unstopped
+		}
+	}
+	if len(waiting) > 0 {
+		defer timeStage("queue wait")()
+		return awaitLease(*self, waiting)
+	}
+	return nil
+}
+
+// decideAction decides what stopMutuals does about a mutual of self: first
+// by its state, then by policy, any matching rule, and any active blackout
+// window, returning the action, whether it needs approval, and why the start
+// is denied, if the action is to deny it.
+func decideAction(self, mutual vmInfo, policy string, rules []policyRule, blackout *blackoutWindow) (action string, ask bool, denial error) {
+	action = preemptAction(mutual)
+	if isPreempting(action) && policy == "queue" {
+		action = actionWait
+	}
+	ask = policy == "ask"
+	if action != actionNone {
+		if rule := matchRules(rules, self, mutual); rule != nil {
+			debugf("rule on line %v applies to vm #%v: %v", rule.line, mutual.id, rule.text)
+			switch rule.action {
+			case "deny":
+				action = actionDeny
+				denial = fmt.Errorf("denied by rule on line %v: %v", rule.line, rule.text)
+			case "ignore":
+				action = actionIgnore
+			case "queue":
+				action = actionWait
+			case "preempt":
+				action = preemptAction(mutual)
+				ask = false
+			case "ask":
+				action = preemptAction(mutual)
+				ask = true
+			}
+		}
+	}
+	if isPreempting(action) && blackout != nil {
+		debugf("blackout window on line %v applies to vm #%v: %v", blackout.line, mutual.id, blackout.text)
+		if blackout.action == "queue" {
+			action = actionWait
+		} else {
+			action = actionDeny
+			denial = fmt.Errorf("preemption is blacked out by the window on line %v: %v", blackout.line, blackout.text)
+		}
+	}
+
+	// only now that any rule has had its say is a denial by state final
+	switch {
+	case action != actionDeny:
+		return action, ask, nil
+	case denial != nil:
+	case mutual.config.protected():
+		denial = fmt.Errorf("mutual vm #%v is protected", mutual.id)
+	default:
+		denial = fmt.Errorf("mutual vm #%v is in unknown state %q", mutual.id, mutual.state)
+	}
+	return action, ask, denial
+}
+
+// Actions taken by stopMutuals for a mutual VM, as decided by preemptAction,
+// and then possibly changed by policy and rules.
+const (
+	actionNone     = "none"
+	actionShutdown = "shutdown"
+	actionResume   = "resume+shutdown"
+	actionStop     = "stop"
+	actionSkip     = "skip"
+	actionWait     = "wait"
+	actionDeny     = "deny"
+	actionIgnore   = "ignore"
+)
+
+// isPreempting returns true for actions that stop a mutual.
+func isPreempting(action string) bool {
+	return action == actionShutdown || action == actionResume || action == actionStop
 }
 
 var (
@@ -341,100 +925,517 @@ type listRec struct {
 	status string
 }
 
-func mutuals(id string) (mutualIds []listRec, _ error) {
-	res, err := hostResources(id)
+// mutuals returns all other VMs that share host resources with the given VM.
+func mutuals(id string) ([]vmInfo, error) {
+	vms, err := scanVMs()
 	if err != nil {
 		return nil, err
 	}
+	return mutualsOf(id, vms), nil
+}
 
-	// TODO do we really need a better fixed-width scanner here?
+// findVM returns a pointer to the VM with the given id, or nil if none.
+func findVM(vms []vmInfo, id string) *vmInfo {
+	for i := range vms {
+		if vms[i].id == id {
+			return &vms[i]
+		}
+	}
+	return nil
+}
 
-	cmm := matchCommand(exec.Command("qm", "list"), listPat)
-	cmm.Scan() // skip first (header) line
+// mutualsOf returns any VMs that are mutuals of the given VM.
+func mutualsOf(id string, vms []vmInfo) (mutualVMs []vmInfo) {
+	self := findVM(vms, id)
+	if self == nil {
+		return nil
+	}
+	for _, vm := range vms {
+		if areMutuals(*self, vm) {
+			mutualVMs = append(mutualVMs, vm)
+		}
+	}
+	return mutualVMs
+}
 
-	for cmm.Scan() {
+// areMutuals returns true if two different VMs share host resources, and
+// are in the same pool under poolScope.
+func areMutuals(a, b vmInfo) bool {
+	return a.id != b.id && samePool(a, b) && len(sharedResources(a.resources, b.resources)) > 0
+}
 
-		otherId := cmm.MatchText(1)
+// hostResourceLabels returns labels identifying any host resources passed
+// thru by a VM config key and value, canonicalized so that each physical
+// device has one label however it's referenced.
+func hostResourceLabels(name, value string) []string {
+	if strings.HasPrefix(name, "hostpci") {
+		mdev := ""
+		if i := strings.IndexByte(value, ','); i >= 0 {
+			mdev = mdevOption(value[i+1:])
+			value = value[:i]
+		}
+		var labels []string
+		for _, addr := range strings.Split(value, ";") {
+			if mdev != "" {
+				// a vGPU is always labeled by its GPU, whose profiles it counts
+				labels = append(labels, fmt.Sprintf("hostpci:%s/%s", pciDevice(addr), mdev))
+				continue
+			}
+			for _, res := range pciResources(addr) {
+				labels = append(labels, "hostpci:"+res)
+			}
+		}
+		return labels
+	}
 
-		if otherId == id {
-			continue
+	if name == "args" {
+		return argsResourceLabels(value)
+	}
+
+	if strings.HasPrefix(name, "virtiofs") && sharedDirs != "off" {
+		if label := virtiofsLabel(value); label != "" {
+			return []string{label}
 		}
+		return nil
+	}
 
-		shares, err := sharesHostResources(otherId, res)
-		if err != nil {
-			return nil, err
+	if strings.HasPrefix(name, "usb") {
+		if match := usbHostPat.FindStringSubmatch(value); len(match) > 0 {
+			return []string{usbLabel(match[1])}
+		}
+	}
+
+	return nil
+}
+
+// vmConfig holds the key-value pairs reported by qm config.
+type vmConfig map[string]string
+
+// scanVMConfig runs qm config to read a VM's config; see readVMConfig.
+func scanVMConfig(id string) (_ vmConfig, rerr error) {
+	cmm := configMatcher(id)
+	defer cmm.Cleanup(&rerr)
+	conf := make(vmConfig)
+	for cmm.Scan() {
+		if key := cmm.MatchText(1); !unusedConfigKeys[key] {
+			conf[key] = cmm.MatchText(2)
 		}
+	}
+	return conf, nil
+}
 
-		otherName := cmm.MatchText(2)
-		otherStatus := cmm.MatchText(3)
+// unusedConfigKeys lists VM config keys, holding arbitrarily long free text,
+// that are never kept in memory.
+var unusedConfigKeys = map[string]bool{
+	"description": true,
+}
 
-		if shares {
-			mutualIds = append(mutualIds, listRec{otherId, otherName, otherStatus})
+// hostResources returns the sorted set of host resource labels passed thru by
+// the config, with one label per physical device.
+func (conf vmConfig) hostResources() []string {
+	var labels []string
+	for key, val := range conf {
+		for _, label := range hostResourceLabels(key, val) {
+			if !hasString(label, labels) {
+				labels = append(labels, label)
+			}
 		}
 	}
+	sort.Strings(labels)
+	return dedupeUSB(labels)
+}
+
+// willBoot returns true if the config has onboot set.
+func (conf vmConfig) willBoot() (bool, error) {
+	val, ok := conf["onboot"]
+	if !ok {
+		return false, nil
+	}
+	n, err := strconv.ParseInt(val, 10, strconv.IntSize)
+	if err != nil {
+		return false, fmt.Errorf("invalid onboot config %q: %w", val, err)
+	}
+	return n != 0, nil
+}
+
+// isOurHook returns true if a hookscript volume reference refers to a qmexmut
+// snippet, regardless of which storage it's in.
+func isOurHook(ref string) bool {
+	return ref != "" && path.Base(ref) == hookCmdName
+}
 
-	if err = cmm.Err(); err != nil {
+// vmInfo combines a VM's qm list record with its config.
+type vmInfo struct {
+	listRec
+	config    vmConfig
+	resources []string
+	pool      string
+	state     string // qemu state, refining status; see vmState
+}
+
+func listVMs() (recs []listRec, rerr error) {
+	if offlineDir != "" {
+		return offlineVMs()
+	}
+	cmm := matchCommand(exec.Command("qm", "list"), listPat)
+	defer cmm.Cleanup(&rerr)
+	cmm.Scan() // skip first (header) line
+	for cmm.Scan() {
+		recs = append(recs, listRec{cmm.MatchText(1), cmm.MatchText(2), cmm.MatchText(3)})
+	}
+	return recs, nil
+}
+
+// scanVMs lists all VMs, and reads all of their configs.
+func scanVMs() ([]vmInfo, error) {
+	listDone := timeStage("list")
+	recs, err := listVMs()
+	if err != nil {
 		return nil, err
 	}
+	listDone()
+	defer timeStage("config scan")()
+	vms := make([]vmInfo, len(recs))
+	g := new(errgroup.Group)
+	g.Go(func() error {
+		return forEachLimit(len(recs), scanWorkers, func(i int) error {
+			rec := recs[i]
+			vms[i].listRec = rec
+			conf, err := readVMConfig(rec.id)
+			vms[i].config = conf
+			vms[i].resources = conf.hostResources()
+			if err != nil {
+				return err
+			}
+			vms[i].state, err = vmState(rec, conf)
+			return err
+		})
+	})
+	if wantPools() {
+		g.Go(func() error {
+			pools, err := vmPools()
+			for i := range vms {
+				vms[i].pool = pools[vms[i].id]
+			}
+			return err
+		})
+	}
+	err = g.Wait()
+	noteScanned(vms)
+	return vms, err
+}
 
-	return mutualIds, nil
+// shareable lists resource label patterns, like "hostusb:1a86:*", that may be
+// used by several running VMs at once; they're still reported, but never make
+// VMs mutuals.
+var shareable listFlag
+
+func init() {
+	flag.Var(&shareable, "shareable", "comma separated resource label patterns that never conflict")
 }
 
-func labelHostResource(cmm *cmdMatcher) string {
-	name := cmm.MatchText(1)
+func isShareable(label string) bool {
+	if isShareableDir(label) {
+		return true
+	}
+	for _, pat := range shareable {
+		if matched, _ := path.Match(pat, label); matched {
+			return true
+		}
+	}
+	return false
+}
 
-	if strings.HasPrefix(name, "hostpci") {
-		value := cmm.MatchText(2)
-		if i := strings.IndexByte(value, ','); i >= 0 {
-			value = value[:i]
+// exclusiveResources returns only the labels that are enforced.
+func exclusiveResources(labels []string) (exclusive []string) {
+	for _, label := range labels {
+		if isEnforced(label) {
+			exclusive = append(exclusive, label)
 		}
-		return fmt.Sprintf("hostpci:%s", value)
 	}
+	return exclusive
+}
 
-	if strings.HasPrefix(name, "usb") {
-		if match := usbHostPat.FindSubmatch(cmm.Match(2)); len(match) > 0 {
-			return fmt.Sprintf("hostusb:%s", match[1])
+// sharedResources returns any exclusive labels common to two sorted label
+// lists; labels that aren't enforced are never considered shared.
+func sharedResources(a, b []string) (shared []string) {
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		case !isEnforced(a[i]):
+			i++
+			j++
+		default:
+			shared = append(shared, a[i])
+			i++
+			j++
 		}
 	}
+	return shared
+}
 
-	return ""
+func configMatcher(id string) *cmdMatcher {
+	return matchCommand(exec.Command("qm", "config", id), keyValPat)
+}
+
+//// flag utilities
+
+// choiceFlag is a string flag restricted to a fixed set of choices.
+type choiceFlag struct {
+	val     *string
+	choices []string
 }
 
-func hostResources(id string) (_ map[string]struct{}, rerr error) {
-	rec := resourceRecognizer(id)
-	defer rec.Cleanup(&rerr)
-	reses := make(map[string]struct{})
-	for rec.Scan() {
-		reses[rec.Label()] = struct{}{}
+func (cf choiceFlag) String() string {
+	if cf.val == nil {
+		return ""
 	}
-	return reses, nil
+	return *cf.val
 }
 
-func sharesHostResources(id string, reses map[string]struct{}) (hasAny bool, rerr error) {
-	rec := resourceRecognizer(id)
-	defer rec.Cleanup(&rerr)
-	for rec.Scan() {
-		if _, has := reses[rec.Label()]; has {
-			return true, nil
+func (cf choiceFlag) Set(s string) error {
+	if !hasString(s, cf.choices) {
+		return fmt.Errorf("must be one of %s", strings.Join(cf.choices, ", "))
+	}
+	*cf.val = s
+	return nil
+}
+
+// listFlag is a flag collecting comma separated values, which may be given
+// more than once.
+type listFlag []string
+
+func (lf *listFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+func (lf *listFlag) Set(s string) error {
+	for _, val := range strings.Split(s, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			*lf = append(*lf, val)
 		}
 	}
-	return false, nil
+	return nil
 }
 
-func configMatcher(id string) *cmdMatcher {
-	return matchCommand(exec.Command("qm", "config", id), keyValPat)
+//// logging utilities
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var minLogLevel = levelInfo
+
+func init() {
+	flag.Var(&minLogLevel, "log-level", "minimum level of log output: debug, info, warn, or error")
+	flag.Var(levelFlag{&minLogLevel, levelDebug}, "v", "verbose output; same as -log-level=debug")
+	flag.Var(levelFlag{&minLogLevel, levelWarn}, "q", "quiet output; same as -log-level=warn")
+}
+
+func (lvl logLevel) String() string {
+	if int(lvl) < len(logLevelNames) {
+		return logLevelNames[lvl]
+	}
+	return fmt.Sprintf("logLevel(%d)", int(lvl))
+}
+
+func (lvl *logLevel) Set(s string) error {
+	for i, name := range logLevelNames {
+		if s == name {
+			*lvl = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %q", s)
 }
 
-func resourceRecognizer(id string) *cmdRecognizer {
-	return recognizeCommand(configMatcher(id), labelHostResource)
+// levelFlag is a boolean flag that sets a log level when given.
+type levelFlag struct {
+	lvl *logLevel
+	to  logLevel
+}
+
+func (lf levelFlag) IsBoolFlag() bool { return true }
+func (lf levelFlag) String() string   { return "false" }
+
+func (lf levelFlag) Set(s string) error {
+	if b, err := strconv.ParseBool(s); err != nil {
+		return err
+	} else if b {
+		*lf.lvl = lf.to
+	}
+	return nil
+}
+
+func logf(lvl logLevel, format string, args ...interface{}) {
+	if lvl < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if lvl == levelError {
+		noteResultError(msg)
+	}
+	if lvl != levelInfo {
+		msg = lvl.String() + ": " + msg
+	}
+	_ = log.Output(3, msg)
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+// traceCommand logs at debug level that cmd is about to start, returning a
+// function to call with its final error to log its duration once it's done.
+func traceCommand(cmd *exec.Cmd) func(err error) {
+	if minLogLevel > levelDebug {
+		return func(error) {}
+	}
+	debugf("exec %q", cmd.Args)
+	t0 := time.Now()
+	return func(err error) {
+		if took := time.Since(t0); err != nil {
+			debugf("exec %q failed after %v: %v", cmd.Args, took, err)
+		} else {
+			debugf("exec %q done in %v", cmd.Args, took)
+		}
+	}
 }
 
 //// command running utilities
 
 var dryRun = false
 
+// maxLineBytes limits the length of any line scanned from command output or
+// the config file; VM configs may have very long args or description lines.
+var maxLineBytes = 1024 * 1024
+
+// scanWorkers bounds how many VMs are scanned at once, so that memory and
+// goroutines don't grow with the number of guests.
+var scanWorkers = 8
+
+// spawnLimit limits the rate of spawning commands like qm and pvesh, so that
+// init and hook activity doesn't starve running guests on a loaded host.
+var spawnLimit tokenBucket
+
 func init() {
 	flag.BoolVar(&dryRun, "dry-run", false, "affect no change")
+	flag.Float64Var(&spawnLimit.rate, "spawn-rate", 0, "maximum commands spawned per second; 0 means unlimited")
+	flag.IntVar(&spawnLimit.burst, "spawn-burst", 4, "number of commands that may be spawned at once before -spawn-rate applies")
+	flag.IntVar(&scanWorkers, "scan-workers", scanWorkers, "number of VMs to scan at once")
+	flag.IntVar(&maxLineBytes, "max-line-bytes", maxLineBytes, "longest line that may be scanned from command output or the config file")
+}
+
+// forEachLimit calls fn for every index in [0, n), from at most limit
+// goroutines at once, returning the first error; once an error is returned, no
+// further indices are started.
+func forEachLimit(n, limit int, fn func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > n {
+		limit = n
+	}
+	var next int32 = -1
+	var failed int32
+	g := new(errgroup.Group)
+	for w := 0; w < limit; w++ {
+		g.Go(func() error {
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= n {
+					return nil
+				}
+				if err := fn(i); err != nil {
+					atomic.StoreInt32(&failed, 1)
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// newLineScanner returns a line scanner limited to maxLineBytes.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	return sc
+}
+
+// lineScanError explains any error from a scanner made by newLineScanner,
+// rather than letting an overlong line pass as a generic io error.
+func lineScanError(err error) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line longer than %v bytes, raise -max-line-bytes: %w", maxLineBytes, err)
+	}
+	return err
+}
+
+// tokenBucket is a rate limiter, allowing up to burst events at once, with
+// its bucket refilling at rate tokens per second.
+type tokenBucket struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until the next event is allowed; waiters are admitted in the
+// order that they called wait.
+func (tb *tokenBucket) wait() {
+	if tb.rate <= 0 {
+		return
+	}
+
+	tb.mu.Lock()
+	now := time.Now()
+	if tb.last.IsZero() {
+		tb.tokens = float64(tb.burst)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if max := float64(tb.burst); tb.tokens > max {
+			tb.tokens = max
+		}
+	}
+	tb.last = now
+	tb.tokens-- // may go negative, reserving a future token
+	var delay time.Duration
+	if tb.tokens < 0 {
+		delay = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+
+	if delay > 0 {
+		debugf("spawn delayed %v by rate limit", delay)
+		time.Sleep(delay)
+	}
+}
+
+// startCommand starts cmd once allowed by spawnLimit, returning a function
+// to call with its final error once it has been waited on.
+func startCommand(cmd *exec.Cmd) (done func(error), _ error) {
+	spawnLimit.wait()
+	done = traceCommand(cmd)
+	if err := cmd.Start(); err != nil {
+		done(err)
+		return nil, err
+	}
+	return done, nil
 }
 
 // maybeRun is used to run consequential commands like "qm shutodown <vmid>"
@@ -442,14 +1443,27 @@ func init() {
 // like "qm config <vmid>".
 func maybeRun(args ...string) error {
 	if dryRun {
-		log.Printf("would run %q", args)
+		infof("would run %q", args)
+		scriptCommand(args...)
 		return nil
 	}
-	log.Printf("run %q", args)
+	infof("run %q", args)
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	stderr := captureStderr(cmd)
+	done, err := startCommand(cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	done(err)
+	if err != nil {
+		return commandError(cmd, stderr, err)
+	}
+	if msg := strings.TrimSpace(string(stderr.buf)); msg != "" {
+		warnf("%q: %v", args, msg)
+	}
+	return nil
 }
 
 func decodeJSONCommand(val interface{}, cmd *exec.Cmd) error {
@@ -457,21 +1471,24 @@ func decodeJSONCommand(val interface{}, cmd *exec.Cmd) error {
 	if err != nil {
 		return fmt.Errorf("failed to stdout pipe: %w", err)
 	}
+	stderr := captureStderr(cmd)
 
-	if err := cmd.Start(); err != nil {
+	done, err := startCommand(cmd)
+	if err != nil {
 		return fmt.Errorf("failed to start %q: %w", cmd.Args, err)
 	}
 
 	dec := json.NewDecoder(rc)
 	err = dec.Decode(val)
 	werr := cmd.Wait()
+	done(werr)
 
-	if err != nil {
-		return fmt.Errorf("failed to decode json from %q: %w", cmd.Args, err)
+	if werr != nil {
+		return commandError(cmd, stderr, werr)
 	}
 
-	if werr != nil {
-		return fmt.Errorf("%q failed: %w", cmd.Args, err)
+	if err != nil {
+		return fmt.Errorf("failed to decode json from %q: %w", cmd.Args, err)
 	}
 
 	return nil
@@ -528,8 +1545,10 @@ func recognizeCommand(
 }
 
 type cmdScanner struct {
-	cmd *exec.Cmd
-	err error
+	cmd    *exec.Cmd
+	err    error
+	done   func(error)
+	stderr *stderrBuffer
 	*bufio.Scanner
 }
 
@@ -588,7 +1607,10 @@ func (cmm *cmdMatcher) Scan() bool {
 func (csc *cmdScanner) Err() error {
 	err := csc.err
 	if err == nil && csc.Scanner != nil {
-		if err = csc.Scanner.Err(); err != nil {
+		if err = csc.Scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+			err = lineScanError(err)
+			csc.err = err
+		} else if err != nil {
 			err = fmt.Errorf("io error: %w", err)
 			csc.err = err
 		}
@@ -603,12 +1625,21 @@ func (csc *cmdScanner) Cleanup(errp *error) {
 		if isKillError(werr) {
 			werr = nil // expected from Process.Kill() above
 		}
+		if csc.done != nil {
+			csc.done(werr)
+			csc.done = nil
+		}
 		if err := csc.Err(); err == nil {
 			csc.err = werr
 		}
 	}
 	if err := csc.Err(); err != nil && errp != nil && *errp == nil {
-		*errp = fmt.Errorf("command %q failed: %w", csc.cmd.Args, err)
+		var xerr *exec.ExitError
+		if errors.As(err, &xerr) {
+			*errp = commandError(csc.cmd, csc.stderr, err)
+		} else {
+			*errp = fmt.Errorf("command %q failed: %w", csc.cmd.Args, err)
+		}
 	}
 }
 
@@ -636,10 +1667,11 @@ func (csc *cmdScanner) Scan() bool {
 				csc.err = err
 				return false
 			}
-			csc.Scanner = bufio.NewScanner(rc)
+			csc.Scanner = newLineScanner(rc)
+			csc.stderr = captureStderr(csc.cmd)
 		}
 
-		csc.err = csc.cmd.Start()
+		csc.done, csc.err = startCommand(csc.cmd)
 
 		if csc.err != nil {
 			return false
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecideAction(t *testing.T) {
+	newFakeHost(t)
+	defer func(prior string) { unknownState = prior }(unknownState)
+	unknownState = "deny"
+
+	self := vmInfo{
+		listRec:   listRec{id: "101", name: "gaming", status: "stopped"},
+		config:    vmConfig{},
+		resources: []string{"hostpci:0000:01:00"},
+		state:     "stopped",
+	}
+	mutual := func(state string, conf vmConfig) vmInfo {
+		return vmInfo{
+			listRec:   listRec{id: "102", name: "work", status: "running"},
+			config:    conf,
+			resources: []string{"hostpci:0000:01:00"},
+			state:     state,
+		}
+	}
+	rule := func(text string) []policyRule {
+		r, err := parseRule(text)
+		if err != nil {
+			t.Fatalf("invalid rule %q: %v", text, err)
+		}
+		return []policyRule{r}
+	}
+	denyWindow := &blackoutWindow{text: "* 00:00-00:00", action: "deny"}
+	queueWindow := &blackoutWindow{text: "* 00:00-00:00", action: "queue"}
+
+	for _, tc := range []struct {
+		name     string
+		mutual   vmInfo
+		policy   string
+		rules    []policyRule
+		blackout *blackoutWindow
+		action   string
+		ask      bool
+		denied   bool
+	}{
+		{name: "running", mutual: mutual("running", nil), policy: "preempt", action: actionShutdown},
+		{name: "stopped", mutual: mutual("stopped", nil), policy: "preempt", action: actionNone},
+		{name: "paused", mutual: mutual("paused", nil), policy: "preempt", action: actionResume},
+		{name: "queue policy", mutual: mutual("running", nil), policy: "queue", action: actionWait},
+		{name: "ask policy", mutual: mutual("running", nil), policy: "ask", action: actionShutdown, ask: true},
+		{name: "unknown state", mutual: mutual("migrating", nil), policy: "preempt", action: actionDeny, denied: true},
+		{name: "protected", mutual: mutual("running", vmConfig{"protection": "1"}), policy: "preempt", action: actionDeny, denied: true},
+
+		{name: "ignore rule on unknown state",
+			mutual: mutual("migrating", nil), policy: "preempt",
+			rules:  rule("when target.id == 102 then ignore"),
+			action: actionIgnore},
+		{name: "queue rule on unknown state",
+			mutual: mutual("migrating", nil), policy: "preempt",
+			rules:  rule("when target.id == 102 then queue"),
+			action: actionWait},
+		{name: "ignore rule on protected",
+			mutual: mutual("running", vmConfig{"protection": "1"}), policy: "preempt",
+			rules:  rule("when target.id == 102 then ignore"),
+			action: actionIgnore},
+		{name: "preempt rule on protected",
+			mutual: mutual("running", vmConfig{"protection": "1"}), policy: "preempt",
+			rules:  rule("when target.id == 102 then preempt"),
+			action: actionDeny, denied: true},
+		{name: "unmatched rule",
+			mutual: mutual("migrating", nil), policy: "preempt",
+			rules:  rule("when target.id == 103 then ignore"),
+			action: actionDeny, denied: true},
+		{name: "deny rule",
+			mutual: mutual("running", nil), policy: "preempt",
+			rules:  rule("when resource matches hostpci:* then deny"),
+			action: actionDeny, denied: true},
+		{name: "preempt rule under ask policy",
+			mutual: mutual("running", nil), policy: "ask",
+			rules:  rule("when target.id == 102 then preempt"),
+			action: actionShutdown},
+
+		{name: "blackout", mutual: mutual("running", nil), policy: "preempt", blackout: denyWindow, action: actionDeny, denied: true},
+		{name: "queueing blackout", mutual: mutual("running", nil), policy: "preempt", blackout: queueWindow, action: actionWait},
+		{name: "blackout of stopped", mutual: mutual("stopped", nil), policy: "preempt", blackout: denyWindow, action: actionNone},
+		{name: "blackout of ignored",
+			mutual: mutual("running", nil), policy: "preempt", blackout: denyWindow,
+			rules:  rule("when target.id == 102 then ignore"),
+			action: actionIgnore},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			action, ask, denial := decideAction(self, tc.mutual, tc.policy, tc.rules, tc.blackout)
+			if action != tc.action {
+				t.Errorf("got action %q, want %q", action, tc.action)
+			}
+			if ask != tc.ask {
+				t.Errorf("got ask %v, want %v", ask, tc.ask)
+			}
+			if denied := denial != nil; denied != tc.denied {
+				t.Errorf("got denial %v, want denied %v", denial, tc.denied)
+			}
+		})
+	}
+}
+
+func TestHostResourceLabels(t *testing.T) {
+	h := newFakeHost(t)
+	h.addPCI("0000:01:00.0", "12")
+	defer func(prior string) { sharedDirs = prior }(sharedDirs)
+	sharedDirs = "exclusive"
+
+	for _, tc := range []struct {
+		key, value string
+		labels     []string
+	}{
+		{"hostpci0", "0000:01:00,pcie=1,x-vga=1", []string{"hostpci:0000:01:00"}},
+		{"hostpci1", "01:00.1", []string{"hostpci:0000:01:00"}},
+		{"hostpci2", "02:00.0;03:00.0,pcie=1", []string{"hostpci:0000:02:00", "hostpci:0000:03:00"}},
+		{"hostpci3", "0000:01:00.0,mdev=nvidia-63", []string{"hostpci:0000:01:00/nvidia-63"}},
+		{"hostpci4", "mapping=gpu", []string{"hostpci:mapping=gpu"}},
+		{"usb0", "host=1a86:7523,usb3=1", []string{"hostusb:1a86:7523"}},
+		{"usb1", "host=1-1.2", []string{"hostusb:1-1.2"}},
+		{"usb2", "spice", nil},
+		{"args", "-device vfio-pci,host=0000:04:00.0 -device usb-host,vendorid=0x1a86,productid=0x7523",
+			[]string{"hostpci:0000:04:00", "hostusb:1a86:7523"}},
+		{"args", "-virtfs local,path=/srv/share/,mount_tag=share", []string{"hostdir:/srv/share"}},
+		{"virtiofs0", "share,cache=always", []string{"hostdir:mapping=share"}},
+		{"virtiofs1", "dirid=media", []string{"hostdir:mapping=media"}},
+		{"net0", "virtio=BC:24:11:00:00:01,bridge=vmbr0", nil},
+		{"scsi0", "local-lvm:vm-101-disk-0,size=32G", nil},
+	} {
+		got := hostResourceLabels(tc.key, tc.value)
+		if strings.Join(got, " ") != strings.Join(tc.labels, " ") {
+			t.Errorf("hostResourceLabels(%q, %q) = %q, want %q", tc.key, tc.value, got, tc.labels)
+		}
+	}
+}
+
+func TestScanVMs(t *testing.T) {
+	h := newFakeHost(t)
+	h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00,pcie=1", "usb0: host=1a86:7523")
+	h.addVM("102", "running", "name: work", "hostpci0: 01:00.0")
+	h.addVM("103", "running", "name: lab", "usb0: host=1a86:7523", "description: a long story")
+	h.setQemuStatus("103", "paused")
+	h.addVM("104", "stopped", "name: idle", "vmstate: local:state-suspend")
+
+	vms, err := scanVMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		id, name, state, resources string
+	}{
+		{"101", "gaming", "stopped", "hostpci:0000:01:00 hostusb:1a86:7523"},
+		{"102", "work", "running", "hostpci:0000:01:00"},
+		{"103", "lab", "paused", "hostusb:1a86:7523"},
+		{"104", "idle", "hibernated", ""},
+	} {
+		vm := findVM(vms, want.id)
+		if vm == nil {
+			t.Errorf("missing vm #%v", want.id)
+			continue
+		}
+		if vm.name != want.name || vm.state != want.state || strings.Join(vm.resources, " ") != want.resources {
+			t.Errorf("got vm #%v %q %v with %q, want %q %v with %q",
+				vm.id, vm.name, vm.state, vm.resources, want.name, want.state, want.resources)
+		}
+		if _, ok := vm.config["description"]; ok {
+			t.Errorf("vm #%v kept its description", vm.id)
+		}
+	}
+	if len(vms) != 4 {
+		t.Errorf("got %v vms, want 4", len(vms))
+	}
+	if got := vmIDs(mutualsOf("101", vms)); strings.Join(got, " ") != "102 103" {
+		t.Errorf("got mutuals of 101 %q, want 102 103", got)
+	}
+}
+
+func TestScanWorkers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("scans a hundred VMs thru the stub qm")
+	}
+	const n = benchVMs / 5
+	h := newFakeHost(t)
+	addBenchVMs(h, n)
+	defer func(prior int) { scanWorkers = prior }(scanWorkers)
+
+	scan := func(workers int) ([]vmInfo, error) {
+		h.resetCaches()
+		scanWorkers = workers
+		return scanVMs()
+	}
+	want, err := scan(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != n {
+		t.Fatalf("got %v vms, want %v", len(want), n)
+	}
+	for _, workers := range []int{0, 2, 8, 32, 2 * n} {
+		t.Run(fmt.Sprint(workers, " workers"), func(t *testing.T) {
+			got, err := scan(workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got a different scan than from 1 worker")
+			}
+		})
+	}
+
+	// a VM whose config can't be read fails the scan, at any parallelism,
+	// rather than hanging or leaving it out
+	h.failCommand("142", "config", "unable to parse config")
+	for _, workers := range []int{1, 32} {
+		if _, err := scan(workers); err == nil {
+			t.Errorf("got no error scanning with %v workers, and a config missing", workers)
+		}
+	}
+}
+
+func TestStopMutuals(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		status   string // of the mutual, or its qemu status if running
+		stopped  bool
+		exitCode int
+	}{
+		{name: "running", status: "running", stopped: true},
+		{name: "stopped", status: "stopped"},
+		{name: "unknown state", config: "unknown-state = deny\n", status: "migrating", exitCode: exitDenied},
+		{name: "unknown state ignored by rule",
+			config: "unknown-state = deny\n[rules]\nwhen target.id == 102 then ignore\n",
+			status: "migrating"},
+		{name: "denied by rule", config: "[rules]\nwhen target.tag == prod then deny\n",
+			status: "running", exitCode: exitDenied},
+		{name: "blacked out", config: "[blackout]\n* 00:00-00:00\n", status: "running", exitCode: exitDenied},
+		{name: "queued", config: "policy = queue\n", status: "stopped"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			h.setConfig(tc.config)
+			h.addVM("101", "stopped", "name: gaming", "hostpci0: 0000:01:00")
+			if tc.status == "stopped" {
+				h.addVM("102", "stopped", "name: work", "tags: prod", "hostpci0: 0000:01:00")
+			} else {
+				h.addVM("102", "running", "name: work", "tags: prod", "hostpci0: 0000:01:00")
+				h.setQemuStatus("102", tc.status)
+			}
+			h.addVM("103", "running", "name: other", "hostpci0: 0000:02:00")
+
+			err := stopMutuals("101")
+			if code := exitCode(err); code != tc.exitCode {
+				t.Fatalf("got exit code %v, want %v, from error %v", code, tc.exitCode, err)
+			}
+			if stopped := h.ran("qm shutdown 102") || h.ran("qm stop 102"); stopped != tc.stopped {
+				t.Errorf("got mutual stopped %v, want %v, by commands:\n%v", stopped, tc.stopped, strings.Join(h.commands(), "\n"))
+			}
+			if h.ran("qm shutdown 103") || h.ran("qm stop 103") {
+				t.Errorf("stopped vm #103, which is no mutual")
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// preemptPolicy decides what the hook does about running mutuals:
+//   - preempt shuts them down
+//   - queue waits for them to stop on their own, granting leases over each
+//     contended resource to waiting VMs in FIFO order
+//   - ask shuts them down only once approved; see awaitApproval
+var preemptPolicy = "preempt"
+
+var preemptPolicies = []string{"preempt", "queue", "ask"}
+
+// queueWait is how long the queue policy waits for a lease before denying
+// the start.
+var queueWait = 10 * time.Minute
+
+// queuePoll is how often the queue policy checks for its lease.
+const queuePoll = 2 * time.Second
+
+// leaseHold is how long a granted lease is held for a VM that has yet to
+// finish starting; it's released early once the VM has started.
+const leaseHold = 2 * time.Minute
+
+func init() {
+	flag.Var(choiceFlag{&preemptPolicy, preemptPolicies},
+		"policy", "what to do about running mutuals: preempt, queue to wait for them, or ask for approval to preempt")
+	flag.DurationVar(&queueWait, "queue-wait", queueWait, "how long the queue policy waits before denying a start")
+	vmSettings["policy"] = "policy when starting this VM: preempt, queue, or ask"
+}
+
+// policyFor returns the preempt policy for starting the given VM.
+func policyFor(vm vmInfo) (string, error) {
+	if val, ok := vm.setting("policy"); ok {
+		if !hasString(val, preemptPolicies) {
+			return "", fmt.Errorf("vm #%v: invalid policy %q", vm.id, val)
+		}
+		return val, nil
+	}
+	return preemptPolicy, nil
+}
+
+type queueEntry struct {
+	VMID  string    `json:"vmid"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// awaitLease waits for all of self's mutuals to stop on their own, queueing
+// for every resource shared with them; the start is granted once no mutual is
+// running, and self is first in line for every contended resource. If that
+// doesn't happen within queueWait, the start is denied.
+func awaitLease(self vmInfo, mutualVMs []vmInfo) error {
+	labels := contendedResources(self, mutualVMs)
+
+	if dryRun {
+		infof("would wait up to %v for mutuals to stop, queued for %v", queueWait, strings.Join(labels, ", "))
+		return nil
+	}
+
+	now := time.Now()
+	deadline := now.Add(queueWait)
+	if err := updateState(func(st *state) error {
+		st.pruneQueue(now)
+		if st.Queue == nil {
+			st.Queue = make(map[string][]queueEntry)
+		}
+		for _, label := range labels {
+			st.Queue[label] = append(st.Queue[label], queueEntry{self.id, now, deadline})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	granted := false
+	defer func() {
+		if err := updateState(func(st *state) error {
+			st.dequeue(self.id)
+			if granted {
+				if st.Leases == nil {
+					st.Leases = make(map[string]queueEntry)
+				}
+				now := time.Now()
+				for _, label := range labels {
+					st.Leases[label] = queueEntry{self.id, now, now.Add(leaseHold)}
+				}
+			}
+			return nil
+		}); err != nil {
+			warnf("unable to leave queue: %v", err)
+		}
+	}()
+
+	lastWaiting := ""
+	for {
+		recs, err := listVMs()
+		if err != nil {
+			return err
+		}
+		var holders []string
+		for _, rec := range recs {
+			for _, vm := range mutualVMs {
+				if rec.id == vm.id && rec.status == "running" {
+					holders = append(holders, "#"+rec.id)
+				}
+			}
+		}
+
+		st, err := readState()
+		if err != nil {
+			return err
+		}
+		for _, label := range labels {
+			lease, has := st.Leases[label]
+			if has && lease.VMID != self.id && time.Now().Before(lease.Until) &&
+				!hasString("#"+lease.VMID, holders) {
+				holders = append(holders, "#"+lease.VMID)
+			}
+		}
+		var ahead []string
+		for _, label := range labels {
+			for _, ent := range st.Queue[label] {
+				if ent.VMID == self.id {
+					break
+				}
+				if !hasString("#"+ent.VMID, ahead) {
+					ahead = append(ahead, "#"+ent.VMID)
+				}
+			}
+		}
+
+		if len(holders) == 0 && len(ahead) == 0 {
+			granted = true
+			recordEvent(event{Kind: kindLease, VMID: self.id, Took: time.Since(now).Seconds()})
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("mutual vm %v still running after waiting %v", strings.Join(holders, ", "), queueWait)
+			if len(holders) == 0 {
+				err = fmt.Errorf("vm %v still queued ahead after waiting %v", strings.Join(ahead, ", "), queueWait)
+			}
+			return withExitCode(exitDenied, recordDenial(self.id, err))
+		}
+
+		waiting := fmt.Sprintf("waiting for mutual vm %v to release", strings.Join(holders, ", "))
+		if len(holders) == 0 {
+			waiting = fmt.Sprintf("waiting behind vm %v in queue", strings.Join(ahead, ", "))
+		}
+		if waiting != lastWaiting {
+			// printed to stdout so that it shows in the proxmox start task log
+			fmt.Println(waiting)
+			lastWaiting = waiting
+		}
+		time.Sleep(queuePoll)
+	}
+}
+
+// contendedResources returns all resource labels that self shares with any of
+// its mutuals.
+func contendedResources(self vmInfo, mutualVMs []vmInfo) (labels []string) {
+	for _, vm := range mutualVMs {
+		for _, label := range sharedResources(self.resources, vm.resources) {
+			if !hasString(label, labels) {
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
+// anyQueued returns true if any VM is already queued for a resource that self
+// shares with its mutuals, in which case self must queue behind it, even if no
+// mutual is currently running.
+func anyQueued(self vmInfo, mutualVMs []vmInfo) (bool, error) {
+	st, err := readState()
+	if err != nil {
+		return false, err
+	}
+	st.pruneQueue(time.Now())
+	for _, label := range contendedResources(self, mutualVMs) {
+		if len(st.Queue[label]) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseLeases releases any leases granted to a VM, once it has started.
+func releaseLeases(vmid string) error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	held := false
+	for _, lease := range st.Leases {
+		held = held || lease.VMID == vmid
+	}
+	if !held {
+		return nil
+	}
+	return updateState(func(st *state) error {
+		for label, lease := range st.Leases {
+			if lease.VMID == vmid {
+				delete(st.Leases, label)
+			}
+		}
+		return nil
+	})
+}
+
+// pruneQueue drops queue entries and leases well past their deadline, left
+// behind by any hook run that died while waiting, or VM that failed to start.
+func (st *state) pruneQueue(now time.Time) {
+	for label, lease := range st.Leases {
+		if now.After(lease.Until) {
+			delete(st.Leases, label)
+		}
+	}
+	for label, ents := range st.Queue {
+		kept := ents[:0]
+		for _, ent := range ents {
+			if now.Before(ent.Until.Add(time.Minute)) {
+				kept = append(kept, ent)
+			}
+		}
+		if len(kept) == 0 {
+			delete(st.Queue, label)
+		} else {
+			st.Queue[label] = kept
+		}
+	}
+}
+
+// dequeue removes all of a VM's queue entries.
+func (st *state) dequeue(vmid string) {
+	for label, ents := range st.Queue {
+		kept := ents[:0]
+		for _, ent := range ents {
+			if ent.VMID != vmid {
+				kept = append(kept, ent)
+			}
+		}
+		if len(kept) == 0 {
+			delete(st.Queue, label)
+		} else {
+			st.Queue[label] = kept
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// runReconcile converges hooks with VM configs, without init's install step:
+// it hooks VMs that newly pass thru exclusive host resources, unhooks any that
+// no longer do, forgets state kept for VMs that no longer exist, and responds
+// to any mutuals running together, as set by onViolation. It's meant to be run periodically, so it's quiet
+// unless it changes something or finds a problem.
+func runReconcile(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: reconcile"))
+	}
+
+	snippetStore, storeDir, err := findSnippets()
+	if err != nil {
+		return err
+	}
+	stubPath := path.Join(storeDir, "snippets", hookCmdName)
+	if _, err := os.Stat(stubPath); err != nil {
+		return withExitCode(exitEnvironment, fmt.Errorf("no hook snippet installed, run qmexmut init first: %w", err))
+	}
+	if detail := checkStub(stubPath); detail != "" {
+		warnf("%v", detail)
+	}
+	hookScript := fmt.Sprintf("%s:snippets/%s", snippetStore, hookCmdName)
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+
+	quiet, err := establishRegistry()
+	if err != nil {
+		return err
+	}
+
+	runSum := newRunSummary("reconcile")
+	changed, failed := 0, 0
+	for _, vm := range vms {
+		exclusive := len(exclusiveResources(vm.resources)) > 0
+		hooked := isOurHook(vm.config["hookscript"])
+		switch {
+		case exclusive && !hooked:
+			ok, err := hookVM(vm.id, hookScript)
+			if err != nil {
+				errorf("failed to hook vm #%v: %v", vm.id, err)
+				runSum.Failed = append(runSum.Failed, vm.id)
+				failed++
+			} else if ok {
+				infof("hooked vm #%v", vm.id)
+				runSum.Hooked = append(runSum.Hooked, vm.id)
+				changed++
+			}
+		case !exclusive && hooked:
+			if err := unhookAndForget(vm.id, vm.config); err != nil {
+				errorf("failed to unhook vm #%v: %v", vm.id, err)
+				runSum.Failed = append(runSum.Failed, vm.id)
+				failed++
+			} else {
+				infof("unhooked vm #%v, which passes thru no exclusive host resources", vm.id)
+				runSum.Unhooked = append(runSum.Unhooked, vm.id)
+				changed++
+			}
+		case exclusive:
+			adopted, err := adoptHooked(vm.id, vm.config, quiet)
+			if err != nil {
+				errorf("failed to register vm #%v: %v", vm.id, err)
+				failed++
+				continue
+			}
+			if adopted {
+				warnf("%v", describeAdopted(vm.id, vm.config))
+				// a clone inherits tags too, so it'd seem to have been preempted
+				if err := markStoppedBy(vm, ""); err != nil {
+					errorf("failed to clear vm #%v stopped-by tag: %v", vm.id, err)
+				}
+				changed++
+			}
+			runSum.Compliant = append(runSum.Compliant, vm.id)
+		default:
+			runSum.Skipped = append(runSum.Skipped, vm.id)
+		}
+	}
+
+	var gone []string
+	for _, id := range st.vmids() {
+		if findVM(vms, id) == nil {
+			gone = append(gone, id)
+		}
+	}
+	if len(gone) > 0 {
+		if err := updateState(func(st *state) error {
+			for _, id := range gone {
+				st.forget(id)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		infof("forgot state of removed vm(s) %v", gone)
+		changed++
+	}
+
+	if err := rollbackFailedStarts(""); err != nil {
+		errorf("failed to rollback failed starts: %v", err)
+		failed++
+	}
+
+	violations, err := checkViolations(vms)
+	if err != nil {
+		errorf("failed to remedy violation: %v", err)
+		failed++
+	}
+	if violations > 0 {
+		changed++
+	}
+
+	if changed > 0 || failed > 0 {
+		recordEvent(event{Kind: kindReconcile})
+		sendRunSummary(runSum)
+	} else {
+		debugf("reconcile found nothing to change")
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to reconcile %v vm(s)", failed)
+	}
+	return nil
+}
+
+// vmids returns the ids of all VMs that the state keeps anything for.
+func (st state) vmids() (ids []string) {
+	add := func(id string) {
+		if id != "" && !hasString(id, ids) {
+			ids = append(ids, id)
+		}
+	}
+	for _, entries := range st.Queue {
+		for _, ent := range entries {
+			add(ent.VMID)
+		}
+	}
+	for _, lease := range st.Leases {
+		add(lease.VMID)
+	}
+	for id := range st.Starts {
+		add(id)
+	}
+	for id := range st.Chains {
+		add(id)
+	}
+	for id := range st.Hookscripts {
+		add(id)
+	}
+	for id := range st.Managed {
+		add(id)
+	}
+	return ids
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resourceSnapshot records the resources and mutuals of every VM as of the
+// last rescan, so that the next can tell what changed.
+type resourceSnapshot struct {
+	Time      time.Time           `json:"time"`
+	Resources map[string][]string `json:"resources"`
+	Mutuals   map[string][]string `json:"mutuals"`
+}
+
+func snapshotPath() string {
+	return filepath.Join(stateDir, "resources.json")
+}
+
+// runRescan rereads every VM config, ignoring the config cache, and resolves
+// their host resources anew, like after a hardware change; it prints how
+// each VM's resources and mutuals changed since the last rescan.
+func runRescan(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: rescan"))
+	}
+
+	configCache.Lock()
+	configCache.loaded = true
+	configCache.entries = make(map[string]cachedConfig)
+	configCache.dirty = true
+	configCache.Unlock()
+	resetHostCaches()
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	snap := resourceSnapshot{
+		Time:      time.Now(),
+		Resources: make(map[string][]string, len(vms)),
+		Mutuals:   make(map[string][]string, len(vms)),
+	}
+	for _, vm := range vms {
+		snap.Resources[vm.id] = vm.resources
+		snap.Mutuals[vm.id] = vmIDs(mutualsOf(vm.id, vms))
+	}
+
+	var prior resourceSnapshot
+	data, err := os.ReadFile(snapshotPath())
+	if err == nil {
+		err = json.Unmarshal(data, &prior)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		infof("rescanned %v vm(s), with no prior rescan to compare to", len(vms))
+	} else if err != nil {
+		warnf("ignoring prior rescan: %v", err)
+	} else if err := printRescanChanges(prior, snap); err != nil {
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+	if data, err = json.MarshalIndent(snap, "", "  "); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	tmp := snapshotPath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, snapshotPath())
+}
+
+func printRescanChanges(prior, snap resourceSnapshot) error {
+	ids := vmIDsOf(prior.Resources)
+	for _, id := range vmIDsOf(snap.Resources) {
+		if !hasString(id, ids) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return vmidLess(ids[i], ids[j]) })
+
+	var tab table
+	tab.header("VMID", "CHANGE", "DETAIL")
+	for _, id := range ids {
+		before, had := prior.Resources[id]
+		after, has := snap.Resources[id]
+		switch {
+		case !had:
+			tab.add(plain(id), colored(colorYellow, "new vm"), plain(describeDevices(after)))
+		case !has:
+			tab.add(plain(id), colored(colorYellow, "removed vm"), plain(""))
+		}
+		if added := missingFrom(after, before); had && len(added) > 0 {
+			tab.add(plain(id), plain("added resource"), plain(describeDevices(added)))
+		}
+		if removed := missingFrom(before, after); has && len(removed) > 0 {
+			tab.add(plain(id), plain("removed resource"), plain(describeDevices(removed)))
+		}
+		if gained := missingFrom(snap.Mutuals[id], prior.Mutuals[id]); len(gained) > 0 {
+			tab.add(plain(id), colored(colorRed, "new mutual"), plain("#"+strings.Join(gained, ", #")))
+		}
+		if lost := missingFrom(prior.Mutuals[id], snap.Mutuals[id]); len(lost) > 0 {
+			tab.add(plain(id), colored(colorGreen, "no longer mutual"), plain("#"+strings.Join(lost, ", #")))
+		}
+	}
+	if len(tab.rows) == 1 {
+		infof("nothing changed since the last rescan at %v", prior.Time.Format(time.RFC3339))
+		return nil
+	}
+	fmt.Printf("since the last rescan at %v:\n", prior.Time.Format(time.RFC3339))
+	return printTable(&tab)
+}
+
+// missingFrom returns the strings of a missing from b.
+func missingFrom(a, b []string) (missing []string) {
+	for _, s := range a {
+		if !hasString(s, b) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func vmIDsOf(m map[string][]string) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type reservation struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by,omitempty"`
+}
+
+// runReserve reserves host resources, by label or all those passed thru by a
+// VM, for maintenance; while reserved, starting any VM that passes thru them
+// is denied. With no arguments, it lists current reservations.
+func runReserve(args []string) error {
+	flags := flag.NewFlagSet("reserve", flag.ContinueOnError)
+	dur := flags.Duration("for", time.Hour, "how long to reserve for")
+	reason := flags.String("reason", "", "reason for the reservation, shown when denying starts")
+	args, err := parseInterspersed(flags, args)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if len(args) == 0 {
+		return listReservations()
+	}
+
+	labels, err := resolveResources(args)
+	if err != nil {
+		return err
+	}
+
+	res := reservation{
+		Until:  time.Now().Add(*dur),
+		Reason: *reason,
+		By:     os.Getenv("SUDO_USER"),
+	}
+	if res.By == "" {
+		res.By = os.Getenv("USER")
+	}
+
+	if err := updateState(func(st *state) error {
+		if st.Reservations == nil {
+			st.Reservations = make(map[string]reservation)
+		}
+		for label, old := range st.Reservations {
+			if time.Now().After(old.Until) {
+				delete(st.Reservations, label)
+			}
+		}
+		for _, label := range labels {
+			st.Reservations[label] = res
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, label := range labels {
+		infof("reserved %v until %v", label, res.Until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// runUnreserve releases reservations made by runReserve before they expire.
+func runUnreserve(args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: unreserve <resource|vmid>..."))
+	}
+	labels, err := resolveResources(args)
+	if err != nil {
+		return err
+	}
+	return updateState(func(st *state) error {
+		for _, label := range labels {
+			if _, has := st.Reservations[label]; has {
+				delete(st.Reservations, label)
+				infof("released reservation of %v", label)
+			}
+		}
+		return nil
+	})
+}
+
+func listReservations() error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	labels := make([]string, 0, len(st.Reservations))
+	for label := range st.Reservations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	now := time.Now()
+	var tab table
+	tab.header("RESOURCE", "UNTIL", "BY", "REASON")
+	for _, label := range labels {
+		res := st.Reservations[label]
+		until := colored(colorRed, res.Until.Format(time.RFC3339))
+		if now.After(res.Until) {
+			until = plain("expired")
+		}
+		tab.add(plain(label), until, plain(res.By), plain(res.Reason))
+	}
+	return printTable(&tab)
+}
+
+// resolveResources resolves arguments that are either resource labels or
+// their aliases, or VMIDs standing for all resources passed thru by that VM.
+func resolveResources(args []string) (labels []string, _ error) {
+	for _, arg := range args {
+		if label, ok := aliasLabel(arg); ok {
+			labels = append(labels, label)
+			continue
+		}
+		if strings.ContainsRune(arg, ':') {
+			labels = append(labels, canonicalLabel(arg))
+			continue
+		}
+		conf, err := readVMConfig(arg)
+		if err != nil {
+			return nil, err
+		}
+		reses := conf.hostResources()
+		if len(reses) == 0 {
+			return nil, fmt.Errorf("vm #%v passes thru no host resources", arg)
+		}
+		labels = append(labels, reses...)
+	}
+	return labels, nil
+}
+
+// checkReservations denies starting a VM that passes thru any resource that
+// is currently reserved.
+func checkReservations(self vmInfo) error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, label := range self.resources {
+		res, has := st.Reservations[label]
+		if !has || now.After(res.Until) {
+			continue
+		}
+		msg := fmt.Sprintf("%v is reserved until %v", displayLabel(label), res.Until.Format(time.RFC3339))
+		if res.By != "" {
+			msg += " by " + res.By
+		}
+		if res.Reason != "" {
+			msg += ": " + res.Reason
+		}
+		return withExitCode(exitDenied, recordDenial(self.id, errors.New(msg)))
+	}
+	return nil
+}
+
+// parseInterspersed parses flags that may be given before, after, or between
+// positional arguments, returning the positional arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) (pos []string, _ error) {
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return pos, nil
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// resultTrailer ends stderr with a machine readable result line, so that
+// the side running us remotely needn't parse our output.
+var resultTrailer = false
+
+func init() {
+	flag.BoolVar(&resultTrailer, "result-trailer", false, "end stderr with a machine readable result line, for remote runs")
+}
+
+// resultTrailerPrefix starts the result trailer line.
+const resultTrailerPrefix = "qmexmut-result: "
+
+// runResult is the result of a run, as given in its result trailer.
+type runResult struct {
+	ExitCode  int      `json:"exit_code"`
+	Error     string   `json:"error,omitempty"`
+	Errors    []string `json:"errors,omitempty"` // logged as errors
+	Hooked    *int     `json:"hooked,omitempty"`
+	Skipped   *int     `json:"skipped,omitempty"`
+	Failed    *int     `json:"failed,omitempty"`
+	HookedVMs []string `json:"hooked_vms,omitempty"`
+}
+
+// result accumulates the result of this run, for any result trailer.
+var result struct {
+	sync.Mutex
+	runResult
+}
+
+// noteResultError notes an error logged during this run.
+func noteResultError(msg string) {
+	if !resultTrailer {
+		return
+	}
+	result.Lock()
+	defer result.Unlock()
+	result.Errors = append(result.Errors, msg)
+}
+
+// noteInitResult notes the outcome of init.
+func noteInitResult(prog *initProgress, hookedVMs []string) {
+	result.Lock()
+	defer result.Unlock()
+	hooked, skipped, failed := int(prog.hooked), int(prog.skipped), int(prog.failed)
+	result.Hooked, result.Skipped, result.Failed = &hooked, &skipped, &failed
+	result.HookedVMs = append([]string(nil), hookedVMs...)
+	sort.Slice(result.HookedVMs, func(i, j int) bool {
+		return vmidLess(result.HookedVMs[i], result.HookedVMs[j])
+	})
+}
+
+// writeResultTrailer writes any result trailer for the error returned by run.
+func writeResultTrailer(err error) {
+	if !resultTrailer {
+		return
+	}
+	result.Lock()
+	defer result.Unlock()
+	result.ExitCode = exitCode(err)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	data, jerr := json.Marshal(result.runResult)
+	if jerr != nil {
+		data = []byte(fmt.Sprintf(`{"exit_code":%v}`, result.ExitCode))
+	}
+	fmt.Fprintf(os.Stderr, "%v%s\n", resultTrailerPrefix, data)
+}
+
+// trailerFilter passes lines thru to w, except for any result trailer, which
+// it decodes.
+type trailerFilter struct {
+	w      io.Writer
+	buf    []byte
+	result *runResult
+}
+
+func (tf *trailerFilter) Write(p []byte) (int, error) {
+	tf.buf = append(tf.buf, p...)
+	for {
+		i := bytes.IndexByte(tf.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := tf.buf[:i+1]
+		if bytes.HasPrefix(line, []byte(resultTrailerPrefix)) {
+			var res runResult
+			if err := json.Unmarshal(line[len(resultTrailerPrefix):], &res); err == nil {
+				tf.result = &res
+			} else {
+				warnf("invalid remote result: %v", err)
+			}
+		} else if _, err := tf.w.Write(line); err != nil {
+			return 0, err
+		}
+		tf.buf = tf.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes any final partial line.
+func (tf *trailerFilter) flush() error {
+	if len(tf.buf) == 0 {
+		return nil
+	}
+	_, err := tf.w.Write(tf.buf)
+	tf.buf = nil
+	return err
+}
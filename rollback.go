@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rollbackAfter is how long a VM that preempted mutuals has to finish
+// starting before its start is deemed failed, and its mutuals restarted.
+var rollbackAfter = 2 * time.Minute
+
+func init() {
+	flag.DurationVar(&rollbackAfter, "rollback-after", rollbackAfter, "restart preempted mutuals if the VM that stopped them hasn't started after this long")
+}
+
+// pendingStart records the intent of a VM to preempt mutuals in order to
+// start, written before any are stopped, until the VM has started; if the
+// hook is interrupted while preempting, or the start fails, it tells which
+// mutuals to restart.
+type pendingStart struct {
+	Time      time.Time `json:"time"`
+	Stopped   []string  `json:"stopped"`
+	Resources []string  `json:"resources,omitempty"`
+
+	// PID is that of the hook run preempting mutuals, and Acted is set once
+	// it's done; an intent not acted upon by a hook that's gone was
+	// interrupted.
+	PID   int  `json:"pid,omitempty"`
+	Acted bool `json:"acted,omitempty"`
+}
+
+// recordStartIntent notes that self is about to stop mutuals in order to
+// start, so that they may be restarted if it's interrupted, or fails to start.
+func recordStartIntent(self vmInfo, stopping []vmInfo) {
+	if len(stopping) == 0 {
+		return
+	}
+	var ids, resources []string
+	for _, vm := range stopping {
+		ids = append(ids, vm.id)
+		for _, label := range sharedResources(self.resources, vm.resources) {
+			if !hasString(label, resources) {
+				resources = append(resources, label)
+			}
+		}
+	}
+	debugf("intent: starting vm #%v, stopping %v for %v", self.id, strings.Join(ids, ","), describeDevices(resources))
+	if err := updateState(func(st *state) error {
+		if st.Starts == nil {
+			st.Starts = make(map[string]pendingStart)
+		}
+		ps := st.Starts[self.id]
+		ps.Time = time.Now()
+		ps.PID = os.Getpid()
+		ps.Acted = false
+		for _, id := range ids {
+			if !hasString(id, ps.Stopped) {
+				ps.Stopped = append(ps.Stopped, id)
+			}
+		}
+		for _, label := range resources {
+			if !hasString(label, ps.Resources) {
+				ps.Resources = append(ps.Resources, label)
+			}
+		}
+		st.Starts[self.id] = ps
+		return nil
+	}); err != nil {
+		warnf("unable to record start intent: %v", err)
+	}
+}
+
+// markStartActed notes that self is done preempting mutuals, and so has only
+// to finish starting.
+func markStartActed(id string) {
+	if err := updateState(func(st *state) error {
+		if ps, ok := st.Starts[id]; ok {
+			ps.Time = time.Now()
+			ps.Acted = true
+			st.Starts[id] = ps
+		}
+		return nil
+	}); err != nil {
+		warnf("unable to record start intent: %v", err)
+	}
+}
+
+// interrupted returns true if the hook run that recorded a start intent is
+// gone without having acted on it.
+func (ps pendingStart) interrupted() bool {
+	if ps.Acted || ps.PID == 0 || ps.PID == os.Getpid() {
+		return false
+	}
+	err := syscall.Kill(ps.PID, 0)
+	return errors.Is(err, syscall.ESRCH)
+}
+
+// claimPendingStarts removes and returns the ids of VMs with pending starts
+// that match the given predicate.
+func claimPendingStarts(match func(id string, ps pendingStart) bool) (ids []string, _ error) {
+	return ids, updateState(func(st *state) error {
+		for id, ps := range st.Starts {
+			if match(id, ps) {
+				ids = append(ids, id)
+				delete(st.Starts, id)
+			}
+		}
+		return nil
+	})
+}
+
+// finishStart clears any pending start once a VM has started.
+func finishStart(id string) error {
+	_, err := claimPendingStarts(func(pid string, _ pendingStart) bool { return pid == id })
+	return err
+}
+
+// rollbackStart restarts any mutuals that the given VM stopped, after its
+// start failed.
+func rollbackStart(id string) error {
+	ids, err := claimPendingStarts(func(pid string, _ pendingStart) bool { return pid == id })
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	infof("start of vm #%v failed, restarting mutuals that it stopped", id)
+	return restartPreempted(id, kindRollback)
+}
+
+// rollbackFailedStarts rolls back any pending starts, other than that of the
+// given VM, either interrupted, or acted upon longer than rollbackAfter ago,
+// whose VM isn't running;
+// this is checked on every hook run, since proxmox doesn't run any hook phase
+// when qemu fails to start.
+func rollbackFailedStarts(except string) error {
+	st, err := readState()
+	if err != nil || len(st.Starts) == 0 {
+		return err
+	}
+
+	var interrupted []string
+	isStale := func(id string, ps pendingStart) bool {
+		if id == except {
+			return false
+		}
+		if ps.interrupted() {
+			if !hasString(id, interrupted) {
+				interrupted = append(interrupted, id)
+			}
+			return true
+		}
+		// a hook still preempting, like waiting out a slow shutdown, may take
+		// any time; only intents recorded without a hook PID can't tell
+		if !ps.Acted && ps.PID != 0 {
+			return false
+		}
+		return time.Since(ps.Time) > rollbackAfter
+	}
+	stale := false
+	for id, ps := range st.Starts {
+		if isStale(id, ps) {
+			stale = true
+		}
+	}
+	if !stale {
+		return nil
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	ids, err := claimPendingStarts(isStale)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if vm := findVM(vms, id); vm == nil || vm.status == "running" {
+			continue // started without us seeing post-start, or gone
+		}
+		if hasString(id, interrupted) {
+			warnf("hook starting vm #%v was interrupted while preempting mutuals, restarting those it stopped", id)
+			recordEvent(event{Kind: kindInterrupted, VMID: id, Reason: "hook exited while preempting mutuals"})
+		} else {
+			infof("vm #%v has not started after %v, restarting mutuals that it stopped", id, rollbackAfter)
+		}
+		if err := restartPreempted(id, kindRollback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollbackDuringSlowShutdown(t *testing.T) {
+	h := newFakeHost(t)
+	defer func(prior time.Duration) { rollbackAfter = prior }(rollbackAfter)
+	rollbackAfter = 200 * time.Millisecond
+	h.addVM("101", "stopped", "hostpci0: 0000:01:00")
+	h.addVM("102", "running", "hostpci0: 0000:01:00")
+	h.slowShutdown("102", 0.6)
+
+	// the mutual's own hooks run while the preempting hook waits on it
+	stopped := make(chan error)
+	go func() { stopped <- stopMutuals("101") }()
+	var err error
+	for running := true; running; {
+		select {
+		case err = <-stopped:
+			running = false
+		case <-time.After(100 * time.Millisecond):
+			if err := rollbackFailedStarts("102"); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ran("qm start") {
+		t.Fatalf("restarted the mutual while it was being preempted")
+	}
+	st, err := readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps, ok := st.Starts["101"]; !ok || !ps.Acted {
+		t.Fatalf("got start intent %+v, want it acted upon", st.Starts["101"])
+	}
+
+	// once acted upon, a start that doesn't follow is rolled back
+	time.Sleep(rollbackAfter)
+	if err := rollbackFailedStarts(""); err != nil {
+		t.Fatal(err)
+	}
+	if !h.ran("qm start 102") {
+		t.Errorf("didn't restart the mutual of a failed start")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// policyRule is one rule from the config file's [rules] section, like:
+//
+//	when resource matches hostpci:0000:01:* and target.tag == prod then deny
+//
+// Rules are evaluated in order for every running mutual (the target) that
+// starting a VM would affect, and every resource that they share; the action
+// of the first matching rule applies to that target:
+//   - deny fails the start
+//   - preempt shuts down the target
+//   - queue waits for the target to stop on its own
+//   - ignore treats the target as if it weren't a mutual
+//   - ask shuts down the target only once approved
+//
+// Conditions compare a subject to a value with == or != for exact (in)equality,
+// or matches for a glob pattern. Subjects are resource, or one of id, name,
+// status, or tag prefixed by target. or starting.; tag conditions hold if any
+// of the VM's tags compare true.
+type policyRule struct {
+	line   int
+	text   string
+	conds  []ruleCond
+	action string
+}
+
+type ruleCond struct {
+	subject string
+	op      string
+	value   string
+}
+
+var ruleActions = []string{"deny", "preempt", "queue", "ignore", "ask"}
+
+var ruleSubjects = []string{
+	"resource",
+	"target.id", "target.name", "target.status", "target.tag",
+	"starting.id", "starting.name", "starting.status", "starting.tag",
+}
+
+var ruleOps = []string{"==", "!=", "matches"}
+
+var (
+	loadRulesOnce sync.Once
+	loadedRules   []policyRule
+	loadRulesErr  error
+)
+
+// configRules returns the rules parsed from the config file, failing on the
+// first invalid rule.
+func configRules() ([]policyRule, error) {
+	loadRulesOnce.Do(func() {
+		var errs []error
+		loadedRules, errs = parseRules(config)
+		if len(errs) > 0 {
+			loadRulesErr = errs[0]
+		}
+	})
+	return loadedRules, loadRulesErr
+}
+
+// parseRules parses all rules in the config, returning all valid rules, and
+// an error for each invalid one.
+func parseRules(cf configFile) (rules []policyRule, errs []error) {
+	for _, ent := range cf.sections["rules"] {
+		rule, err := parseRule(ent.value)
+		if err != nil {
+			errs = append(errs, cf.errorf(ent.line, "%w", err))
+			continue
+		}
+		rule.line = ent.line
+		rules = append(rules, rule)
+	}
+	return rules, errs
+}
+
+func parseRule(text string) (rule policyRule, _ error) {
+	rule.text = text
+	words, err := splitCommandLine(text)
+	if err != nil {
+		return rule, err
+	}
+	if len(words) == 0 || words[0] != "when" {
+		return rule, fmt.Errorf("rule must start with when")
+	}
+	words = words[1:]
+	for {
+		if len(words) < 3 {
+			return rule, fmt.Errorf("expected <subject> <op> <value> condition")
+		}
+		cond := ruleCond{words[0], words[1], words[2]}
+		if !hasString(cond.subject, ruleSubjects) {
+			return rule, fmt.Errorf("unknown subject %q, expected one of %v", cond.subject, strings.Join(ruleSubjects, ", "))
+		}
+		if !hasString(cond.op, ruleOps) {
+			return rule, fmt.Errorf("unknown operator %q, expected one of %v", cond.op, strings.Join(ruleOps, ", "))
+		}
+		if cond.op == "matches" {
+			if _, err := path.Match(cond.value, ""); err != nil {
+				return rule, fmt.Errorf("invalid pattern %q: %w", cond.value, err)
+			}
+		}
+		rule.conds = append(rule.conds, cond)
+		words = words[3:]
+
+		if len(words) > 0 && words[0] == "and" {
+			words = words[1:]
+			continue
+		}
+		if len(words) != 2 || words[0] != "then" {
+			return rule, fmt.Errorf("expected and <condition>, or then <action>")
+		}
+		if !hasString(words[1], ruleActions) {
+			return rule, fmt.Errorf("unknown action %q, expected one of %v", words[1], strings.Join(ruleActions, ", "))
+		}
+		rule.action = words[1]
+		return rule, nil
+	}
+}
+
+// matchRules returns the first rule matching starting self, affecting the
+// target mutual, over any of their shared resources; it returns nil if none.
+func matchRules(rules []policyRule, self, target vmInfo) *policyRule {
+	shared := sharedResources(self.resources, target.resources)
+	for i := range rules {
+		for _, label := range shared {
+			if rules[i].matches(self, target, label) {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (rule policyRule) matches(self, target vmInfo, label string) bool {
+	for _, cond := range rule.conds {
+		if !cond.matches(self, target, label) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond ruleCond) matches(self, target vmInfo, label string) bool {
+	vm := target
+	field := cond.subject
+	if strings.HasPrefix(field, "starting.") {
+		vm = self
+	}
+	field = field[strings.IndexByte(field, '.')+1:]
+
+	switch field {
+	case "resource":
+		return cond.compare(label)
+	case "id":
+		return cond.compare(vm.id)
+	case "name":
+		return cond.compare(vm.name)
+	case "status":
+		return cond.compare(vm.state)
+	case "tag":
+		any := false
+		for _, tag := range vm.config.tags() {
+			if cond.op == "!=" {
+				if tag == cond.value {
+					return false
+				}
+			} else if cond.compare(tag) {
+				any = true
+			}
+		}
+		return any || cond.op == "!="
+	}
+	return false
+}
+
+func (cond ruleCond) compare(s string) bool {
+	switch cond.op {
+	case "==":
+		return s == cond.value
+	case "!=":
+		return s != cond.value
+	case "matches":
+		matched, _ := path.Match(cond.value, s)
+		return matched
+	}
+	return false
+}
+
+// runPolicy provides policy subcommands, currently just lint.
+func runPolicy(args []string) error {
+	if len(args) != 1 || args[0] != "lint" {
+		return withExitCode(exitUsage, fmt.Errorf("usage: policy lint"))
+	}
+	rules, errs := parseRules(config)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v invalid rule(s)", len(errs))
+	}
+	infof("%v rule(s) ok", len(rules))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		conds  int
+		action string
+		err    string
+	}{
+		{text: "when target.tag == prod then deny", conds: 1, action: "deny"},
+		{text: "when resource matches hostpci:0000:01:* and starting.name != 'lab vm' then ask", conds: 2, action: "ask"},
+		{text: "when target.id == 102 and target.status == paused and resource == hostusb:1a86:7523 then ignore", conds: 3, action: "ignore"},
+		{text: "target.tag == prod then deny", err: "rule must start with when"},
+		{text: "when target.tag == prod", err: "expected and <condition>, or then <action>"},
+		{text: "when target.tag ==", err: "expected <subject> <op> <value> condition"},
+		{text: "when target.color == red then deny", err: `unknown subject "target.color"`},
+		{text: "when target.tag =~ prod then deny", err: `unknown operator "=~"`},
+		{text: "when resource matches [ then deny", err: `invalid pattern "["`},
+		{text: "when target.tag == prod then explode", err: `unknown action "explode"`},
+		{text: "when target.name == 'unterminated then deny", err: "unterminated ' quote"},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			rule, err := parseRule(tc.text)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rule.conds) != tc.conds || rule.action != tc.action {
+				t.Errorf("got %v conditions then %q, want %v then %q", len(rule.conds), rule.action, tc.conds, tc.action)
+			}
+		})
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	stateDir = t.TempDir()
+	self := vmInfo{
+		listRec:   listRec{id: "101", name: "gaming", status: "stopped"},
+		config:    vmConfig{"tags": "lab"},
+		resources: []string{"hostpci:0000:01:00", "hostusb:1a86:7523"},
+	}
+	target := vmInfo{
+		listRec:   listRec{id: "102", name: "work", status: "running"},
+		config:    vmConfig{"tags": "prod;backup"},
+		resources: []string{"hostpci:0000:01:00", "hostusb:046d:c52b"},
+		state:     "running",
+	}
+
+	for _, tc := range []struct {
+		rules string
+		line  int // of the matching rule, or 0 for none
+	}{
+		{"when target.tag == prod then deny", 1},
+		{"when target.tag == lab then deny", 0},
+		{"when starting.tag == lab then deny", 1},
+		{"when target.tag != prod then deny", 0},
+		{"when target.tag != lab then deny", 1},
+		{"when target.name matches w* and target.status == running then deny", 1},
+		{"when resource matches hostusb:* then deny", 0}, // the usb devices differ
+		{"when resource == hostpci:0000:01:00 then deny", 1},
+		{"when target.id == 103 then deny\nwhen target.id == 102 then ignore", 2},
+	} {
+		t.Run(tc.rules, func(t *testing.T) {
+			var rules []policyRule
+			for i, text := range strings.Split(tc.rules, "\n") {
+				rule, err := parseRule(text)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rule.line = i + 1
+				rules = append(rules, rule)
+			}
+			line := 0
+			if rule := matchRules(rules, self, target); rule != nil {
+				line = rule.line
+			}
+			if line != tc.line {
+				t.Errorf("got matching rule %v, want %v", line, tc.line)
+			}
+		})
+	}
+}
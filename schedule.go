@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleEntry is a recurring time window, given in the [schedule] config
+// section, at the start of which the watch daemon starts a VM, so that a
+// device may be time-shared between mutuals:
+//
+//	[schedule]
+//	# the ML vm gets the GPU overnight, the workstation during the day
+//	* 22:00-08:00 104
+//	* 08:00-22:00 101
+//
+// Starting the VM runs its hook, which gracefully preempts its mutuals as
+// usual.
+type scheduleEntry struct {
+	timeWindow
+	line int
+	text string
+	vmid string
+}
+
+// schedulePoll is how often the watch daemon checks the schedule.
+const schedulePoll = 30 * time.Second
+
+func init() {
+	configSections["schedule"] = nil
+	rawSections["schedule"] = true
+}
+
+var (
+	loadScheduleOnce sync.Once
+	loadedSchedule   []scheduleEntry
+	loadScheduleErr  error
+)
+
+// configSchedule returns the schedule parsed from the config file, failing
+// on the first invalid entry.
+func configSchedule() ([]scheduleEntry, error) {
+	loadScheduleOnce.Do(func() {
+		var errs []error
+		loadedSchedule, errs = parseSchedule(config)
+		if len(errs) > 0 {
+			loadScheduleErr = errs[0]
+		}
+	})
+	return loadedSchedule, loadScheduleErr
+}
+
+// parseSchedule parses all schedule entries in the config, returning all
+// valid entries, and an error for each invalid one.
+func parseSchedule(cf configFile) (entries []scheduleEntry, errs []error) {
+	for _, ent := range cf.sections["schedule"] {
+		se, err := parseScheduleEntry(ent.value)
+		if err != nil {
+			errs = append(errs, cf.errorf(ent.line, "%w", err))
+			continue
+		}
+		se.line = ent.line
+		entries = append(entries, se)
+	}
+	return entries, errs
+}
+
+func parseScheduleEntry(text string) (se scheduleEntry, err error) {
+	se.text = text
+	fields := strings.Fields(text)
+	if len(fields) != 3 {
+		return se, fmt.Errorf("expected <days> <HH:MM>-<HH:MM> <vmid>")
+	}
+	if se.timeWindow, err = parseTimeWindow(fields[0], fields[1]); err != nil {
+		return se, err
+	}
+	if _, err := strconv.Atoi(fields[2]); err != nil {
+		return se, fmt.Errorf("invalid vmid %q", fields[2])
+	}
+	se.vmid = fields[2]
+	return se, nil
+}
+
+// runSchedule starts the VM of every schedule entry whose window has begun
+// since it was last handed over, as recorded in the state; a VM that's
+// already running, or was stopped by hand meanwhile, is left alone until the
+// window next begins. Entries for VMs of other nodes are left to their watch
+// daemons.
+func runSchedule(now time.Time) error {
+	entries, err := configSchedule()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+
+	var vms []vmInfo
+	for _, se := range entries {
+		if !se.contains(now) {
+			continue
+		}
+		begun := se.startOf(now)
+		if last, ok := st.Schedule[se.text]; ok && !last.Before(begun) {
+			continue
+		}
+
+		if vms == nil {
+			if vms, err = scanVMs(); err != nil {
+				return err
+			}
+		}
+		vm := findVM(vms, se.vmid)
+		if vm == nil {
+			debugf("not handing over to vm #%v, it's not on this node", se.vmid)
+			continue
+		}
+
+		if vm.status == "running" {
+			debugf("vm #%v is already running, as scheduled by line %v: %v", vm.id, se.line, se.text)
+		} else {
+			ev := event{Kind: kindSchedule, VMID: vm.id, Reason: se.text}
+			if err := maybeRun("qm", "start", vm.id); err != nil {
+				ev.Error = err.Error()
+			}
+			recordEvent(ev)
+		}
+
+		if err := updateState(func(st *state) error {
+			if st.Schedule == nil {
+				st.Schedule = make(map[string]time.Time)
+			}
+			st.Schedule[se.text] = begun
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
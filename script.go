@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// emitScript, if set, names a shell script to write every consequential
+// command to, rather than running it, so that an operator may review and
+// apply them; it implies dry-run.
+var emitScript string
+
+func init() {
+	flag.StringVar(&emitScript, "emit-script", "", "write the commands that would be run to this shell script, rather than running them; implies -dry-run")
+}
+
+var script *os.File
+
+// openScript creates any -emit-script file, returning a function to close it.
+func openScript() (func() error, error) {
+	if emitScript == "" {
+		return func() error { return nil }, nil
+	}
+	dryRun = true
+	f, err := os.OpenFile(emitScript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	script = f
+	if _, err := fmt.Fprintf(f, "#!/bin/sh\n# qmexmut %v\nset -e\n", shellJoin(os.Args[1:])); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f.Close, nil
+}
+
+// scriptCommand writes a command to any -emit-script file.
+func scriptCommand(args ...string) {
+	if script == nil {
+		return
+	}
+	if _, err := fmt.Fprintln(script, shellJoin(args)); err != nil {
+		warnf("unable to write %q to %v: %v", args, script.Name(), err)
+	}
+}
+
+// scriptComment writes a comment to any -emit-script file, like to note a
+// step that can't be given as a command.
+func scriptComment(format string, args ...interface{}) {
+	if script == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(script, "# "+format+"\n", args...); err != nil {
+		warnf("unable to write to %v: %v", script.Name(), err)
+	}
+}
+
+var shellSafePat = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// shellJoin quotes arguments for a POSIX shell, as needed.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafePat.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
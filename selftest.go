@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hookPhases are the phases that proxmox runs a hookscript for.
+var hookPhases = []string{"pre-start", "post-start", "pre-stop", "post-stop"}
+
+// runSelftest exercises, without changing anything, everything that the hook
+// does: it scans every VM and its resources, loads the config's rules and
+// aliases, and then runs every hook phase in dry-run for each hooked VM. Any
+// errors, other than starts being denied, are reported as a failure, so that
+// it makes a safe smoke test after upgrading.
+func runSelftest(args []string) error {
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: selftest"))
+	}
+	dryRun = true
+
+	failed := 0
+	var tab table
+	tab.header("VMID", "NAME", "PHASE", "RESULT", "DETAIL")
+	result := func(vm vmInfo, phase string, err error, detail string) {
+		switch {
+		case err == nil:
+			tab.add(plain(vm.id), plain(vm.name), plain(phase), colored(colorGreen, "ok"), plain(detail))
+		case exitCode(err) == exitDenied:
+			tab.add(plain(vm.id), plain(vm.name), plain(phase), colored(colorYellow, "denied"), plain(err.Error()))
+		default:
+			failed++
+			tab.add(plain(vm.id), plain(vm.name), plain(phase), colored(colorRed, "error"), plain(err.Error()))
+		}
+	}
+
+	_, err := configRules()
+	result(vmInfo{}, "rules", err, "")
+	loadAliases()
+
+	vms, err := scanVMs()
+	if err != nil {
+		result(vmInfo{}, "scan", err, "")
+		return selftestDone(&tab, failed)
+	}
+	hooked := 0
+	for _, vm := range vms {
+		if isOurHook(vm.config["hookscript"]) {
+			hooked++
+		}
+	}
+	result(vmInfo{}, "scan", nil, fmt.Sprintf("%v vm(s), %v hooked", len(vms), hooked))
+
+	for _, vm := range vms {
+		if !isOurHook(vm.config["hookscript"]) {
+			continue
+		}
+		var ids []string
+		for _, mutual := range mutualsOf(vm.id, vms) {
+			ids = append(ids, "#"+mutual.id)
+		}
+		result(vm, "mutuals", nil, strings.Join(ids, ", "))
+		for _, phase := range hookPhases {
+			result(vm, phase, selftestHook(vm.id, phase), "")
+		}
+	}
+	return selftestDone(&tab, failed)
+}
+
+// selftestHook runs one hook phase quietly, recovering any panic as an error.
+func selftestHook(id, phase string) (err error) {
+	stdout, level := os.Stdout, minLogLevel
+	if devnull, derr := os.Open(os.DevNull); derr == nil {
+		os.Stdout = devnull
+		defer devnull.Close()
+	}
+	if minLogLevel == levelInfo {
+		minLogLevel = levelWarn
+	}
+	summary = hookSummary{}
+	defer func() {
+		os.Stdout, minLogLevel = stdout, level
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return runHook(hookCmdName, []string{id, phase})
+}
+
+func selftestDone(tab *table, failed int) error {
+	if err := printTable(tab); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("selftest found %v error(s)", failed)
+	}
+	return nil
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// shutdownOrder is the strategy used by shutdownVMs:
+//   - tiers shuts down VMs in tiers by reverse proxmox startup order; all VMs
+//     within a tier are shut down at once
+//   - parallel shuts down all VMs at once
+//   - sequential shuts down one VM at a time, in VMID order
+//   - memory shuts down one VM at a time, smallest memory first
+//   - startup shuts down one VM at a time, in reverse proxmox startup order
+var shutdownOrder = "tiers"
+
+// Global shutdown policy, which may be overridden per-VM; see shutdownPolicyFor.
+var (
+	shutdownMethod  = "auto"
+	shutdownTimeout = 0
+	forceStop       = false
+	agentWait       = 0
+)
+
+var shutdownMethods = []string{"auto", "acpi", "agent", "stop"}
+
+// onShutdownFailure is what to do when a mutual fails to shut down:
+//   - abort gives up on shutting down any others, failing the start
+//   - continue still shuts down the others, then fails the start
+//   - stop escalates to a hard stop, failing the start only if that fails too
+var onShutdownFailure = "continue"
+
+var shutdownFailureActions = []string{"abort", "continue", "stop"}
+
+// Optional command to run inside a mutual's guest, like one to warn logged in
+// users, followed by a delay before actually shutting it down.
+var (
+	preShutdownExec  = ""
+	preShutdownDelay = 0
+)
+
+func init() {
+	flag.Var(choiceFlag{&shutdownOrder, []string{"tiers", "parallel", "sequential", "memory", "startup"}},
+		"shutdown-order", "how to order shutting down mutuals: tiers, parallel, sequential, memory, or startup")
+	flag.Var(choiceFlag{&shutdownMethod, shutdownMethods},
+		"shutdown-method", "how to stop mutuals: auto, acpi shutdown, guest agent shutdown, or hard stop")
+	flag.IntVar(&shutdownTimeout, "shutdown-timeout", 0, "seconds to wait for a mutual to shutdown; 0 uses the proxmox default")
+	flag.BoolVar(&forceStop, "force-stop", false, "hard stop any mutual that doesn't shutdown in time")
+	flag.Var(choiceFlag{&onShutdownFailure, shutdownFailureActions},
+		"on-shutdown-failure", "what to do when a mutual fails to shutdown: abort, continue, or stop")
+
+	vmSettings["shutdown-method"] = "auto, acpi, agent, or stop"
+	vmSettings["shutdown-timeout"] = "seconds to wait for shutdown"
+	vmSettings["force-stop"] = "hard stop if not shutdown in time"
+	vmSettings["on-shutdown-failure"] = "abort, continue, or stop"
+
+	flag.IntVar(&agentWait, "agent-wait", 0, "seconds since boot to wait for a mutual's guest agent under the auto shutdown method")
+	vmSettings["agent-wait"] = "seconds since boot to wait for the guest agent"
+
+	flag.StringVar(&preShutdownExec, "pre-shutdown-exec", "", "command to run within a mutual's guest agent before shutting it down")
+	flag.IntVar(&preShutdownDelay, "pre-shutdown-delay", 0, "seconds to wait after any -pre-shutdown-exec before shutting down")
+	vmSettings["pre-shutdown-exec"] = "command to run in guest before shutdown"
+	vmSettings["pre-shutdown-delay"] = "seconds to wait after pre-shutdown-exec"
+}
+
+// shutdownVMs shuts down all of the given VMs as ordered by shutdownOrder.
+// A failure to shutdown one VM does not prevent trying the rest, unless its
+// onShutdownFailure is abort; any failures are returned as shutdownFailures.
+func shutdownVMs(by string, vms []vmInfo) error {
+	vms = append([]vmInfo(nil), vms...)
+	switch shutdownOrder {
+	case "tiers":
+		return shutdownBatches(by, startupTiers(vms))
+	case "parallel":
+		return shutdownBatches(by, [][]vmInfo{vms})
+	case "sequential":
+		sort.SliceStable(vms, func(i, j int) bool {
+			return vmidLess(vms[i].id, vms[j].id)
+		})
+	case "memory":
+		sort.SliceStable(vms, func(i, j int) bool {
+			mi, mj := vms[i].config.memory(), vms[j].config.memory()
+			if mi != mj {
+				return mi < mj
+			}
+			return vmidLess(vms[i].id, vms[j].id)
+		})
+	case "startup":
+		sort.SliceStable(vms, func(i, j int) bool {
+			return startupLess(vms[j], vms[i])
+		})
+	}
+	return shutdownEach(by, vms)
+}
+
+// shutdownEach shuts down VMs one at a time, in the given order.
+func shutdownEach(by string, vms []vmInfo) error {
+	var failures shutdownFailures
+	for i, vm := range vms {
+		if err := shutdownVM(by, vm); err != nil {
+			failures.failed = append(failures.failed, shutdownFailure{vm.id, err})
+			if shutdownFailureFor(vm) == "abort" {
+				failures.skipped = vmIDs(vms[i+1:])
+				break
+			}
+		}
+	}
+	return failures.err()
+}
+
+// startupTiers groups VMs into tiers that share the same proxmox startup
+// order, in reverse startup order; all VMs without an explicit startup order
+// are in the first tier, since proxmox shuts them down first.
+func startupTiers(vms []vmInfo) (tiers [][]vmInfo) {
+	sort.SliceStable(vms, func(i, j int) bool {
+		return startupLess(vms[j], vms[i])
+	})
+	for len(vms) > 0 {
+		tier := vms[0].config.startup()
+		n := 1
+		for ; n < len(vms); n++ {
+			if sc := vms[n].config.startup(); sc.hasOrder != tier.hasOrder || sc.order != tier.order {
+				break
+			}
+		}
+		tiers = append(tiers, vms[:n])
+		vms = vms[n:]
+	}
+	return tiers
+}
+
+// shutdownBatches shuts down each batch of VMs in turn, all VMs within a
+// batch at once; any failure to abort on skips all later batches.
+func shutdownBatches(by string, batches [][]vmInfo) error {
+	var failures shutdownFailures
+	for b, batch := range batches {
+		errs := make([]error, len(batch))
+		g := new(errgroup.Group)
+		for i, vm := range batch {
+			i, vm := i, vm
+			g.Go(func() error {
+				errs[i] = shutdownVM(by, vm)
+				return nil
+			})
+		}
+		_ = g.Wait()
+		abort := false
+		for i, err := range errs {
+			if err != nil {
+				failures.failed = append(failures.failed, shutdownFailure{batch[i].id, err})
+				abort = abort || shutdownFailureFor(batch[i]) == "abort"
+			}
+		}
+		if abort {
+			for _, rest := range batches[b+1:] {
+				failures.skipped = append(failures.skipped, vmIDs(rest)...)
+			}
+			break
+		}
+	}
+	return failures.err()
+}
+
+// shutdownFailure is a VM that failed to shut down, and why.
+type shutdownFailure struct {
+	id  string
+	err error
+}
+
+// shutdownFailures reports every VM that shutdownVMs failed to shut down,
+// and any that it then didn't try to.
+type shutdownFailures struct {
+	failed  []shutdownFailure
+	skipped []string
+}
+
+// err returns the failures as an error, or nil if there were none.
+func (sf shutdownFailures) err() error {
+	if len(sf.failed) == 0 {
+		return nil
+	}
+	return sf
+}
+
+func (sf shutdownFailures) Error() string {
+	if len(sf.failed) == 1 && len(sf.skipped) == 0 {
+		return fmt.Sprintf("vm #%v: %v", sf.failed[0].id, sf.failed[0].err)
+	}
+	parts := make([]string, len(sf.failed))
+	for i, f := range sf.failed {
+		parts[i] = fmt.Sprintf("vm #%v: %v", f.id, f.err)
+	}
+	msg := fmt.Sprintf("%v vm(s) failed to shutdown: %v", len(sf.failed), strings.Join(parts, "; "))
+	if len(sf.skipped) > 0 {
+		msg += fmt.Sprintf("; aborted before shutting down vm(s) %v", strings.Join(sf.skipped, ", "))
+	}
+	return msg
+}
+
+// has returns true if the VM with the given id failed to shut down, or
+// wasn't tried.
+func (sf shutdownFailures) has(id string) bool {
+	for _, f := range sf.failed {
+		if f.id == id {
+			return true
+		}
+	}
+	return hasString(id, sf.skipped)
+}
+
+// shutdownFailureFor returns a VM's onShutdownFailure, as overridden by any
+// per-VM setting.
+func shutdownFailureFor(vm vmInfo) string {
+	if val, ok := vm.setting("on-shutdown-failure"); ok && hasString(val, shutdownFailureActions) {
+		return val
+	}
+	return onShutdownFailure
+}
+
+// shutdownVM shuts down a VM as directed by its shutdownPolicyFor, on behalf
+// of the starting VM by, recording which method was used in the event log.
+func shutdownVM(by string, vm vmInfo) error {
+	t0 := time.Now()
+	if err := notifyGuest(vm); err != nil {
+		warnf("pre-shutdown exec in vm #%v failed: %v", vm.id, err)
+	}
+	if err := awaitWindowsUpdates(vm); err != nil {
+		warnf("%v", err)
+	}
+
+	// tagged before shutting down, so that the VM's own post-stop hook knows
+	// that it was preempted
+	if err := markStoppedBy(vm, by); err != nil {
+		warnf("unable to tag vm #%v as stopped by vm #%v: %v", vm.id, by, err)
+	}
+
+	recordEvent(event{Kind: kindStopping, VMID: vm.id, By: by})
+	method, err := shutdownVMWith(vm)
+	if err != nil && shutdownFailureFor(vm) == "stop" && !strings.HasSuffix(method, "stop") {
+		warnf("shutdown of vm #%v failed, stopping: %v", vm.id, err)
+		if method == "" {
+			method = "stop"
+		} else {
+			method += "+stop"
+		}
+		if serr := maybeRun("qm", "stop", vm.id); serr != nil {
+			err = fmt.Errorf("%v, then stop failed: %w", err, serr)
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		// the scanned config is shared, so the tag just added is only seen by
+		// a copy of it
+		tagged := vm
+		tagged.config = vm.config.with("tags", strings.Join(vm.config.withStoppedBy(by), ";"))
+		if err := markStoppedBy(tagged, ""); err != nil {
+			warnf("unable to untag vm #%v: %v", vm.id, err)
+		}
+	}
+	ev := event{
+		Kind:   kindShutdown,
+		VMID:   vm.id,
+		By:     by,
+		Method: method,
+		Took:   time.Since(t0).Seconds(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	recordEvent(ev)
+	return err
+}
+
+// shutdownVMWith shuts down a VM, returning the method used; under the auto
+// method, a live guest agent is used if available, falling back to acpi
+// shutdown and then, unless force-stop is configured false, a hard stop,
+// which windows guests are given longer to avoid.
+func shutdownVMWith(vm vmInfo) (string, error) {
+	pol, err := shutdownPolicyFor(vm)
+	if err != nil {
+		return "", err
+	}
+
+	switch preemptAction(vm) {
+	case actionStop:
+		return "stop", maybeRun("qm", "stop", vm.id)
+	case actionResume:
+		if err := maybeRun("qm", "resume", vm.id); err != nil {
+			warnf("unable to resume vm #%v, stopping: %v", vm.id, err)
+			return "stop", maybeRun("qm", "stop", vm.id)
+		}
+	}
+
+	method := pol.method
+	if method == "auto" {
+		method = "acpi"
+		if !pol.forceStopSet {
+			pol.forceStop = true
+		}
+		if pol.timeout == 0 {
+			pol.timeout = defaultAutoTimeout
+			if vm.config.isWindows() {
+				pol.timeout = windowsShutdownTimeout
+			}
+		}
+		if vm.config.agentEnabled() && (pingAgent(vm.id) || awaitAgent(vm.id, pol.agentWait)) {
+			method = "agent"
+		}
+	}
+
+	switch method {
+	case "stop":
+		return method, maybeRun("qm", "stop", vm.id)
+
+	case "agent":
+		err := maybeRun("qm", "guest", "cmd", vm.id, "shutdown")
+		if err == nil {
+			args := []string{"qm", "wait", vm.id}
+			if pol.timeout > 0 {
+				args = append(args, "--timeout", strconv.Itoa(pol.timeout))
+			}
+			err = maybeRun(args...)
+		}
+		if err != nil && pol.forceStop {
+			warnf("guest agent shutdown of vm #%v failed, stopping: %v", vm.id, err)
+			return "agent+stop", maybeRun("qm", "stop", vm.id)
+		}
+		return method, err
+
+	default:
+		args := []string{"qm", "shutdown", vm.id}
+		if pol.timeout > 0 {
+			args = append(args, "--timeout", strconv.Itoa(pol.timeout))
+		}
+		if pol.forceStop {
+			args = append(args, "--forceStop", "1")
+			method = "acpi+stop"
+		}
+		return method, maybeRun(args...)
+	}
+}
+
+// notifyGuest runs any pre-shutdown-exec command inside the VM using its guest
+// agent, and then waits for any pre-shutdown-delay, giving interactive users
+// a warning before their VM is shutdown.
+func notifyGuest(vm vmInfo) error {
+	command, _ := vm.setting("pre-shutdown-exec")
+	if command == "" {
+		command = preShutdownExec
+	}
+	if command == "" {
+		return nil
+	}
+	if !vm.config.agentEnabled() {
+		debugf("not running pre-shutdown exec in vm #%v: no guest agent", vm.id)
+		return nil
+	}
+	if vm.state != "running" {
+		debugf("not running pre-shutdown exec in vm #%v: %v", vm.id, vm.state)
+		return nil
+	}
+
+	delay := preShutdownDelay
+	if val, ok := vm.setting("pre-shutdown-delay"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid pre-shutdown-delay: %w", err)
+		}
+		delay = n
+	}
+
+	argv, err := splitCommandLine(command)
+	if err != nil {
+		return err
+	}
+	if err := maybeRun(append([]string{"qm", "guest", "exec", vm.id, "--"}, argv...)...); err != nil {
+		return err
+	}
+
+	if delay > 0 {
+		if dryRun {
+			infof("would wait %vs before shutting down vm #%v", delay, vm.id)
+		} else {
+			infof("waiting %vs before shutting down vm #%v", delay, vm.id)
+			time.Sleep(time.Duration(delay) * time.Second)
+		}
+	}
+	return nil
+}
+
+// splitCommandLine splits a command line into arguments on whitespace, with
+// support for single and double quoted arguments.
+func splitCommandLine(s string) (args []string, _ error) {
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// defaultAutoTimeout bounds how long the auto shutdown method waits before
+// escalating to a hard stop, when no timeout is otherwise given.
+const defaultAutoTimeout = 180
+
+// agentEnabled returns true if the config enables the qemu guest agent, as
+// either "agent: 1" or "agent: enabled=1,...".
+func (conf vmConfig) agentEnabled() bool {
+	for _, part := range strings.Split(conf["agent"], ",") {
+		if part == "1" || part == "enabled=1" {
+			return true
+		}
+	}
+	return false
+}
+
+// pingAgent returns true if the VM's guest agent responds to a ping.
+func pingAgent(id string) bool {
+	cmd := exec.Command("qm", "guest", "cmd", id, "ping")
+	done, err := startCommand(cmd)
+	if err != nil {
+		return false
+	}
+	err = cmd.Wait()
+	done(err)
+	if err != nil {
+		debugf("vm #%v guest agent ping failed: %v", id, err)
+	}
+	return err == nil
+}
+
+// agentPoll is how often awaitAgent pings a guest agent.
+const agentPoll = 2 * time.Second
+
+// awaitAgent waits for the guest agent of a VM that has only just booted,
+// until it's been up for wait seconds, returning true once the agent
+// responds; since acpi shutdown is often ignored while a guest is still
+// booting, this gives it a chance to be shut down by its agent instead.
+func awaitAgent(id string, wait int) bool {
+	if wait <= 0 {
+		return false
+	}
+	up, err := vmUptime(id)
+	if err != nil {
+		debugf("not waiting for vm #%v guest agent: %v", id, err)
+		return false
+	}
+	if up >= wait {
+		return false
+	}
+	left := time.Duration(wait-up) * time.Second
+	if dryRun {
+		infof("would wait up to %v for vm #%v guest agent", left, id)
+		return false
+	}
+	infof("waiting up to %v for vm #%v guest agent", left, id)
+	for deadline := time.Now().Add(left); time.Now().Before(deadline); {
+		time.Sleep(agentPoll)
+		if pingAgent(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdownPolicy is how to shut down a particular VM.
+type shutdownPolicy struct {
+	method    string
+	timeout   int  // seconds; 0 leaves it to proxmox
+	forceStop bool // hard stop if not shutdown in time
+	agentWait int  // seconds since boot to wait for the guest agent
+
+	// forceStopSet is true if forceStop was configured, globally or for the
+	// VM, rather than left to its default.
+	forceStopSet bool
+}
+
+// shutdownPolicyFor resolves the shutdown policy for a VM: starting from the
+// global flags, its startup down delay overrides the timeout, and then any
+// per-VM settings override everything.
+func shutdownPolicyFor(vm vmInfo) (shutdownPolicy, error) {
+	pol := shutdownPolicy{shutdownMethod, shutdownTimeout, forceStop, agentWait, isConfigured("force-stop")}
+
+	if down := vm.config.startup().down; down > 0 {
+		pol.timeout = down
+	}
+
+	if val, ok := vm.setting("shutdown-method"); ok {
+		if !hasString(val, shutdownMethods) {
+			return pol, fmt.Errorf("vm #%v: invalid shutdown-method %q", vm.id, val)
+		}
+		pol.method = val
+	}
+
+	if val, ok := vm.setting("shutdown-timeout"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return pol, fmt.Errorf("vm #%v: invalid shutdown-timeout: %w", vm.id, err)
+		}
+		pol.timeout = n
+	}
+
+	if val, ok := vm.setting("agent-wait"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return pol, fmt.Errorf("vm #%v: invalid agent-wait: %w", vm.id, err)
+		}
+		pol.agentWait = n
+	}
+
+	if val, ok := vm.setting("force-stop"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return pol, fmt.Errorf("vm #%v: invalid force-stop: %w", vm.id, err)
+		}
+		pol.forceStop, pol.forceStopSet = b, true
+	}
+
+	return pol, nil
+}
+
+// vmidLess orders VMIDs numerically.
+func vmidLess(a, b string) bool {
+	na, aerr := strconv.Atoi(a)
+	nb, berr := strconv.Atoi(b)
+	if aerr != nil || berr != nil {
+		return a < b
+	}
+	return na < nb
+}
+
+// sortVMIDs sorts VMIDs numerically.
+func sortVMIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return vmidLess(ids[i], ids[j]) })
+}
+
+// startupLess orders VMs as proxmox starts them: those with an explicit
+// startup order first, ascending, followed by all others; ties are broken by
+// VMID. Proxmox shuts VMs down in the reverse of this order.
+func startupLess(a, b vmInfo) bool {
+	sa, sb := a.config.startup(), b.config.startup()
+	if sa.hasOrder != sb.hasOrder {
+		return sa.hasOrder
+	}
+	if sa.hasOrder && sa.order != sb.order {
+		return sa.order < sb.order
+	}
+	return vmidLess(a.id, b.id)
+}
+
+// defaultMemory is proxmox's default VM memory size in MiB.
+const defaultMemory = 512
+
+// memory returns the configured memory size in MiB.
+func (conf vmConfig) memory() int {
+	if n, err := strconv.Atoi(conf["memory"]); err == nil {
+		return n
+	}
+	return defaultMemory
+}
+
+// startupConfig is a parsed proxmox startup option like "order=1,up=30,down=60".
+type startupConfig struct {
+	hasOrder bool
+	order    int
+	up       int // seconds to wait after starting
+	down     int // seconds to wait for shutdown
+}
+
+// startup parses the config's startup option, ignoring any malformed parts.
+func (conf vmConfig) startup() (sc startupConfig) {
+	for _, part := range strings.Split(conf["startup"], ",") {
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil {
+			continue
+		}
+		switch part[:i] {
+		case "order":
+			sc.hasOrder = true
+			sc.order = n
+		case "up":
+			sc.up = n
+		case "down":
+			sc.down = n
+		}
+	}
+	return sc
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssh options for -ssh and -node, for hosts that are only reachable thru a
+// bastion or on a non-standard port; anything else may be given with
+// -ssh-option, or in ssh_config, which ssh reads as usual.
+var (
+	sshPort     int
+	sshIdentity string
+	sshJump     string
+	sshTimeout  time.Duration
+	sshOptions  repeatedFlag
+	sshCache    = true
+)
+
+func init() {
+	flag.IntVar(&sshPort, "ssh-port", 0, "port to ssh to, rather than ssh's default")
+	flag.StringVar(&sshIdentity, "ssh-identity", "", "identity file to ssh with")
+	flag.StringVar(&sshJump, "ssh-jump", "", "jump host(s) to ssh thru, like ssh -J")
+	flag.DurationVar(&sshTimeout, "ssh-timeout", 0, "timeout for ssh to connect")
+	flag.Var(&sshOptions, "ssh-option", "an ssh -o option, like ServerAliveInterval=10; may be given more than once")
+	flag.BoolVar(&sshCache, "ssh-cache", sshCache, "keep the uploaded executable on the remote host, so that it's only uploaded again once changed")
+}
+
+// remoteCacheDir is where remote hosts keep the executable uploaded by -ssh,
+// named by its checksum.
+const remoteCacheDir = "$HOME/.cache/qmexmut"
+
+// remoteHasSelf returns true if the remote host has a cached executable with
+// the given checksum.
+func remoteHasSelf(server, sum string) bool {
+	remoteArgs := append(sshArgs(), server, "sha256sum", remoteCacheDir+"/qmexmut-"+sum)
+	out, err := exec.Command("ssh", remoteArgs...).Output()
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(string(out), sum+" ")
+}
+
+// remoteCachedScript returns a remote shell script that runs the cached
+// executable, after first decompressing it from stdin if upload is set,
+// replacing any prior version.
+func remoteCachedScript(sum string, upload bool) string {
+	self := remoteCacheDir + "/qmexmut-" + sum
+	run := "exec " + self + ` "$@"`
+	if !upload {
+		return run
+	}
+	return strings.Join([]string{
+		"mkdir -p " + remoteCacheDir,
+		"chmod 700 " + remoteCacheDir,
+		"tmp=`mktemp " + remoteCacheDir + "/.upload.XXXXXX`",
+		"gzip -dc >$tmp",
+		"chmod +x $tmp",
+		"rm -f " + remoteCacheDir + "/qmexmut-*",
+		"mv $tmp " + self,
+		run,
+	}, " && ")
+}
+
+// sshArgs returns ssh arguments for any ssh options given, to precede the
+// destination.
+func sshArgs() (args []string) {
+	if sshPort != 0 {
+		args = append(args, "-p", strconv.Itoa(sshPort))
+	}
+	if sshIdentity != "" {
+		args = append(args, "-i", sshIdentity)
+	}
+	if sshJump != "" {
+		args = append(args, "-J", sshJump)
+	}
+	if sshTimeout > 0 {
+		secs := int((sshTimeout + time.Second - 1) / time.Second)
+		args = append(args, "-o", "ConnectTimeout="+strconv.Itoa(secs))
+	}
+	for _, opt := range sshOptions {
+		args = append(args, "-o", opt)
+	}
+	return args
+}
+
+// repeatedFlag is a flag collecting a value each time it's given; unlike
+// listFlag, values aren't split on commas, since they may contain them.
+type repeatedFlag []string
+
+func (rf *repeatedFlag) String() string {
+	return strings.Join(*rf, " ")
+}
+
+func (rf *repeatedFlag) Set(s string) error {
+	*rf = append(*rf, s)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// stateDir holds qmexmut's local state, like its event log.
+var stateDir = "/var/lib/qmexmut"
+
+func init() {
+	flag.StringVar(&stateDir, "state-dir", stateDir, "directory to keep state and event log in")
+}
+
+// event is a record of something that qmexmut did, appended to the event
+// log as a line of JSON.
+type event struct {
+	Time   time.Time `json:"time"`
+	Kind   eventKind `json:"kind"`
+	VMID   string    `json:"vmid,omitempty"`
+	By     string    `json:"by,omitempty"` // the VM whose start caused this
+	Method string    `json:"method,omitempty"`
+	Took   float64   `json:"took,omitempty"` // seconds
+	Error  string    `json:"error,omitempty"`
+	Reason string    `json:"reason,omitempty"` // why qmexmut decided as it did
+
+	// Mutuals summarizes what a hook run did about each mutual.
+	Mutuals []mutualResult `json:"mutuals,omitempty"`
+}
+
+func init() {
+	subscribeEvents("the event log", false, appendEvent)
+}
+
+// recordEvent publishes an event to every eventSink, including the event
+// log; failure to do so is only logged, since it shouldn't prevent a VM from
+// starting.
+func recordEvent(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	publishEvent(ev)
+}
+
+// recordDenial records that starting a VM was denied, returning the error
+// that denies it.
+func recordDenial(vmid string, err error) error {
+	recordEvent(event{Kind: kindDeny, VMID: vmid, Error: err.Error()})
+	return err
+}
+
+func appendEvent(ev event) (rerr error) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(eventLogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); rerr == nil {
+			rerr = err
+		}
+	}()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write %q: %w", f.Name(), err)
+	}
+	return nil
+}
+
+func eventLogPath() string {
+	return filepath.Join(stateDir, "events.jsonl")
+}
+
+// state is qmexmut's persistent local state, kept as a JSON file within
+// stateDir, and updated under an exclusive lock by concurrent hook runs.
+type state struct {
+	// Preemptions records the last preemption over each resource label.
+	Preemptions map[string]preemptRecord `json:"preemptions,omitempty"`
+
+	// Queue lists VMs waiting for each resource label, in FIFO order.
+	Queue map[string][]queueEntry `json:"queue,omitempty"`
+
+	// Leases records VMs granted each resource label by the queue policy,
+	// until they finish starting.
+	Leases map[string]queueEntry `json:"leases,omitempty"`
+
+	// Reservations of resource labels made by the reserve command.
+	Reservations map[string]reservation `json:"reservations,omitempty"`
+
+	// Starts records VMs that preempted mutuals, until they finish
+	// starting, so that a failed start can be rolled back.
+	Starts map[string]pendingStart `json:"starts,omitempty"`
+
+	// Chains records the chain of hook runs that caused the hook to start
+	// each VM, until its start is decided, so that cascades can be limited.
+	Chains map[string][]string `json:"chains,omitempty"`
+
+	// Hookscripts records any other hookscript that init replaced on each
+	// VM, so that purge can restore it.
+	Hookscripts map[string]string `json:"hookscripts,omitempty"`
+
+	// Paused records that enforcement was paused by ctl pause, until resumed.
+	Paused *pauseRecord `json:"paused,omitempty"`
+
+	// Approvals records preemptions awaiting or granted approval, by the
+	// VMID of the starting VM.
+	Approvals map[string]approvalRequest `json:"approvals,omitempty"`
+
+	// Schedule records, for each [schedule] config line, when the window
+	// that it last handed over to its VM began.
+	Schedule map[string]time.Time `json:"schedule,omitempty"`
+
+	// Managed records the VMs that qmexmut hooked, so that any found hooked
+	// otherwise, like clones of them, can be told apart; it's nil until init
+	// or reconcile first establish it, so isn't omitted when empty.
+	Managed map[string]managedRecord `json:"managed"`
+}
+
+type preemptRecord struct {
+	Time    time.Time `json:"time"`
+	By      string    `json:"by"`
+	Stopped []string  `json:"stopped"`
+}
+
+func statePath() string {
+	return filepath.Join(stateDir, "state.json")
+}
+
+// readState reads the current state under a shared lock; a missing state
+// file is an empty state.
+func readState() (st state, _ error) {
+	return st, withStateLock(syscall.LOCK_SH, func() error {
+		return loadState(&st)
+	})
+}
+
+// updateState calls fn to modify the state under an exclusive lock, saving
+// the result unless fn fails; under -dry-run, nothing is saved.
+func updateState(fn func(st *state) error) error {
+	if dryRun {
+		var st state
+		if err := loadState(&st); err != nil {
+			return err
+		}
+		return fn(&st)
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	return withStateLock(syscall.LOCK_EX, func() error {
+		var st state
+		if err := loadState(&st); err != nil {
+			return err
+		}
+		if err := fn(&st); err != nil {
+			return err
+		}
+		return saveState(&st)
+	})
+}
+
+func withStateLock(how int, fn func() error) (rerr error) {
+	lockPath := filepath.Join(stateDir, "state.lock")
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if errors.Is(err, fs.ErrNotExist) && how == syscall.LOCK_SH {
+		return fn() // no state dir, so nothing to lock
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); rerr == nil {
+			rerr = err
+		}
+	}()
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		return fmt.Errorf("failed to lock %q: %w", lockPath, err)
+	}
+	return fn()
+}
+
+func loadState(st *state) error {
+	data, err := os.ReadFile(statePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return fmt.Errorf("invalid state file %q: %w", statePath(), err)
+	}
+	return nil
+}
+
+func saveState(st *state) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := statePath() + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath())
+}
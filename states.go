@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// unknownState is what to do about a mutual in an unrecognized qemu state.
+var unknownState = "skip"
+
+var unknownStates = []string{"skip", "stop", "deny"}
+
+// resumeHibernated is what to do when resuming a VM hibernated to disk would
+// preempt mutuals that took its devices meanwhile: preempt them, as for any
+// start, or deny the resume.
+var resumeHibernated = "preempt"
+
+var resumeHibernatedChoices = []string{"preempt", "deny"}
+
+// preemptProtected allows preempting VMs with proxmox's protection flag set,
+// which are otherwise never preempted.
+var preemptProtected = false
+
+func init() {
+	flag.Var(choiceFlag{&unknownState, unknownStates}, "unknown-state",
+		"what to do about mutuals in unknown states: skip them, hard stop them, or deny the start")
+	flag.Var(choiceFlag{&resumeHibernated, resumeHibernatedChoices}, "resume-hibernated",
+		"when resuming a hibernated VM would preempt mutuals: preempt or deny")
+	flag.BoolVar(&preemptProtected, "preempt-protected", false, "allow preempting VMs with the proxmox protection flag set")
+	vmSettings["resume-hibernated"] = "when resuming this VM from hibernation would preempt mutuals: preempt or deny"
+}
+
+var qmpStatusPat = regexp.MustCompile(`qmpstatus:\s*(.+)`)
+
+// vmState returns a VM's state, refining its qm list status: running VMs
+// report their qemu status (like paused), and stopped VMs that have been
+// suspended to disk are hibernated.
+func vmState(rec listRec, conf vmConfig) (string, error) {
+	switch rec.status {
+	case "running":
+		state, err := matchCommandOnce(exec.Command("qm", "status", rec.id, "--verbose"), qmpStatusPat)
+		if state == "" {
+			state = rec.status
+		}
+		return state, err
+	case "stopped":
+		if conf["vmstate"] != "" {
+			return "hibernated", nil
+		}
+	}
+	return rec.status, nil
+}
+
+// preemptAction decides what to do about a mutual VM, by its state, when
+// starting a VM that shares host resources with it; protected VMs are never
+// preempted, unless preemptProtected.
+func preemptAction(vm vmInfo) string {
+	action := stateAction(vm.state)
+	if isPreempting(action) && vm.config.protected() && !preemptProtected {
+		return actionDeny
+	}
+	return action
+}
+
+func stateAction(state string) string {
+	switch state {
+	case "running":
+		return actionShutdown
+
+	case "stopped", "hibernated":
+		// hibernated VMs hold no devices until resumed
+		return actionNone
+
+	case "paused", "suspended":
+		// a paused guest can't respond to shutdown
+		return actionResume
+
+	case "prelaunch", "io-error", "internal-error", "guest-panicked", "shutdown":
+		// qemu holds devices, but the guest can't shut itself down
+		return actionStop
+
+	default:
+		switch unknownState {
+		case "stop":
+			return actionStop
+		case "deny":
+			return actionDeny
+		default:
+			return actionSkip
+		}
+	}
+}
+
+// checkResume denies resuming a hibernated VM that would preempt mutuals,
+// if so configured.
+func checkResume(self vmInfo, stopping []vmInfo) error {
+	if self.state != "hibernated" || len(stopping) == 0 {
+		return nil
+	}
+	mode := resumeHibernated
+	if val, ok := self.setting("resume-hibernated"); ok {
+		if !hasString(val, resumeHibernatedChoices) {
+			return fmt.Errorf("vm #%v: invalid resume-hibernated %q", self.id, val)
+		}
+		mode = val
+	}
+	if mode != "deny" {
+		return nil
+	}
+	ids := make([]string, len(stopping))
+	for i, vm := range stopping {
+		ids[i] = "#" + vm.id
+	}
+	return withExitCode(exitDenied, fmt.Errorf("resuming from hibernation would preempt %v", strings.Join(ids, ", ")))
+}
+
+// protected returns true if the proxmox protection flag is set.
+func (conf vmConfig) protected() bool {
+	return conf["protection"] == "1"
+}
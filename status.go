@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runStatus prints every VM along with the host resources that it passes
+// thru, and any mutuals that it shares them with.
+func runStatus(args []string) error {
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: status"))
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	var tab table
+	tab.header("VMID", "NAME", "STATUS", "HOOKED", "RESOURCES", "MUTUALS")
+	for _, vm := range vms {
+		statusCell := plain(vm.state)
+		if vm.status == "running" {
+			statusCell.color = colorGreen
+		}
+
+		hooked := plain("no")
+		if isOurHook(vm.config["hookscript"]) {
+			hooked = plain("yes")
+		} else if len(exclusiveResources(vm.resources)) > 0 {
+			hooked.color = colorYellow
+		}
+
+		var mutualIds []string
+		conflict := false
+		for _, other := range vms {
+			if !areMutuals(vm, other) {
+				continue
+			}
+			mutualIds = append(mutualIds, other.id)
+			if vm.status == "running" && other.status == "running" {
+				conflict = true
+			}
+		}
+		mutualCell := plain(strings.Join(mutualIds, ","))
+		if conflict {
+			mutualCell.color = colorRed
+		}
+
+		tab.add(
+			plain(vm.id),
+			plain(vm.name),
+			statusCell,
+			hooked,
+			plain(describeResources(vm.resources)),
+			mutualCell,
+		)
+	}
+	if err := printTable(&tab); err != nil {
+		return err
+	}
+
+	// name the devices in a separate table, rather than widening the first
+	var labels []string
+	for _, vm := range vms {
+		for _, label := range vm.resources {
+			if !hasString(label, labels) {
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	var devTab table
+	devTab.header("DEVICE", "ALIAS", "NAME")
+	for _, label := range labels {
+		name, alias := deviceName(label), labelAlias(label)
+		if name != "" || alias != "" {
+			devTab.add(plain(label), plain(alias), plain(name))
+		}
+	}
+	if len(devTab.rows) > 1 {
+		fmt.Println()
+		if err := printTable(&devTab); err != nil {
+			return err
+		}
+	}
+
+	// and the last decision affecting each VM, so that troubleshooting
+	// doesn't take digging thru the event log
+	decisions, err := lastDecisions()
+	if err != nil {
+		return err
+	}
+	var decTab table
+	decTab.header("VMID", "TIME", "LAST DECISION")
+	for _, vm := range vms {
+		if ev, ok := decisions[vm.id]; ok {
+			desc := colored(decisionColor(ev), describeDecision(ev, preemptedOver(ev)))
+			decTab.add(plain(vm.id), plain(ev.Time.Format(time.RFC3339)), desc)
+		}
+	}
+	if len(decTab.rows) == 1 {
+		return nil
+	}
+	fmt.Println()
+	return printTable(&decTab)
+}
+
+// decisionKinds lists the kinds of event that record a decision made about
+// a VM.
+var decisionKinds = []eventKind{kindShutdown, kindDeny, kindCancel, kindViolation, kindBoot, kindSchedule}
+
+// lastDecisions returns the last decision event recorded for each VM.
+func lastDecisions() (map[string]event, error) {
+	decisions := make(map[string]event)
+	if err := readEvents(func(ev event) {
+		if ev.VMID != "" && hasKind(ev.Kind, decisionKinds) {
+			decisions[ev.VMID] = ev
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+// describeDecision describes a decision event about its VM, naming any
+// resources over which it was stopped.
+func describeDecision(ev event, over []string) string {
+	switch ev.Kind {
+	case kindShutdown:
+		desc := fmt.Sprintf("stopped by %v for vm #%v", ev.Method, ev.By)
+		if len(over) > 0 {
+			desc += " over " + describeDevices(over)
+		}
+		if ev.Error != "" {
+			desc += ", failed: " + ev.Error
+		}
+		return desc
+	case kindDeny:
+		return "start denied: " + ev.Error
+	case kindCancel:
+		return "start cancelled"
+	case kindViolation:
+		desc := fmt.Sprintf("ran together with vm #%v", ev.By)
+		if ev.Error != "" {
+			return desc + ", failed: " + ev.Error
+		}
+		return desc + ": " + ev.Reason
+	case kindBoot:
+		return fmt.Sprintf("onboot cleared for vm #%v", ev.By)
+	case kindSchedule:
+		if ev.Error != "" {
+			return "scheduled start failed: " + ev.Error
+		}
+		return "started by schedule: " + ev.Reason
+	}
+	return string(ev.Kind)
+}
+
+// decisionColor returns the color to show a decision event in.
+func decisionColor(ev event) string {
+	switch {
+	case ev.Error != "" || ev.Kind == kindDeny || ev.Kind == kindCancel || ev.Kind == kindViolation:
+		return colorRed
+	case ev.Kind == kindShutdown:
+		return colorYellow
+	case ev.Kind == kindSchedule:
+		return colorGreen
+	}
+	return colorNone
+}
+
+// preemptedOver returns the resources over which a shutdown event's VM was
+// preempted, if the state still records that preemption.
+func preemptedOver(ev event) (labels []string) {
+	st, err := readState()
+	if err != nil {
+		debugf("unable to read state: %v", err)
+		return nil
+	}
+	for label, rec := range st.Preemptions {
+		if rec.By == ev.By && hasString(ev.VMID, rec.Stopped) && !rec.Time.Before(ev.Time) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// runPlan prints what the hook would do when starting the given VM, or what
+// init would do if no VM is given; it changes nothing.
+func runPlan(args []string) error {
+	switch len(args) {
+	case 0:
+		return planInit()
+	case 1:
+		if _, ok := aliasLabel(args[0]); ok || strings.ContainsRune(args[0], ':') {
+			return planFree(args[0])
+		}
+		return planStart(args[0])
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("usage: plan [<vmid>|<resource>]"))
+	}
+}
+
+func planInit() error {
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	var tab table
+	tab.header("VMID", "NAME", "RESOURCES", "ACTION")
+	for _, vm := range vms {
+		action := plain("skip")
+		if len(exclusiveResources(vm.resources)) > 0 {
+			if isOurHook(vm.config["hookscript"]) {
+				action = colored(colorGreen, "already hooked")
+			} else {
+				action = colored(colorYellow, "set hookscript")
+			}
+		}
+		tab.add(plain(vm.id), plain(vm.name), plain(describeResources(vm.resources)), action)
+	}
+	return printTable(&tab)
+}
+
+func planStart(id string) error {
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	self := findVM(vms, id)
+	if self == nil {
+		return withExitCode(exitUsage, fmt.Errorf("no such vm #%v", id))
+	}
+
+	fmt.Printf("starting vm #%v (%v) would:\n", self.id, self.name)
+
+	var tab table
+	tab.header("VMID", "NAME", "STATUS", "SHARED", "ACTION")
+	for _, other := range vms {
+		if !areMutuals(*self, other) {
+			continue
+		}
+		shared := sharedResources(self.resources, other.resources)
+
+		action := preemptAction(other)
+		actionCell := plain(action)
+		switch {
+		case isPreempting(action):
+			actionCell.color = colorRed
+		case action == actionNone:
+			actionCell.color = colorGreen
+		default:
+			actionCell.color = colorYellow
+		}
+
+		tab.add(plain(other.id), plain(other.name), plain(other.state), plain(describeDevices(shared)), actionCell)
+	}
+	if len(tab.rows) == 1 {
+		fmt.Printf("  nothing, it has no mutuals\n")
+		return nil
+	}
+	return printTable(&tab)
+}
+
+// planFree prints what the free command would do for a resource.
+func planFree(arg string) error {
+	labels, err := resolveResources([]string{arg})
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("freeing %v would:\n", describeDevices(labels))
+
+	var tab table
+	tab.header("VMID", "NAME", "STATUS", "ACTION")
+	for _, vm := range vms {
+		if vm.status != "running" || len(heldLabels(vm, labels)) == 0 {
+			continue
+		}
+		action := preemptAction(vm)
+		actionCell := colored(colorYellow, action)
+		if isPreempting(action) {
+			actionCell.color = colorRed
+		}
+		tab.add(plain(vm.id), plain(vm.name), plain(vm.state), actionCell)
+	}
+	if len(tab.rows) == 1 {
+		fmt.Printf("  nothing, no running vm holds it\n")
+		return nil
+	}
+	return printTable(&tab)
+}
+
+// runCheck verifies that every VM that passes thru host resources is hooked,
+// that the hook stub matches the installed binary, and that no mutuals are
+// running together, returning an error if not. Under auto-unhook, it also
+// unhooks any hooked VM that passes thru no exclusive host resources.
+func runCheck(args []string) error {
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: check"))
+	}
+
+	vms, err := scanVMs()
+	if err != nil {
+		return err
+	}
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	var tab table
+	tab.header("VMID", "NAME", "RESULT", "DETAIL")
+	for _, vm := range vms {
+		hookscript := vm.config["hookscript"]
+		hooked := isOurHook(hookscript)
+
+		var results []cell
+		var details []string
+		problem := func(detail string) {
+			problems++
+			results = append(results, colored(colorRed, "problem"))
+			details = append(details, detail)
+		}
+
+		exclusive := exclusiveResources(vm.resources)
+		if len(exclusive) > 0 && !hooked {
+			if hookscript != "" {
+				problem(fmt.Sprintf("not hooked, hookscript is %q", hookscript))
+			} else {
+				problem("not hooked")
+			}
+		}
+		if len(exclusive) == 0 && hooked {
+			if !autoUnhook {
+				results = append(results, colored(colorYellow, "warning"))
+				details = append(details, "hooked, but passes thru no exclusive host resources")
+			} else if err := unhookAndForget(vm.id, vm.config); err != nil {
+				problem(fmt.Sprintf("passes thru no exclusive host resources, but unable to unhook: %v", err))
+			} else {
+				hooked = false
+				results = append(results, colored(colorGreen, "unhooked"))
+				details = append(details, "passes thru no exclusive host resources")
+			}
+		}
+		if _, known := st.Managed[vm.id]; !known && st.Managed != nil && hooked {
+			results = append(results, colored(colorYellow, "warning"))
+			details = append(details, "hooked outside of qmexmut, like by cloning a managed vm; reconcile or starting it registers it")
+		}
+		if prev := st.Hookscripts[vm.id]; prev != "" && hooked {
+			results = append(results, colored(colorYellow, "warning"))
+			details = append(details, fmt.Sprintf("hooked, shadowing original hookscript %q", prev))
+		}
+		if vm.status == "running" {
+			for _, other := range vms {
+				if other.status == "running" && areMutuals(vm, other) {
+					problem(fmt.Sprintf("running together with mutual #%v", other.id))
+				}
+			}
+		}
+		if len(results) == 0 && hooked {
+			results = append(results, colored(colorGreen, "ok"))
+			details = append(details, "")
+		}
+
+		for i, result := range results {
+			tab.add(plain(vm.id), plain(vm.name), result, plain(details[i]))
+		}
+	}
+
+	_, storeDir, err := findSnippets()
+	if err != nil {
+		return err
+	}
+	if detail := checkStub(path.Join(storeDir, "snippets", hookCmdName)); detail != "" {
+		problems++
+		tab.add(plain(""), plain(hookCmdName), colored(colorRed, "problem"), plain(detail))
+	}
+	if err := printTable(&tab); err != nil {
+		return err
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("check found %v problem(s)", problems)
+	}
+	return nil
+}
+
+// describeResources joins resource labels for display, marking any that are
+// shareable or ignored.
+func describeResources(labels []string) string {
+	descs := make([]string, len(labels))
+	for i, label := range labels {
+		descs[i] = label
+		if isShareable(label) {
+			descs[i] += "(shareable)"
+		} else if isIgnoredClass(label) {
+			descs[i] += "(ignored)"
+		} else if isIdenticalUSB(label) {
+			descs[i] += "(identical)"
+		} else if isDisabled(label) {
+			descs[i] += "(disabled)"
+		} else if n, ok := mdevAvailable(label); ok {
+			descs[i] += fmt.Sprintf("(%v free)", n)
+		}
+	}
+	return strings.Join(descs, ",")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hookSummary collects what a pre-start hook run did about each mutual, so
+// that it can be summarized at the end, rather than reconstructed from
+// interleaved log lines.
+type hookSummary struct {
+	mu        sync.Mutex
+	actions   map[string]string
+	shutdowns map[string]event
+}
+
+// summary is the summary of the current hook run.
+var summary hookSummary
+
+func init() {
+	subscribeEvents("the hook summary", true, func(ev event) error {
+		summary.noteEvent(ev)
+		return nil
+	})
+}
+
+// mutualResult summarizes what was done about one mutual.
+type mutualResult struct {
+	VMID   string  `json:"vmid"`
+	Action string  `json:"action"`
+	Method string  `json:"method,omitempty"`
+	Took   float64 `json:"took,omitempty"` // seconds
+	Error  string  `json:"error,omitempty"`
+}
+
+// noteActions records the action decided for each mutual.
+func (hs *hookSummary) noteActions(actions map[string]string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.actions = actions
+}
+
+// noteEvent records the outcome of any shutdown event.
+func (hs *hookSummary) noteEvent(ev event) {
+	if ev.Kind != kindShutdown {
+		return
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.shutdowns == nil {
+		hs.shutdowns = make(map[string]event)
+	}
+	hs.shutdowns[ev.VMID] = ev
+}
+
+func (hs *hookSummary) results() (results []mutualResult) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for id, action := range hs.actions {
+		if action == actionNone {
+			continue
+		}
+		res := mutualResult{VMID: id, Action: action}
+		if ev, ok := hs.shutdowns[id]; ok {
+			res.Method, res.Took, res.Error = ev.Method, ev.Took, ev.Error
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return vmidLess(results[i].VMID, results[j].VMID)
+	})
+	return results
+}
+
+// report prints a summary of a pre-start hook run for the given VM to stdout,
+// so that it shows in the proxmox start task log, and records it in the event
+// log.
+func (hs *hookSummary) report(vmid string, took time.Duration, err error) {
+	results := hs.results()
+	failed := 0
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "failed"
+		if exitCode(err) == exitDenied {
+			outcome = "denied"
+		}
+	}
+	fmt.Printf("qmexmut: vm #%v pre-start %v in %.1fs: %v mutual(s) affected, %v failed\n",
+		vmid, outcome, took.Seconds(), len(results), failed)
+	if len(results) > 0 {
+		var tab table
+		tab.header("  VMID", "ACTION", "METHOD", "TOOK", "ERROR")
+		for _, res := range results {
+			tookCell := ""
+			if res.Took > 0 {
+				tookCell = strconv.FormatFloat(res.Took, 'f', 1, 64) + "s"
+			}
+			tab.add(plain("  #"+res.VMID), plain(res.Action), plain(res.Method), plain(tookCell), plain(res.Error))
+		}
+		_ = tab.writeTo(os.Stdout, false)
+	}
+
+	ev := event{Kind: kindSummary, VMID: vmid, Took: took.Seconds(), Mutuals: results}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	recordEvent(ev)
+}
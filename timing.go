@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+var (
+	debugTiming bool
+	cpuProfile  string
+)
+
+func init() {
+	flag.BoolVar(&debugTiming, "debug-timing", false, "log how long each stage of a hook run takes")
+	flag.StringVar(&cpuProfile, "cpu-profile", "", "write a pprof cpu profile of the run to this file")
+}
+
+// timeStage starts timing a named stage, like listing or scanning VMs,
+// returning a function to call once it's done; with -debug-timing, the
+// duration of every stage is logged, to show what delays a VM start.
+func timeStage(name string) func() {
+	if !debugTiming {
+		return func() {}
+	}
+	t0 := time.Now()
+	return func() {
+		infof("timing: %v took %v", name, time.Since(t0))
+	}
+}
+
+// startProfile starts any -cpu-profile, returning a function to stop it.
+func startProfile() (func(), error) {
+	if cpuProfile == "" {
+		return func() {}, nil
+	}
+	f, err := os.Create(cpuProfile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cpu profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to start cpu profile: %w", err)
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		if err := f.Close(); err != nil {
+			warnf("unable to write cpu profile: %v", err)
+		}
+	}, nil
+}
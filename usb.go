@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// usbIdentity is how USB devices passed thru by vendor:product id are
+// identified: by that id, so that identical devices all conflict; or by the
+// port of the physical device, found in sysfs, so that only VMs using the same
+// physical device conflict.
+var usbIdentity = "id"
+
+var usbIdentities = []string{"id", "port"}
+
+// usbSysfs is where the host's USB devices are found.
+var usbSysfs = "/sys/bus/usb/devices"
+
+func init() {
+	flag.Var(choiceFlag{&usbIdentity, usbIdentities}, "usb-identity",
+		"identify USB devices passed thru by vendor:product id by that id, or by the port of the physical device")
+}
+
+var usbIDPat = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+var (
+	usbPortsOnce sync.Once
+	usbPorts     map[string][]string
+	usbIDs       map[string]string
+)
+
+// usbPortsByID returns the ports of all USB devices attached to the host,
+// keyed by lower case vendor:product id.
+func usbPortsByID() map[string][]string {
+	scanUSB()
+	return usbPorts
+}
+
+// usbIDsByPort returns the vendor:product id of all USB devices attached to
+// the host, keyed by port.
+func usbIDsByPort() map[string]string {
+	scanUSB()
+	return usbIDs
+}
+
+func scanUSB() {
+	usbPortsOnce.Do(func() {
+		usbPorts = make(map[string][]string)
+		usbIDs = make(map[string]string)
+		ents, err := os.ReadDir(usbSysfs)
+		if err != nil {
+			debugf("unable to list usb devices: %v", err)
+			return
+		}
+		for _, ent := range ents {
+			port := ent.Name()
+			if strings.ContainsAny(port, ":") || strings.HasPrefix(port, "usb") {
+				continue // interfaces and root hubs
+			}
+			vendor, verr := os.ReadFile(filepath.Join(usbSysfs, port, "idVendor"))
+			product, perr := os.ReadFile(filepath.Join(usbSysfs, port, "idProduct"))
+			if verr != nil || perr != nil {
+				continue
+			}
+			id := strings.ToLower(strings.TrimSpace(string(vendor)) + ":" + strings.TrimSpace(string(product)))
+			usbPorts[id] = append(usbPorts[id], port)
+			usbIDs[port] = id
+		}
+	})
+}
+
+// usbLabel returns the label for a USB device passed thru by the given host
+// value. Under usbIdentity port, a vendor:product id that matches exactly one
+// attached device is identified by its port instead.
+func usbLabel(host string) string {
+	if usbIdentity == "port" && usbIDPat.MatchString(host) {
+		if ports := usbPortsByID()[strings.ToLower(host)]; len(ports) == 1 {
+			return "hostusb:" + ports[0]
+		}
+	}
+	return "hostusb:" + host
+}
+
+// isIdenticalUSB returns true if a label names a USB vendor:product id that
+// matches several attached devices under usbIdentity port; since each VM then
+// gets its own device, such labels never conflict.
+func isIdenticalUSB(label string) bool {
+	if usbIdentity != "port" || resourceClass(label) != "hostusb" {
+		return false
+	}
+	id := strings.TrimPrefix(label, "hostusb:")
+	return usbIDPat.MatchString(id) && len(usbPortsByID()[strings.ToLower(id)]) > 1
+}
+
+// dedupeUSB drops any USB port labels for a device that's also labeled by its
+// vendor:product id, as when a VM passes thru the same device twice, once by
+// port and once by id; under usbIdentity port, usbLabel already resolves ids
+// to ports.
+func dedupeUSB(labels []string) []string {
+	kept := labels[:0]
+	for _, label := range labels {
+		if resourceClass(label) == "hostusb" {
+			if id, ok := usbIDsByPort()[strings.TrimPrefix(label, "hostusb:")]; ok && hasString("hostusb:"+id, labels) {
+				continue
+			}
+		}
+		kept = append(kept, label)
+	}
+	return kept
+}
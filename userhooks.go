@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Commands run at points during a hook run, so that sites can integrate their
+// own logic, like switching a KVM or toggling a smart plug, without changing
+// qmexmut. Each is given details of the event as JSON on stdin, and in
+// QMEXMUT_* environment variables; their failure is only logged.
+var (
+	beforePreemptExec string
+	afterPreemptExec  string
+	onDenyExec        string
+	onYieldBackExec   string
+	onAskExec         string
+	userHookTimeout   = 30 * time.Second
+)
+
+func init() {
+	flag.StringVar(&beforePreemptExec, "before-preempt-exec", "", "command to run before preempting mutuals")
+	flag.StringVar(&afterPreemptExec, "after-preempt-exec", "", "command to run after preempting mutuals")
+	flag.StringVar(&onDenyExec, "on-deny-exec", "", "command to run when a start is denied")
+	flag.StringVar(&onYieldBackExec, "on-yield-back-exec", "", "command to run before restarting preempted VMs under yield-back")
+	flag.StringVar(&onAskExec, "on-ask-exec", "", "command to run when preempting mutuals awaits approval")
+	flag.DurationVar(&userHookTimeout, "hook-exec-timeout", userHookTimeout, "how long to let any of the above -exec commands run")
+}
+
+// userHookEvent describes the event that a user hook command is run for.
+type userHookEvent struct {
+	Point   string   `json:"point"`
+	VMID    string   `json:"vmid"`              // the starting VM, or the stopped one for yield-back
+	Mutuals []string `json:"mutuals,omitempty"` // preempted, or restarted for yield-back
+	Error   string   `json:"error,omitempty"`
+}
+
+// runUserHook runs any user hook command for an event.
+func runUserHook(command string, ev userHookEvent) {
+	if command == "" {
+		return
+	}
+	argv, err := splitCommandLine(command)
+	if err != nil || len(argv) == 0 {
+		warnf("invalid %v-exec command %q: %v", ev.Point, command, err)
+		return
+	}
+	if dryRun {
+		infof("would run %v-exec %q", ev.Point, argv)
+		return
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		warnf("unable to encode %v event: %v", ev.Point, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), userHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr // keep our stdout for the start task log
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"QMEXMUT_POINT="+ev.Point,
+		"QMEXMUT_VMID="+ev.VMID,
+		"QMEXMUT_MUTUALS="+strings.Join(ev.Mutuals, ","),
+		"QMEXMUT_ERROR="+ev.Error,
+	)
+	done := traceCommand(cmd)
+	err = cmd.Run()
+	done(err)
+	if ctx.Err() != nil {
+		warnf("%v-exec %q timed out after %v", ev.Point, argv, userHookTimeout)
+	} else if err != nil {
+		warnf("%v-exec %q failed: %v", ev.Point, argv, err)
+	}
+}
+
+// vmIDs returns the ids of the given VMs.
+func vmIDs(vms []vmInfo) []string {
+	ids := make([]string, len(vms))
+	for i, vm := range vms {
+		ids[i] = vm.id
+	}
+	return ids
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mdevOption returns any mediated device type, like nvidia-63 for an NVIDIA
+// vGPU profile, from the options of a hostpci config value.
+func mdevOption(opts string) string {
+	for _, opt := range strings.Split(opts, ",") {
+		if strings.HasPrefix(opt, "mdev=") {
+			return opt[len("mdev="):]
+		}
+	}
+	return ""
+}
+
+var (
+	mdevMu    sync.Mutex
+	mdevAvail = make(map[string]int)
+)
+
+// mdevAvailable returns how many more instances of a mediated device type may
+// be created on a GPU, as labeled like hostpci:0000:01:00/nvidia-63, from
+// sysfs; false is returned for labels of no mediated device, or any type whose
+// count is unknown.
+func mdevAvailable(label string) (int, bool) {
+	if resourceClass(label) != "hostpci" {
+		return 0, false
+	}
+	i := strings.IndexByte(label, '/')
+	if i < 0 {
+		return 0, false
+	}
+	dev, typ := strings.TrimPrefix(label[:i], "hostpci:"), label[i+1:]
+
+	mdevMu.Lock()
+	defer mdevMu.Unlock()
+	if n, ok := mdevAvail[label]; ok {
+		return n, n >= 0
+	}
+	n := -1
+	pat := filepath.Join(pciSysfs, dev+"*", "mdev_supported_types", typ, "available_instances")
+	if matches, _ := filepath.Glob(pat); len(matches) > 0 {
+		if data, err := os.ReadFile(matches[0]); err == nil {
+			if v, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				n = v
+			}
+		}
+	}
+	mdevAvail[label] = n
+	return n, n >= 0
+}
+
+// isSpareMdev returns true if a label names a mediated device type of which
+// more instances may still be created; VMs using such a vGPU profile only
+// conflict once the GPU is fully partitioned.
+func isSpareMdev(label string) bool {
+	n, ok := mdevAvailable(label)
+	return ok && n > 0
+}
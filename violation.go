@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// onViolation is what reconcile does about mutuals found running together,
+// like after a start that bypassed the hook:
+//   - alert only logs and records the violation
+//   - stop-newer stops whichever VM started most recently
+//   - stop-priority stops whichever VM has the lower boot-priority, or else
+//     the newer one
+//   - stop-higher-vmid stops whichever VM has the higher VMID
+var onViolation = "alert"
+
+var violationResponses = []string{"alert", "stop-newer", "stop-priority", "stop-higher-vmid"}
+
+func init() {
+	flag.Var(choiceFlag{&onViolation, violationResponses}, "on-violation",
+		"what to do about mutuals running together: alert, stop-newer, stop-priority, or stop-higher-vmid")
+}
+
+var uptimePat = regexp.MustCompile(`uptime:\s*(\d+)`)
+
+// vmUptime returns how many seconds a running VM has been up.
+func vmUptime(id string) (int, error) {
+	s, err := matchCommandOnce(exec.Command("qm", "status", id, "--verbose"), uptimePat)
+	if err != nil {
+		return 0, err
+	}
+	if s == "" {
+		return 0, fmt.Errorf("vm #%v: no uptime reported", id)
+	}
+	return strconv.Atoi(s)
+}
+
+// checkViolations finds any mutuals running together, recording a violation
+// event for each pair, and responding as set by onViolation; it returns the
+// number of violations found.
+func checkViolations(vms []vmInfo) (int, error) {
+	running := make([]bool, len(vms))
+	for i, vm := range vms {
+		running[i] = vm.status == "running"
+	}
+
+	found := 0
+	var firstErr error
+	for i := range vms {
+		for j := i + 1; j < len(vms); j++ {
+			if !running[i] || !running[j] || !areMutuals(vms[i], vms[j]) {
+				continue
+			}
+			found++
+			a, b := vms[i], vms[j]
+			if onViolation == "alert" {
+				recordEvent(event{Kind: kindViolation, VMID: a.id, By: b.id, Reason: "alert only"})
+				continue
+			}
+			keep, stop, reason, err := violationLoser(a, b)
+			if err != nil {
+				recordEvent(event{Kind: kindViolation, VMID: a.id, By: b.id, Error: err.Error()})
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			recordEvent(event{Kind: kindViolation, VMID: stop.id, By: keep.id, Reason: reason})
+			if err := shutdownVM(keep.id, stop); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if stop.id == a.id {
+				running[i] = false
+			} else {
+				running[j] = false
+			}
+		}
+	}
+	return found, firstErr
+}
+
+// violationLoser decides which of two mutuals running together to stop, as
+// set by onViolation, explaining why.
+func violationLoser(a, b vmInfo) (keep, stop vmInfo, reason string, _ error) {
+	switch onViolation {
+	case "stop-higher-vmid":
+		if vmidLess(b.id, a.id) {
+			a, b = b, a
+		}
+		return a, b, "higher vmid", nil
+
+	case "stop-priority":
+		pa, err := bootPriority(a)
+		if err != nil {
+			return a, b, "", err
+		}
+		pb, err := bootPriority(b)
+		if err != nil {
+			return a, b, "", err
+		}
+		if pa != pb {
+			if pb > pa {
+				a, b, pa, pb = b, a, pb, pa
+			}
+			return a, b, fmt.Sprintf("lower boot-priority %v than %v", pb, pa), nil
+		}
+	}
+
+	ua, err := vmUptime(a.id)
+	if err != nil {
+		return a, b, "", err
+	}
+	ub, err := vmUptime(b.id)
+	if err != nil {
+		return a, b, "", err
+	}
+	if ua == ub {
+		if vmidLess(b.id, a.id) {
+			a, b = b, a
+		}
+		return a, b, "started at the same time, with a higher vmid", nil
+	}
+	if ua < ub {
+		a, b, ua, ub = b, a, ub, ua
+	}
+	return a, b, fmt.Sprintf("started more recently, up %vs rather than %vs", ub, ua), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+)
+
+var autoUnhook bool
+
+func init() {
+	flag.BoolVar(&autoUnhook, "auto-unhook", false, "unhook any hooked VM found to pass thru no exclusive host resources when it starts, or by check")
+}
+
+// runHookVM hooks a single VM, without the full sweep of init; the hook
+// snippet must already have been installed by init.
+func runHookVM(args []string) error {
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: hook-vm <vmid>"))
+	}
+	id := args[0]
+
+	snippetStore, storeDir, err := findSnippets()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(storeDir, "snippets", hookCmdName)); err != nil {
+		return withExitCode(exitEnvironment, fmt.Errorf("no hook snippet installed, run qmexmut init first: %w", err))
+	}
+
+	hooked, err := hookVM(id, fmt.Sprintf("%s:snippets/%s", snippetStore, hookCmdName))
+	if err != nil {
+		return err
+	}
+	if !hooked {
+		infof("vm #%v not hooked: it's either already hooked, or passes thru no exclusive host resources", id)
+	}
+	return nil
+}
+
+// runUnhookVM unhooks a single VM, restoring any hookscript that init
+// replaced, and forgets any state kept for it.
+func runUnhookVM(args []string) error {
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: unhook-vm <vmid>"))
+	}
+	id := args[0]
+
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return err
+	}
+	return unhookAndForget(id, conf)
+}
+
+// unhookAndForget unhooks a VM, restoring any hookscript that init replaced,
+// and forgets any state kept for it.
+func unhookAndForget(id string, conf vmConfig) error {
+	st, err := readState()
+	if err != nil {
+		return err
+	}
+	if err := unhookVM(vmInfo{listRec: listRec{id: id}, config: conf}, st.Hookscripts[id]); err != nil {
+		return err
+	}
+	return updateState(func(st *state) error {
+		st.forget(id)
+		return nil
+	})
+}
+
+// unmanagedConfig returns the config of a VM, and whether it passes thru no
+// exclusive host resources, as when its passthru entries were removed since
+// it was hooked; such a VM needs no management.
+func unmanagedConfig(id string) (vmConfig, bool, error) {
+	conf, err := readVMConfig(id)
+	if err != nil {
+		return nil, false, err
+	}
+	return conf, len(exclusiveResources(conf.hostResources())) == 0, nil
+}
+
+// forget removes all state kept for a VM.
+func (st *state) forget(id string) {
+	st.dequeue(id)
+	for label, lease := range st.Leases {
+		if lease.VMID == id {
+			delete(st.Leases, label)
+		}
+	}
+	delete(st.Starts, id)
+	delete(st.Chains, id)
+	delete(st.Hookscripts, id)
+	delete(st.Managed, id)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often the watch daemon reconciles.
+var watchInterval = time.Minute
+
+// configPollInterval is how often the watch daemon checks whether the config
+// file has changed.
+const configPollInterval = 5 * time.Second
+
+func init() {
+	flag.DurationVar(&watchInterval, "watch-interval", watchInterval, "how often watch reconciles")
+}
+
+// watchUnitPath is where the watch unit should be installed.
+const watchUnitPath = "/etc/systemd/system/qmexmut-watch.service"
+
+// watchUnit is a systemd unit that runs the watch daemon, using the binary
+// installed by init.
+const watchUnit = `[Unit]
+Description=Keep VMs that pass thru host resources hooked and exclusive
+After=pve-cluster.service
+
+[Service]
+Type=notify
+ExecStart=%v watch
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+WatchdogSec=15min
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// runWatch runs as a daemon, reconciling every watchInterval; the config file
+// is reloaded on SIGHUP or once it changes, after which it reconciles right
+// away, so that any changed settings or rules apply.
+//
+// With a -unit argument, it instead prints a systemd unit to run it.
+func runWatch(args []string) error {
+	if len(args) == 1 && args[0] == "-unit" {
+		fmt.Printf(watchUnit, libPath())
+		return nil
+	}
+	if len(args) != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: watch [-unit]"))
+	}
+
+	watchStatus.since = time.Now()
+	reqs := make(chan ctlRequest)
+	ln, err := listenCtl(reqs)
+	if err != nil {
+		return withExitCode(exitEnvironment, fmt.Errorf("unable to listen on control socket: %w", err))
+	}
+	defer ln.Close()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+	interval := watchInterval
+	tick := time.NewTicker(interval)
+	defer func() { tick.Stop() }()
+	sched := time.NewTicker(schedulePoll)
+	defer sched.Stop()
+
+	// ping any systemd watchdog from the loop, so that a wedged loop is
+	// restarted
+	var watchdog <-chan time.Time
+	if d := sdWatchdogInterval(); d > 0 {
+		wd := time.NewTicker(d)
+		defer wd.Stop()
+		watchdog = wd.C
+	}
+
+	stamp := configStamp()
+	infof("watching, reconciling every %v", interval)
+	sdNotify("READY=1")
+	watchReconcile()
+	watchSchedule(time.Now())
+	for {
+		reload := ""
+		select {
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+		case sig := <-stop:
+			infof("stopping on %v", sig)
+			return nil
+		case <-hup:
+			reload = "SIGHUP"
+		case <-poll.C:
+			if s := configStamp(); s != stamp {
+				reload = "config file changed"
+			}
+		case <-tick.C:
+			watchReconcile()
+		case now := <-sched.C:
+			watchSchedule(now)
+		case req := <-reqs:
+			var resp ctlResponse
+			out, err := handleCtl(req.Args)
+			resp.Output = out
+			if err != nil {
+				resp.Error = err.Error()
+			}
+			req.reply <- resp
+		}
+		if reload != "" {
+			stamp = configStamp()
+			if _, err := reloadConfig(reload); err == nil {
+				watchReconcile()
+			}
+		}
+		if watchInterval != interval {
+			interval = watchInterval
+			tick.Stop()
+			tick = time.NewTicker(interval)
+			infof("now reconciling every %v", interval)
+		}
+	}
+}
+
+// watchStatus is what the watch daemon reports about itself; it's only used
+// by the watch loop.
+var watchStatus struct {
+	since         time.Time
+	lastReconcile time.Time
+	lastErr       error
+}
+
+// describeWatch describes the watch daemon's status for ctl status.
+func describeWatch() (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "watching since %v, reconciling every %v\n", watchStatus.since.Format(time.RFC3339), watchInterval)
+	fmt.Fprintf(&sb, "config: %v\n", configPath)
+	if watchStatus.lastReconcile.IsZero() {
+		fmt.Fprintf(&sb, "last reconcile: never\n")
+	} else if watchStatus.lastErr != nil {
+		fmt.Fprintf(&sb, "last reconcile: %v, failed: %v\n", watchStatus.lastReconcile.Format(time.RFC3339), watchStatus.lastErr)
+	} else {
+		fmt.Fprintf(&sb, "last reconcile: %v, ok\n", watchStatus.lastReconcile.Format(time.RFC3339))
+	}
+	paused, err := enforcementPaused()
+	if err != nil {
+		return "", err
+	}
+	if paused == nil {
+		fmt.Fprintf(&sb, "enforcement: active")
+		return sb.String(), nil
+	}
+	fmt.Fprintf(&sb, "enforcement: paused since %v", paused.Time.Format(time.RFC3339))
+	if paused.Node != "" {
+		fmt.Fprintf(&sb, " on every node, by %v", paused.Node)
+	}
+	if paused.Until != nil {
+		fmt.Fprintf(&sb, ", until %v", paused.Until.Format(time.RFC3339))
+	}
+	if paused.Reason != "" {
+		fmt.Fprintf(&sb, ": %v", paused.Reason)
+	}
+	return sb.String(), nil
+}
+
+// configStamp identifies the current version of the config file.
+func configStamp() string {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v %v", info.ModTime().UnixNano(), info.Size())
+}
+
+// reloadConfig reloads the config file, logging and returning what changed
+// in the effective config; if the new config is invalid, the prior one is
+// kept.
+func reloadConfig(why string) ([]string, error) {
+	prior := config
+	cf, err := readConfig()
+	if err == nil {
+		err = applyConfig(cf)
+		if err != nil {
+			if rerr := applyConfig(prior); rerr != nil {
+				errorf("unable to restore prior config: %v", rerr)
+			}
+		}
+	}
+	if err != nil {
+		errorf("not reloading config on %v: %v", why, err)
+		return nil, err
+	}
+	resetConfigCaches()
+
+	changes := diffConfigDocs(configDocOf(prior), configDocOf(config))
+	if len(changes) == 0 {
+		infof("reloaded config on %v, nothing changed", why)
+	} else {
+		infof("reloaded config on %v:", why)
+		for _, change := range changes {
+			infof("  %v", change)
+		}
+	}
+	recordEvent(event{Kind: kindReload, Reason: strings.Join(changes, "; ")})
+	return changes, nil
+}
+
+// resetConfigCaches forgets anything parsed from the prior config.
+func resetConfigCaches() {
+	loadRulesOnce = sync.Once{}
+	loadedRules, loadRulesErr = nil, nil
+	loadAliasesOnce = sync.Once{}
+	loadBlackoutsOnce = sync.Once{}
+	loadedBlackouts, loadBlackoutsErr = nil, nil
+	loadScheduleOnce = sync.Once{}
+	loadedSchedule, loadScheduleErr = nil, nil
+	loadNotifiersOnce = sync.Once{}
+	loadedNotifiers, loadNotifiersErr = nil, nil
+}
+
+// resetHostCaches forgets what's been learned about host devices, which may
+// change between reconciles.
+func resetHostCaches() {
+	usbPortsOnce = sync.Once{}
+	disabledOnce = sync.Once{}
+	mdevMu.Lock()
+	mdevAvail = make(map[string]int)
+	mdevMu.Unlock()
+}
+
+func watchReconcile() {
+	if paused, err := enforcementPaused(); err != nil {
+		errorf("unable to read state: %v", err)
+		return
+	} else if paused != nil {
+		debugf("enforcement paused, not reconciling")
+		return
+	}
+	resetHostCaches()
+	err := runReconcile(nil)
+	if err != nil {
+		errorf("reconcile failed: %v", err)
+	}
+	watchStatus.lastReconcile, watchStatus.lastErr = time.Now(), err
+	saveConfigCache()
+}
+
+// watchSchedule runs the schedule, unless enforcement is paused.
+func watchSchedule(now time.Time) {
+	if paused, err := enforcementPaused(); err != nil {
+		errorf("unable to read state: %v", err)
+		return
+	} else if paused != nil {
+		debugf("enforcement paused, not running schedule")
+		return
+	}
+	if err := runSchedule(now); err != nil {
+		errorf("schedule failed: %v", err)
+	}
+}
+
+// diffConfigDocs describes each difference between two config documents.
+func diffConfigDocs(a, b configDoc) (changes []string) {
+	changes = diffSettings("", a.Settings, b.Settings)
+
+	var names []string
+	for name := range a.Sections {
+		names = append(names, name)
+	}
+	for name := range b.Sections {
+		if _, dup := a.Sections[name]; !dup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, had := a.Sections[name]
+		_, has := b.Sections[name]
+		switch {
+		case !had:
+			changes = append(changes, fmt.Sprintf("added [%v]", name))
+		case !has:
+			changes = append(changes, fmt.Sprintf("removed [%v]", name))
+		}
+		changes = append(changes, diffSettings(fmt.Sprintf("[%v] ", name), a.Sections[name], b.Sections[name])...)
+	}
+
+	names = names[:0]
+	for name := range a.Raw {
+		names = append(names, name)
+	}
+	for name := range b.Raw {
+		if _, dup := a.Raw[name]; !dup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		before, after := a.Raw[name], b.Raw[name]
+		n := len(changes)
+		for _, line := range before {
+			if !hasString(line, after) {
+				changes = append(changes, fmt.Sprintf("[%v] removed %v", name, line))
+			}
+		}
+		for _, line := range after {
+			if !hasString(line, before) {
+				changes = append(changes, fmt.Sprintf("[%v] added %v", name, line))
+			}
+		}
+		// rules are evaluated in order, so reordering them matters
+		if len(changes) == n && strings.Join(before, "\n") != strings.Join(after, "\n") {
+			changes = append(changes, fmt.Sprintf("[%v] reordered", name))
+		}
+	}
+	return changes
+}
+
+func diffSettings(prefix string, a, b map[string]string) (changes []string) {
+	keys := sortedKeys(a)
+	for _, key := range sortedKeys(b) {
+		if _, dup := a[key]; !dup {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		before, had := a[key]
+		after, has := b[key]
+		switch {
+		case !had:
+			changes = append(changes, fmt.Sprintf("%vset %v = %v", prefix, key, after))
+		case !has:
+			changes = append(changes, fmt.Sprintf("%vunset %v, was %v", prefix, key, before))
+		case before != after:
+			changes = append(changes, fmt.Sprintf("%vchanged %v from %v to %v", prefix, key, before, after))
+		}
+	}
+	return changes
+}
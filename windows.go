@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Windows guests, detected by their ostype, often take a long time to shut
+// down, especially while installing updates, which a hard stop may corrupt.
+var (
+	windowsShutdownTimeout = 600
+	windowsUpdateWait      = 0
+)
+
+func init() {
+	flag.IntVar(&windowsShutdownTimeout, "windows-shutdown-timeout", windowsShutdownTimeout,
+		"seconds that the auto shutdown method waits for a windows guest before a hard stop, when no timeout is given")
+	flag.IntVar(&windowsUpdateWait, "windows-update-wait", 0,
+		"seconds to wait for a windows guest to finish installing updates before shutting it down; needs its guest agent")
+	vmSettings["windows-update-wait"] = "seconds to wait for windows updates before shutdown"
+}
+
+// windowsUpdatePoll is how often to check whether a windows guest is still
+// installing updates.
+const windowsUpdatePoll = 15 * time.Second
+
+// windowsUpdateCheck exits non-zero while a windows guest is installing
+// updates, as shown by the windows modules installer worker running.
+var windowsUpdateCheck = []string{
+	"powershell", "-NoProfile", "-NonInteractive", "-Command",
+	"if (Get-Process TiWorker -ErrorAction SilentlyContinue) { exit 1 }",
+}
+
+// isWindows returns true if the config's ostype is any windows version.
+func (conf vmConfig) isWindows() bool {
+	return strings.HasPrefix(conf["ostype"], "win")
+}
+
+// awaitWindowsUpdates waits, up to any windows-update-wait, for a windows
+// guest to finish installing updates before it's shut down; it only warns if
+// the guest can't be checked, or is still updating when time runs out.
+func awaitWindowsUpdates(vm vmInfo) error {
+	if !vm.config.isWindows() || vm.state != "running" {
+		return nil
+	}
+	wait := windowsUpdateWait
+	if val, ok := vm.setting("windows-update-wait"); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("vm #%v: invalid windows-update-wait: %w", vm.id, err)
+		}
+		wait = n
+	}
+	if wait <= 0 {
+		return nil
+	}
+	if !vm.config.agentEnabled() {
+		debugf("not waiting for updates in vm #%v: no guest agent", vm.id)
+		return nil
+	}
+	if dryRun {
+		infof("would wait up to %vs for vm #%v to finish installing updates", wait, vm.id)
+		return nil
+	}
+
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		updating, err := windowsUpdating(vm.id)
+		if err != nil {
+			warnf("unable to check for updates in vm #%v: %v", vm.id, err)
+			return nil
+		}
+		if !updating {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			warnf("vm #%v is still installing updates after %vs, shutting it down anyway", vm.id, wait)
+			return nil
+		}
+		infof("waiting for vm #%v to finish installing updates", vm.id)
+		time.Sleep(windowsUpdatePoll)
+	}
+}
+
+// windowsUpdating runs windowsUpdateCheck in a guest by its agent.
+func windowsUpdating(id string) (bool, error) {
+	var res struct {
+		ExitCode int `json:"exitcode"`
+		Exited   int `json:"exited"`
+	}
+	args := append([]string{"guest", "exec", id, "--"}, windowsUpdateCheck...)
+	if err := decodeJSONCommand(&res, exec.Command("qm", args...)); err != nil {
+		return false, err
+	}
+	if res.Exited == 0 {
+		return false, fmt.Errorf("update check didn't finish")
+	}
+	return res.ExitCode != 0, nil
+}